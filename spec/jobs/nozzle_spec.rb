@@ -0,0 +1,126 @@
+require 'rspec'
+require 'bosh/template/test'
+require 'yaml'
+
+describe 'nozzle-for-microsoft-azure-log-analytics-src job' do
+  let(:job_name) { 'nozzle-for-microsoft-azure-log-analytics-src' }
+  let(:release_dir) { File.join(File.dirname(__FILE__), '../..') }
+  let(:job) { Bosh::Template::Test::ReleaseDir.new(release_dir).job(job_name) }
+  let(:properties) do
+    {
+      'cf' => { 'api_address' => 'https://api.sys.example.com', 'user' => 'nozzle', 'password' => 'secret' },
+      'output' => { 'data_collector' => { 'workspace' => 'workspace-id', 'key' => 'workspace-key' } }
+    }
+  end
+  let(:cloud_controller) do
+    Bosh::Template::Test::Link.new(name: 'cloud_controller', properties: { 'system_domain' => 'sys.example.com' })
+  end
+
+  describe 'config/nozzle.yml' do
+    let(:template) { job.template('config/nozzle.yml') }
+
+    it 'renders the properties set as the config file' do
+      expect(YAML.safe_load(template.render(properties))).to eq(properties)
+    end
+
+    it 'renders every setting of the job' do
+      spec = YAML.safe_load(File.read(File.join(release_dir, 'jobs', job_name, 'spec')))
+      settings = spec['properties'].keys - ['output.entra_id.certificate']
+      all = {}
+      settings.each do |name|
+        *sections, key = name.split('.')
+        sections.inject(all) { |section, s| section[s] ||= {} }[key] = "#{name} value"
+      end
+
+      config = YAML.safe_load(template.render(all))
+      settings.each do |name|
+        expect(config.dig(*name.split('.'))).to eq("#{name} value")
+      end
+    end
+
+    it 'renders lists and maps' do
+      properties['filter'] = { 'rules' => ['exclude eventType=LogMessage sourceType=RTR', 'exclude org=system'] }
+      properties['output']['logs_ingestion'] = { 'streams' => { 'CF_LogMessage' => 'Custom-CFLogs_CL' } }
+
+      config = YAML.safe_load(template.render(properties))
+      expect(config['filter']['rules']).to eq(['exclude eventType=LogMessage sourceType=RTR', 'exclude org=system'])
+      expect(config['output']['logs_ingestion']['streams']).to eq('CF_LogMessage' => 'Custom-CFLogs_CL')
+    end
+
+    it 'renders outputs and routes' do
+      properties['outputs'] = [{ 'name' => 'payments', 'data_collector' => { 'workspace' => 'payments-id', 'key' => 'payments-key' } }]
+      properties['routes'] = ['payments org=payments']
+
+      config = YAML.safe_load(template.render(properties))
+      expect(config['outputs']).to eq(properties['outputs'])
+      expect(config['routes']).to eq(['payments org=payments'])
+    end
+
+    it 'takes the API address from the cloud_controller link' do
+      properties['cf'].delete('api_address')
+
+      config = YAML.safe_load(template.render(properties, consumes: [cloud_controller]))
+      expect(config['cf']['api_address']).to eq('https://api.sys.example.com')
+    end
+
+    it 'prefers the API address property to the link' do
+      properties['cf']['api_address'] = 'https://api.other.example.com'
+
+      config = YAML.safe_load(template.render(properties, consumes: [cloud_controller]))
+      expect(config['cf']['api_address']).to eq('https://api.other.example.com')
+    end
+
+    it 'points to the certificate of the app registration' do
+      properties['output']['entra_id'] = { 'tenant_id' => 'tenant', 'client_id' => 'client', 'certificate' => 'PEM' }
+
+      config = YAML.safe_load(template.render(properties))
+      expect(config['output']['entra_id']).to eq(
+        'tenant_id' => 'tenant',
+        'client_id' => 'client',
+        'certificate_path' => "/var/vcap/jobs/#{job_name}/config/entra-id-certificate.pem"
+      )
+    end
+  end
+
+  describe 'config/entra-id-certificate.pem' do
+    it 'renders the certificate of the app registration' do
+      pem = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+      properties['output']['entra_id'] = { 'certificate' => pem }
+
+      expect(job.template('config/entra-id-certificate.pem').render(properties)).to include(pem)
+    end
+  end
+
+  describe 'config/bpm.yml' do
+    let(:template) { job.template('config/bpm.yml') }
+
+    it 'runs the nozzle with the config file' do
+      process = YAML.safe_load(template.render(properties))['processes'][0]
+      expect(process['name']).to eq(job_name)
+      expect(process['executable']).to eq('/var/vcap/packages/nozzle-for-microsoft-azure-log-analytics/azure-oms-nozzle')
+      expect(process['args']).to eq(['run', '--config-file', "/var/vcap/jobs/#{job_name}/config/nozzle.yml"])
+      expect(process['persistent_disk']).to be(false)
+    end
+
+    it 'identifies the instance' do
+      spec = Bosh::Template::Test::InstanceSpec.new(deployment: 'nozzle', name: 'oms', id: '5e8f1c2a')
+
+      env = YAML.safe_load(template.render(properties, spec: spec))['processes'][0]['env']
+      expect(env).to eq('BOSH_DEPLOYMENT' => 'nozzle', 'BOSH_INSTANCE_GROUP' => 'oms', 'BOSH_INSTANCE_ID' => '5e8f1c2a')
+    end
+
+    it 'mounts the persistent disk for a spool on it' do
+      properties['spool'] = { 'dir' => "/var/vcap/store/#{job_name}/spool" }
+
+      process = YAML.safe_load(template.render(properties))['processes'][0]
+      expect(process['persistent_disk']).to be(true)
+    end
+  end
+
+  describe 'bin/pre-start' do
+    it 'validates the config file' do
+      script = job.template('bin/pre-start').render(properties)
+      expect(script).to include("azure-oms-nozzle validate \\\n  --config-file /var/vcap/jobs/#{job_name}/config/nozzle.yml")
+    end
+  end
+end
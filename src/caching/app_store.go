@@ -0,0 +1,203 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// appStore holds the apps, spaces and orgs loaded from the V3 CC API, so that refreshes only
+// need to load the ones updated since
+type appStore struct {
+	apps   map[string]cfclient.V3App
+	spaces map[string]cfclient.V3Space
+	orgs   map[string]cfclient.V3Organization
+	// latest updated_at of the loaded resources, in the RFC 3339 format of the CC API
+	updatedAt string
+}
+
+// v3Included holds the resources included in a V3 response with include=space.organization
+type v3Included struct {
+	Spaces        []cfclient.V3Space        `json:"spaces"`
+	Organizations []cfclient.V3Organization `json:"organizations"`
+}
+
+type v3AppsPage struct {
+	Pagination cfclient.Pagination `json:"pagination"`
+	Resources  []cfclient.V3App    `json:"resources"`
+	Included   v3Included          `json:"included"`
+}
+
+type v3SpacesPage struct {
+	Pagination cfclient.Pagination `json:"pagination"`
+	Resources  []cfclient.V3Space  `json:"resources"`
+}
+
+type v3OrganizationsPage struct {
+	Pagination cfclient.Pagination       `json:"pagination"`
+	Resources  []cfclient.V3Organization `json:"resources"`
+}
+
+type v3AppWithIncluded struct {
+	cfclient.V3App
+	Included v3Included `json:"included"`
+}
+
+func newAppStore() *appStore {
+	return &appStore{
+		apps:   make(map[string]cfclient.V3App),
+		spaces: make(map[string]cfclient.V3Space),
+		orgs:   make(map[string]cfclient.V3Organization),
+	}
+}
+
+// loadAppStore loads all apps with their spaces and orgs
+func loadAppStore(cfClient *cfclient.Client) (*appStore, error) {
+	s := newAppStore()
+	err := s.loadApps(cfClient, url.Values{})
+	return s, err
+}
+
+// update loads the apps, spaces and orgs updated since the last load. Deleted apps are only
+// dropped by loading a new store.
+func (s *appStore) update(cfClient *cfclient.Client) error {
+	// updated_at has a precision of seconds, so resources updated in the same second as the
+	// latest one may not have been loaded yet
+	updatedAt := s.updatedAt
+	err := s.loadApps(cfClient, url.Values{"updated_ats[gte]": {updatedAt}})
+	if err == nil {
+		err = s.loadSpaces(cfClient, url.Values{"updated_ats[gte]": {updatedAt}})
+	}
+	if err == nil {
+		err = s.loadOrganizations(cfClient, url.Values{"updated_ats[gte]": {updatedAt}})
+	}
+	if err != nil {
+		// pages are not ordered by updated_at, so load all resources since then again
+		s.updatedAt = updatedAt
+	}
+	return err
+}
+
+func (s *appStore) loadApps(cfClient *cfclient.Client, query url.Values) error {
+	query.Set("include", "space.organization")
+	return listAll(cfClient, "/v3/apps", query, func(page *v3AppsPage) *cfclient.Pagination {
+		for _, app := range page.Resources {
+			s.addApp(app)
+		}
+		s.addIncluded(page.Included)
+		return &page.Pagination
+	})
+}
+
+func (s *appStore) loadSpaces(cfClient *cfclient.Client, query url.Values) error {
+	return listAll(cfClient, "/v3/spaces", query, func(page *v3SpacesPage) *cfclient.Pagination {
+		for _, space := range page.Resources {
+			s.addSpace(space)
+		}
+		return &page.Pagination
+	})
+}
+
+func (s *appStore) loadOrganizations(cfClient *cfclient.Client, query url.Values) error {
+	return listAll(cfClient, "/v3/organizations", query, func(page *v3OrganizationsPage) *cfclient.Pagination {
+		for _, org := range page.Resources {
+			s.addOrganization(org)
+		}
+		return &page.Pagination
+	})
+}
+
+func (s *appStore) addApp(app cfclient.V3App) {
+	s.apps[app.GUID] = app
+	s.observe(app.UpdatedAt)
+}
+
+func (s *appStore) addSpace(space cfclient.V3Space) {
+	s.spaces[space.GUID] = space
+	s.observe(space.UpdatedAt)
+}
+
+func (s *appStore) addOrganization(org cfclient.V3Organization) {
+	s.orgs[org.GUID] = org
+	s.observe(org.UpdatedAt)
+}
+
+func (s *appStore) addIncluded(included v3Included) {
+	for _, space := range included.Spaces {
+		s.addSpace(space)
+	}
+	for _, org := range included.Organizations {
+		s.addOrganization(org)
+	}
+}
+
+func (s *appStore) observe(updatedAt string) {
+	// timestamps of the CC API are in UTC and compare as strings
+	if updatedAt > s.updatedAt {
+		s.updatedAt = updatedAt
+	}
+}
+
+// resolve returns the space and org of app, false if they are not loaded
+func (s *appStore) resolve(app *cfclient.V3App) (*cfclient.V3Space, *cfclient.V3Organization, bool) {
+	space, ok := s.spaces[app.Relationships["space"].Data.GUID]
+	if !ok {
+		return nil, nil, false
+	}
+	org, ok := s.orgs[space.Relationships["organization"].Data.GUID]
+	if !ok {
+		return nil, nil, false
+	}
+	return &space, &org, true
+}
+
+// getApp gets a single app with its space and org
+func getApp(cfClient *cfclient.Client, appGuid string) (*appStore, error) {
+	var app v3AppWithIncluded
+	if err := get(cfClient, "/v3/apps/"+url.PathEscape(appGuid)+"?include=space.organization", &app); err != nil {
+		return nil, err
+	}
+	s := newAppStore()
+	s.addApp(app.V3App)
+	s.addIncluded(app.Included)
+	return s, nil
+}
+
+// listAll gets all pages of a V3 list, passing each to add, which returns its pagination
+func listAll[T any](cfClient *cfclient.Client, path string, query url.Values, add func(*T) *cfclient.Pagination) error {
+	query.Set("per_page", listPageSize)
+	requestURL := path + "?" + query.Encode()
+	for {
+		var page T
+		if err := get(cfClient, requestURL, &page); err != nil {
+			return err
+		}
+		next := add(&page).Next.Href
+		if next == "" {
+			break
+		}
+		nextURL, err := url.Parse(next)
+		if err != nil {
+			return fmt.Errorf("error parsing the next page of %s: %s", path, err)
+		}
+		requestURL = nextURL.RequestURI()
+	}
+	return nil
+}
+
+func get(cfClient *cfclient.Client, requestURL string, v interface{}) error {
+	resp, err := cfClient.DoRequest(cfClient.NewRequest("GET", requestURL))
+	if err != nil {
+		return fmt.Errorf("error requesting %s: %s", requestURL, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error parsing the response of %s: %s", requestURL, err)
+	}
+	return nil
+}
@@ -6,15 +6,21 @@ package caching
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.cloudfoundry.org/lager/v3"
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
 )
 
+// page size of lists from the V3 CC API, the max it allows
+const listPageSize = "5000"
+
 type AppInfo struct {
 	Name      string `json:"name"`
 	Org       string `json:"org"`
@@ -22,17 +28,77 @@ type AppInfo struct {
 	Space     string `json:"space"`
 	SpaceID   string `json:"spaceId"`
 	Monitored bool   `json:"monitored"`
+	// log types forwarded for the app, all if nil
+	LogTypes []string `json:"logTypes,omitempty"`
+	// labels and annotations of the app, its space and its org selected by MetadataKeys
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// stack and buildpacks of the buildpack lifecycle of the app. Buildpacks are the configured
+	// ones, not those detected at staging, which are only known to the droplet of the app.
+	Stack      string   `json:"stack,omitempty"`
+	Buildpacks []string `json:"buildpacks,omitempty"`
+}
+
+// Forwards reports whether events of logType, one of LogTypeMetric, LogTypeLog and LogTypeHTTP,
+// are forwarded for the app
+func (a AppInfo) Forwards(logType string) bool {
+	if !a.Monitored {
+		return false
+	}
+	if a.LogTypes == nil {
+		return true
+	}
+	for _, t := range a.LogTypes {
+		if t == logType {
+			return true
+		}
+	}
+	return false
+}
+
+// CachingConfig configures the app info cache
+type CachingConfig struct {
+	// CF environment name added to events
+	Environment string
+	// comma separated white list of orgs, spaces and apps to monitor, all if empty
+	SpaceFilter string
+	// interval of refreshes, which load the apps, spaces and orgs updated since the last refresh
+	Interval time.Duration
+	// interval of full refreshes, which load all apps to drop deleted ones; every refresh is
+	// full if this is not longer than Interval
+	FullRefreshInterval time.Duration
+	// how long apps that could not be looked up are not looked up again; zero disables this
+	NegativeTTL time.Duration
+	// max lookups per second from the CC API on average, in bursts of at most LookupBurst; zero
+	// disables the limit
+	LookupRate  float64
+	LookupBurst int
+	// stores a snapshot of the cache after every refresh, loaded at startup; nil disables snapshots
+	SnapshotStore SnapshotStore
+	// keys of the labels and annotations added to AppInfo, or prefixes of keys ending with *
+	MetadataKeys []string
+	// name of the nozzle instance added to events, pid-<pid>@<hostname> if empty
+	InstanceName string
 }
 
 type Caching struct {
 	cfClientConfig  *cfclient.Config
+	config          *CachingConfig
 	appInfosByGuid  map[string]AppInfo
 	spaceWhiteList  map[string]bool
 	appInfoLock     sync.RWMutex
 	logger          lager.Logger
 	instanceName    string
-	environment     string
-	cachingInterval time.Duration
+	store           *appStore // only used by refreshCache
+	lastFullRefresh time.Time
+	lookupLock      sync.Mutex
+	inFlight        map[string]*lookup   // lookups from the CC API by app GUID
+	unknown         map[string]time.Time // expiry of apps that could not be looked up by GUID
+	lookupLimiter   *rateLimiter
+	lookups         *metrics.Counter // by result, hit, miss, coalesced, unknown or throttled
+	refreshes       *metrics.Counter // by type, full or incremental, and result
+	snapshots       *metrics.Counter // by operation, load or save, and result
+	initialized     atomic.Bool      // set once the cache is loaded from the CC API
 }
 
 type CachingClient interface {
@@ -40,14 +106,17 @@ type CachingClient interface {
 	GetInstanceName() string
 	GetEnvironmentName() string
 	Initialize()
+	// Initialized reports whether the cache has been loaded from the CC API at least once
+	Initialized() bool
 }
 
-func NewCaching(config *cfclient.Config, logger lager.Logger, environment string, spaceFilter string, cachingInterval time.Duration) CachingClient {
+// NewCaching creates the app info cache; registry is optional and receives the cache metrics
+func NewCaching(config *cfclient.Config, logger lager.Logger, cachingConfig *CachingConfig, registry *metrics.Registry) CachingClient {
 	var spaceWhiteList map[string]bool
-	if len(spaceFilter) > 0 {
-		logger.Info("config", lager.Data{"SPACE_FILTER": spaceFilter})
+	if len(cachingConfig.SpaceFilter) > 0 {
+		logger.Info("config", lager.Data{"SPACE_FILTER": cachingConfig.SpaceFilter})
 		spaceWhiteList = make(map[string]bool)
-		spaceFilters := strings.Split(spaceFilter, ",")
+		spaceFilters := strings.Split(cachingConfig.SpaceFilter, ",")
 		for _, v := range spaceFilters {
 			v = strings.TrimSuffix(strings.Trim(v, " "), ".*")
 			spaceWhiteList[v] = true
@@ -56,163 +125,232 @@ func NewCaching(config *cfclient.Config, logger lager.Logger, environment string
 	} else {
 		logger.Info("config SPACE_FILTER is nil, all apps will be monitored")
 	}
-	return &Caching{
-		cfClientConfig:  config,
-		appInfosByGuid:  make(map[string]AppInfo),
-		spaceWhiteList:  spaceWhiteList,
-		logger:          logger,
-		environment:     environment,
-		cachingInterval: cachingInterval,
+	c := &Caching{
+		cfClientConfig: config,
+		config:         cachingConfig,
+		appInfosByGuid: make(map[string]AppInfo),
+		spaceWhiteList: spaceWhiteList,
+		logger:         logger,
+		inFlight:       make(map[string]*lookup),
+		unknown:        make(map[string]time.Time),
+		lookupLimiter:  newRateLimiter(cachingConfig.LookupRate, cachingConfig.LookupBurst),
+		lookups:        registry.Counter("nozzle_app_cache_lookups_total", "Lookups of app info in the cache", "result"),
+		refreshes:      registry.Counter("nozzle_app_cache_refreshes_total", "Refreshes of the cache from the CC API", "type", "result"),
+		snapshots:      registry.Counter("nozzle_app_cache_snapshots_total", "Loads and saves of cache snapshots", "operation", "result"),
 	}
+	registry.GaugeFunc("nozzle_app_cache_apps", "Apps in the cache", func() float64 {
+		c.appInfoLock.RLock()
+		defer c.appInfoLock.RUnlock()
+		return float64(len(c.appInfosByGuid))
+	})
+	return c
 }
 
-func (c *Caching) addAppinfoRecord(app cfclient.App) {
+// newAppInfo creates the info of app, monitored if it is in the space white list unless the
+// metadata of its org, space or itself says otherwise
+func (c *Caching) newAppInfo(app *cfclient.V3App, space *cfclient.V3Space, org *cfclient.V3Organization) AppInfo {
 	var appInfo = AppInfo{
 		Name:    app.Name,
-		Org:     app.SpaceData.Entity.OrgData.Entity.Name,
-		OrgID:   app.SpaceData.Entity.OrgData.Entity.Guid,
-		Space:   app.SpaceData.Entity.Name,
-		SpaceID: app.SpaceData.Entity.Guid,
-	}
-	appInfo.Monitored = c.spaceWhiteList == nil || c.spaceWhiteList[app.SpaceData.Entity.OrgData.Entity.Name] ||
-		c.spaceWhiteList[app.SpaceData.Entity.OrgData.Entity.Name+"."+app.SpaceData.Entity.Name] ||
-		c.spaceWhiteList[app.SpaceData.Entity.OrgData.Entity.Name+"."+app.SpaceData.Entity.Name+"."+app.Name]
+		Org:     org.Name,
+		OrgID:   org.GUID,
+		Space:   space.Name,
+		SpaceID: space.GUID,
+	}
+	appInfo.Monitored = c.spaceWhiteList == nil || c.spaceWhiteList[appInfo.Org] ||
+		c.spaceWhiteList[appInfo.Org+"."+appInfo.Space] ||
+		c.spaceWhiteList[appInfo.Org+"."+appInfo.Space+"."+appInfo.Name]
+	c.applyMetadata(&appInfo, app.GUID, org.Metadata, space.Metadata, app.Metadata)
+	c.selectMetadata(&appInfo, org.Metadata, space.Metadata, app.Metadata)
+	if app.Lifecycle.Type == "" || app.Lifecycle.Type == "buildpack" {
+		appInfo.Stack = app.Lifecycle.BuildpackData.Stack
+		appInfo.Buildpacks = app.Lifecycle.BuildpackData.Buildpacks
+	}
+	return appInfo
+}
+
+func (c *Caching) addAppinfoRecord(guid string, appInfo AppInfo) {
 	c.appInfoLock.Lock()
-	c.appInfosByGuid[app.Guid] = appInfo
+	c.appInfosByGuid[guid] = appInfo
 	c.appInfoLock.Unlock()
 	c.logger.Debug("adding to app info cache",
-		lager.Data{"guid": app.Guid},
+		lager.Data{"guid": guid},
 		lager.Data{"info": appInfo},
 	)
 }
 
+// newCFClient creates a CC API client. cfclient.NewClient writes to its config and to the
+// transport of http.DefaultClient, so every client gets a copy of the config and its own
+// HTTP client to let refreshes and lookups run concurrently.
+func (c *Caching) newCFClient() (*cfclient.Client, error) {
+	config := *c.cfClientConfig
+	if config.HttpClient == nil {
+		config.HttpClient = &http.Client{}
+	}
+	return cfclient.NewClient(&config)
+}
+
+// Initialize loads the cache from the snapshot store, or else from the CC API, and then keeps
+// refreshing it from the CC API
 func (c *Caching) Initialize() {
 	c.setInstanceName() //nolint:errcheck
 
-	c.refreshCache()
+	loaded := c.loadSnapshot()
+	if loaded {
+		c.updateAppInfos()
+		c.initialized.Store(true)
+	} else {
+		c.refreshCache()
+	}
 
 	c.logger.Info("Cache initialize completed",
 		lager.Data{"cache size": len(c.appInfosByGuid)})
 	go func() {
-		time.Sleep(time.Duration(float64(c.cachingInterval) * rand.Float64())) //nolint:gosec
-		ticker := time.NewTicker(c.cachingInterval)
+		if loaded {
+			// catch up with the changes since the snapshot
+			c.refreshCache()
+		} else {
+			time.Sleep(time.Duration(float64(c.config.Interval) * rand.Float64())) //nolint:gosec
+		}
+		ticker := time.NewTicker(c.config.Interval)
 		for range ticker.C {
 			c.refreshCache()
 		}
 	}()
 }
 
+// refreshCache loads the apps updated since the last refresh, or all apps if the last full
+// refresh is older than the full refresh interval
 func (c *Caching) refreshCache() {
-	c.logger.Debug("Refreshing Cache")
-	cfClient, err := cfclient.NewClient(c.cfClientConfig)
-	if err != nil {
-		c.logger.Error("error creating cfclient", err)
-		return
+	// an empty store has no updated_at to load the changes since
+	full := c.store == nil || c.store.updatedAt == "" || c.config.FullRefreshInterval <= c.config.Interval ||
+		time.Since(c.lastFullRefresh) >= c.config.FullRefreshInterval
+	refreshType := "incremental"
+	if full {
+		refreshType = "full"
 	}
-
-	apps, err := cfClient.ListAppsByQuery(nil)
+	c.logger.Debug("Refreshing Cache", lager.Data{"type": refreshType})
+	cfClient, err := c.newCFClient()
 	if err != nil {
-		c.logger.Error("error getting app list", err)
+		c.logger.Error("error creating cfclient", err)
+		c.refreshes.Inc(refreshType, "error")
 		return
 	}
 
-	spaces, err := cfClient.ListSpaces()
-	if err != nil {
-		c.logger.Error("error getting spaces list", err)
+	if full {
+		start := time.Now()
+		store, err := loadAppStore(cfClient)
+		if err != nil {
+			c.logger.Error("error getting app list", err)
+			c.refreshes.Inc(refreshType, "error")
+			return
+		}
+		c.store = store
+		c.lastFullRefresh = start
+	} else if err := c.store.update(cfClient); err != nil {
+		c.logger.Error("error getting updated apps", err)
+		c.refreshes.Inc(refreshType, "error")
 		return
 	}
 
-	spaceMap := make(map[string]cfclient.Space)
-	for _, space := range spaces {
-		spaceMap[space.Guid] = space
-	}
-
-	orgs, err := cfClient.ListOrgs()
-	if err != nil {
-		c.logger.Error("error getting org list", err)
-		return
-	}
-	orgMap := make(map[string]cfclient.Org)
-	for _, org := range orgs {
-		orgMap[org.Guid] = org
-	}
+	size := c.updateAppInfos()
+	c.purgeUnknown()
+	c.initialized.Store(true)
+	c.refreshes.Inc(refreshType, "success")
+	c.logger.Debug("Refreshed", lager.Data{"type": refreshType}, lager.Data{"cache size": size})
+	c.saveSnapshot()
+}
 
-	newAppInfo := make(map[string]AppInfo)
-	for _, app := range apps {
-		appInfo := AppInfo{
-			Name:    app.Name,
-			Org:     orgMap[spaceMap[app.SpaceGuid].OrganizationGuid].Name,
-			OrgID:   spaceMap[app.SpaceGuid].OrganizationGuid,
-			Space:   spaceMap[app.SpaceGuid].Name,
-			SpaceID: spaceMap[app.SpaceGuid].Guid,
+// updateAppInfos replaces the cached app infos with the ones of the store and returns their number
+func (c *Caching) updateAppInfos() int {
+	newAppInfo := make(map[string]AppInfo, len(c.store.apps))
+	for guid, app := range c.store.apps {
+		space, org, ok := c.store.resolve(&app)
+		if !ok {
+			// the space or org is not visible to the CF user, looked up when the app logs
+			continue
 		}
-		appInfo.Monitored = c.spaceWhiteList == nil || c.spaceWhiteList[appInfo.Org] ||
-			c.spaceWhiteList[appInfo.Org+"."+appInfo.Space] ||
-			c.spaceWhiteList[appInfo.Org+"."+appInfo.Space+"."+appInfo.Name]
-		newAppInfo[app.Guid] = appInfo
+		newAppInfo[guid] = c.newAppInfo(&app, space, org)
 	}
 
 	c.appInfoLock.Lock()
 	c.appInfosByGuid = newAppInfo
 	c.appInfoLock.Unlock()
-	c.logger.Debug("Refreshed")
+	return len(newAppInfo)
+}
+
+func (c *Caching) Initialized() bool {
+	return c.initialized.Load()
 }
 
+// GetAppInfo gets the info of an app from the cache, or looks it up from the CC API on a miss.
+// Concurrent misses of the same app wait for a single lookup, apps that could not be looked up
+// are not looked up again for the negative TTL, and lookups are rate limited. Apps that are not
+// looked up get an empty AppInfo.
 func (c *Caching) GetAppInfo(appGuid string) AppInfo {
 	var appInfo AppInfo
 	var ok bool
-	var old bool
 	func() {
 		c.appInfoLock.RLock()
 		defer c.appInfoLock.RUnlock()
 		appInfo, ok = c.appInfosByGuid[appGuid]
 	}()
-	if ok && !old {
+	if ok {
+		c.lookups.Inc("hit")
 		return appInfo
-	} else {
-		if !ok {
-			c.logger.Info("App info not found for GUID",
-				lager.Data{"guid": appGuid})
-		}
-		// call the client api to get the name for this app
-		// purposely create a new client due to issue in using a single client
-		start := time.Now()
-		cfClient, err := cfclient.NewClient(c.cfClientConfig)
-		if err != nil {
-			c.logger.Error("error creating cfclient", err)
-			return AppInfo{
-				Name:      "",
-				Org:       "",
-				OrgID:     "",
-				Space:     "",
-				SpaceID:   "",
-				Monitored: false,
-			}
-		}
-		app, err := cfClient.AppByGuid(appGuid)
-		stop := time.Now()
-		c.logger.Debug("app info lookup time", nil, lager.Data{"time_ms": stop.Sub(start).Milliseconds()})
+	}
+	l, result := c.startLookup(appGuid)
+	c.lookups.Inc(result)
+	switch result {
+	case "hit":
+		return l.appInfo
+	case "coalesced":
+		<-l.done
+		return l.appInfo
+	case "miss":
+	default:
+		c.logger.Debug("not looking up app info", lager.Data{"guid": appGuid}, lager.Data{"reason": result})
+		return AppInfo{}
+	}
+	c.logger.Info("App info not found for GUID",
+		lager.Data{"guid": appGuid})
+	// call the client api to get the name for this app
+	// purposely create a new client due to issue in using a single client
+	start := time.Now()
+	cfClient, err := c.newCFClient()
+	if err == nil {
+		l.appInfo, err = c.lookupAppInfo(cfClient, appGuid)
+		c.logger.Debug("app info lookup time", lager.Data{"time_ms": time.Since(start).Milliseconds()})
 		if err != nil {
 			c.logger.Error("error getting app info", err, lager.Data{"guid": appGuid})
-			return AppInfo{
-				Name:      "",
-				Org:       "",
-				OrgID:     "",
-				Space:     "",
-				SpaceID:   "",
-				Monitored: false,
-			}
-		} else {
-			// store app info in map
-			c.addAppinfoRecord(app)
-			// return App Info
-			return appInfo
 		}
+	} else {
+		c.logger.Error("error creating cfclient", err)
 	}
+	c.finishLookup(appGuid, l, err == nil)
+	return l.appInfo
+}
+
+// lookupAppInfo gets the app with its space and org from the CC API
+func (c *Caching) lookupAppInfo(cfClient *cfclient.Client, appGuid string) (AppInfo, error) {
+	store, err := getApp(cfClient, appGuid)
+	if err != nil {
+		return AppInfo{}, err
+	}
+	app := store.apps[appGuid]
+	space, org, ok := store.resolve(&app)
+	if !ok {
+		return AppInfo{}, fmt.Errorf("space or org of app %s not found", appGuid)
+	}
+	return c.newAppInfo(&app, space, org), nil
 }
 
 func (c *Caching) setInstanceName() error {
 	// instance id to track multiple nozzles, used for logging
+	if c.config.InstanceName != "" {
+		c.instanceName = c.config.InstanceName
+		c.logger.Info("getting nozzle instance name", lager.Data{"name": c.instanceName})
+		return nil
+	}
 	hostName, err := os.Hostname()
 	if err != nil {
 		c.logger.Error("failed to get hostname for nozzle instance", err)
@@ -229,5 +367,5 @@ func (c *Caching) GetInstanceName() string {
 }
 
 func (c *Caching) GetEnvironmentName() string {
-	return c.environment
+	return c.config.Environment
 }
@@ -0,0 +1,408 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching_test
+
+import (
+	"path/filepath"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+func labels(kv ...string) cfclient.V3Metadata {
+	m := cfclient.V3Metadata{Labels: make(map[string]string)}
+	for i := 0; i < len(kv); i += 2 {
+		m.Labels[kv[i]] = kv[i+1]
+	}
+	return m
+}
+
+func annotations(kv ...string) cfclient.V3Metadata {
+	m := cfclient.V3Metadata{Annotations: make(map[string]string)}
+	for i := 0; i < len(kv); i += 2 {
+		m.Annotations[kv[i]] = kv[i+1]
+	}
+	return m
+}
+
+var _ = Describe("Caching", func() {
+	var (
+		cc            *fakeCloudController
+		cachingConfig *caching.CachingConfig
+		cache         caching.CachingClient
+	)
+
+	BeforeEach(func() {
+		cc = newFakeCloudController()
+		cachingConfig = &caching.CachingConfig{Environment: "cf", Interval: time.Hour, FullRefreshInterval: 24 * time.Hour}
+		cc.addOrg("org-guid", "my-org", cfclient.V3Metadata{})
+		cc.addSpace("space-guid", "dev", "org-guid", cfclient.V3Metadata{})
+		cc.addApp("app-guid", "my-app", "space-guid", cfclient.V3Metadata{})
+	})
+
+	AfterEach(func() {
+		cc.Close()
+	})
+
+	JustBeforeEach(func() {
+		cache = caching.NewCaching(cc.config(), mocks.NewMockLogger(), cachingConfig, nil)
+	})
+
+	It("loads the apps with their spaces and orgs", func() {
+		Expect(cache.Initialized()).To(BeFalse())
+
+		cache.Initialize()
+
+		Expect(cache.Initialized()).To(BeTrue())
+		Expect(cache.GetAppInfo("app-guid")).To(Equal(caching.AppInfo{
+			Name:      "my-app",
+			Org:       "my-org",
+			OrgID:     "org-guid",
+			Space:     "dev",
+			SpaceID:   "space-guid",
+			Monitored: true,
+		}))
+		Expect(cc.requestsTo("/v3/apps/")).To(BeEmpty())
+	})
+
+	It("pages through the apps", func() {
+		cc.setPageSize(2)
+		cc.addApp("app-guid-2", "my-app-2", "space-guid", cfclient.V3Metadata{})
+		cc.addApp("app-guid-3", "my-app-3", "space-guid", cfclient.V3Metadata{})
+
+		cache.Initialize()
+
+		Expect(cache.GetAppInfo("app-guid").Name).To(Equal("my-app"))
+		Expect(cache.GetAppInfo("app-guid-2").Name).To(Equal("my-app-2"))
+		Expect(cache.GetAppInfo("app-guid-3").Name).To(Equal("my-app-3"))
+		requests := cc.requestsTo("/v3/apps?")
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0]).To(ContainSubstring("include=space.organization"))
+		Expect(requests[1]).To(ContainSubstring("page=2"))
+		Expect(cc.requestsTo("/v3/apps/")).To(BeEmpty())
+	})
+
+	It("looks up and caches apps created after the cache was loaded", func() {
+		cache.Initialize()
+		cc.addApp("new-app-guid", "new-app", "space-guid", cfclient.V3Metadata{})
+
+		appInfo := cache.GetAppInfo("new-app-guid")
+
+		Expect(appInfo.Name).To(Equal("new-app"))
+		Expect(appInfo.Space).To(Equal("dev"))
+		Expect(appInfo.Org).To(Equal("my-org"))
+		Expect(appInfo.Monitored).To(BeTrue())
+		Expect(cache.GetAppInfo("new-app-guid")).To(Equal(appInfo))
+		Expect(cc.requestsTo("/v3/apps/new-app-guid")).To(Equal([]string{"/v3/apps/new-app-guid?include=space.organization"}))
+	})
+
+	It("does not monitor apps that cannot be looked up", func() {
+		cache.Initialize()
+
+		Expect(cache.GetAppInfo("unknown-guid")).To(Equal(caching.AppInfo{}))
+	})
+
+	Describe("lookups", func() {
+		JustBeforeEach(func() {
+			cache.Initialize()
+		})
+
+		It("looks up an app once for concurrent misses", func() {
+			cc.addApp("new-app-guid", "new-app", "space-guid", cfclient.V3Metadata{})
+			gate := cc.blockApps()
+			names := make(chan string, 10)
+			for i := 0; i < cap(names); i++ {
+				go func() {
+					names <- cache.GetAppInfo("new-app-guid").Name
+				}()
+			}
+
+			Eventually(func() []string { return cc.requestsTo("/v3/apps/") }).Should(HaveLen(1))
+			close(gate)
+			for i := 0; i < cap(names); i++ {
+				Eventually(names).Should(Receive(Equal("new-app")))
+			}
+			Expect(cc.requestsTo("/v3/apps/")).To(HaveLen(1))
+			Expect(cc.requestsTo("/oauth/token")).To(HaveLen(2))
+		})
+
+		Context("with a negative TTL", func() {
+			BeforeEach(func() {
+				cachingConfig.NegativeTTL = 100 * time.Millisecond
+			})
+
+			It("does not look up unknown apps again until it expires", func() {
+				Expect(cache.GetAppInfo("unknown-guid")).To(Equal(caching.AppInfo{}))
+				Expect(cache.GetAppInfo("unknown-guid")).To(Equal(caching.AppInfo{}))
+				Expect(cc.requestsTo("/v3/apps/")).To(HaveLen(1))
+
+				cc.addApp("unknown-guid", "late-app", "space-guid", cfclient.V3Metadata{})
+				Eventually(func() string { return cache.GetAppInfo("unknown-guid").Name }).Should(Equal("late-app"))
+				Expect(cc.requestsTo("/v3/apps/")).To(HaveLen(2))
+			})
+		})
+
+		Context("with a rate limit", func() {
+			BeforeEach(func() {
+				cachingConfig.LookupRate = 0.001
+				cachingConfig.LookupBurst = 2
+			})
+
+			It("does not look up apps beyond it", func() {
+				cc.addApp("new-app-guid", "new-app", "space-guid", cfclient.V3Metadata{})
+				Expect(cache.GetAppInfo("unknown-guid")).To(Equal(caching.AppInfo{}))
+				Expect(cache.GetAppInfo("unknown-guid")).To(Equal(caching.AppInfo{}))
+
+				Expect(cache.GetAppInfo("new-app-guid")).To(Equal(caching.AppInfo{}))
+				Expect(cc.requestsTo("/v3/apps/")).To(HaveLen(2))
+				Expect(cache.GetAppInfo("app-guid").Name).To(Equal("my-app"))
+			})
+		})
+	})
+
+	Describe("refreshes", func() {
+		BeforeEach(func() {
+			cachingConfig.Interval = 20 * time.Millisecond
+		})
+
+		It("loads only the apps, spaces and orgs updated since the last refresh", func() {
+			cache.Initialize()
+			cc.addApp("new-app-guid", "new-app", "space-guid", cfclient.V3Metadata{})
+			cc.addSpace("space-guid", "staging", "org-guid", labels(caching.EnabledMetadataKey, "false"))
+
+			Eventually(func() caching.AppInfo { return cache.GetAppInfo("app-guid") }).Should(And(
+				HaveField("Space", "staging"), HaveField("Monitored", false)))
+			Eventually(func() []string { return cc.requestsTo("/v3/organizations?") }).Should(
+				ContainElement(ContainSubstring("updated_ats%5Bgte%5D=2020-01-01T00%3A00%3A03Z")))
+			Expect(cc.requestsTo("/v3/apps?")).To(ContainElement(ContainSubstring("updated_ats%5Bgte%5D=2020-01-01T00%3A00%3A03Z")))
+			Expect(cc.requestsTo("/v3/spaces?")).To(ContainElement(ContainSubstring("updated_ats%5Bgte%5D=2020-01-01T00%3A00%3A03Z")))
+			Expect(cache.GetAppInfo("new-app-guid").Name).To(Equal("new-app"))
+			Expect(cc.requestsTo("/v3/apps/")).To(BeEmpty())
+		})
+
+		It("keeps deleted apps until the next full refresh", func() {
+			cache.Initialize()
+			cc.deleteApp("app-guid")
+
+			Eventually(func() []string { return cc.requestsTo("/v3/organizations?") }).ShouldNot(BeEmpty())
+			Expect(cache.GetAppInfo("app-guid").Name).To(Equal("my-app"))
+		})
+
+		Context("with a full refresh interval not longer than the interval", func() {
+			BeforeEach(func() {
+				cachingConfig.FullRefreshInterval = cachingConfig.Interval
+			})
+
+			It("drops deleted apps", func() {
+				cache.Initialize()
+				cc.deleteApp("app-guid")
+
+				Eventually(func() caching.AppInfo { return cache.GetAppInfo("app-guid") }).Should(Equal(caching.AppInfo{}))
+				Expect(cc.requestsTo("/v3/apps?")).NotTo(ContainElement(ContainSubstring("updated_ats")))
+			})
+		})
+	})
+
+	Describe("snapshots", func() {
+		var snapshotStore *caching.FileSnapshotStore
+
+		BeforeEach(func() {
+			snapshotStore = &caching.FileSnapshotStore{Path: filepath.Join(GinkgoT().TempDir(), "cache", "snapshot.json")}
+			cachingConfig.SnapshotStore = snapshotStore
+		})
+
+		It("saves the cache and loads it at startup without the CC API", func() {
+			cache.Initialize()
+			Expect(snapshotStore.Path).To(BeAnExistingFile())
+			appInfo := cache.GetAppInfo("app-guid")
+			cc.Close()
+
+			restarted := caching.NewCaching(cc.config(), mocks.NewMockLogger(), cachingConfig, nil)
+			restarted.Initialize()
+
+			Expect(restarted.Initialized()).To(BeTrue())
+			Expect(restarted.GetAppInfo("app-guid")).To(Equal(appInfo))
+		})
+
+		It("loads only the changes since the snapshot after loading it", func() {
+			cache.Initialize()
+			cc.addApp("new-app-guid", "new-app", "space-guid", cfclient.V3Metadata{})
+
+			restarted := caching.NewCaching(cc.config(), mocks.NewMockLogger(), cachingConfig, nil)
+			restarted.Initialize()
+
+			Eventually(func() []string { return cc.requestsTo("/v3/organizations?") }).Should(HaveLen(1))
+			Expect(restarted.GetAppInfo("new-app-guid").Name).To(Equal("new-app"))
+			Expect(cc.requestsTo("/v3/apps?")).To(HaveLen(2))
+			Expect(cc.requestsTo("/v3/apps?")[1]).To(ContainSubstring("updated_ats%5Bgte%5D=2020-01-01T00%3A00%3A03Z"))
+			Expect(cc.requestsTo("/v3/apps/")).To(BeEmpty())
+		})
+
+		It("loads the cache from the CC API if the snapshot is invalid", func() {
+			Expect(snapshotStore.Save([]byte("{"))).To(Succeed())
+
+			cache.Initialize()
+
+			Expect(cache.GetAppInfo("app-guid").Name).To(Equal("my-app"))
+			Expect(cc.requestsTo("/v3/apps?")).To(HaveLen(1))
+		})
+	})
+
+	Context("with a space white list", func() {
+		BeforeEach(func() {
+			cachingConfig.SpaceFilter = "my-org.prod"
+			cc.addSpace("prod-guid", "prod", "org-guid", cfclient.V3Metadata{})
+			cc.addApp("prod-app-guid", "prod-app", "prod-guid", cfclient.V3Metadata{})
+		})
+
+		It("monitors only the apps in the listed spaces", func() {
+			cache.Initialize()
+
+			Expect(cache.GetAppInfo("prod-app-guid").Monitored).To(BeTrue())
+			Expect(cache.GetAppInfo("app-guid").Monitored).To(BeFalse())
+		})
+	})
+
+	Describe("metadata", func() {
+		It("opts apps out with the enabled label", func() {
+			cc.addApp("app-guid", "my-app", "space-guid", labels(caching.EnabledMetadataKey, "false"))
+			cache.Initialize()
+
+			Expect(cache.GetAppInfo("app-guid").Monitored).To(BeFalse())
+		})
+
+		It("lets apps override their space and spaces their org", func() {
+			cc.addOrg("org-guid", "my-org", labels(caching.EnabledMetadataKey, "false"))
+			cc.addSpace("space-guid", "dev", "org-guid", labels(caching.EnabledMetadataKey, "true"))
+			cc.addSpace("other-space-guid", "test", "org-guid", cfclient.V3Metadata{})
+			cc.addApp("other-app-guid", "other-app", "other-space-guid", cfclient.V3Metadata{})
+			cc.addApp("opted-in-app-guid", "opted-in-app", "other-space-guid", labels(caching.EnabledMetadataKey, "true"))
+			cache.Initialize()
+
+			Expect(cache.GetAppInfo("app-guid").Monitored).To(BeTrue())
+			Expect(cache.GetAppInfo("other-app-guid").Monitored).To(BeFalse())
+			Expect(cache.GetAppInfo("opted-in-app-guid").Monitored).To(BeTrue())
+		})
+
+		Context("with a space white list", func() {
+			BeforeEach(func() {
+				cachingConfig.SpaceFilter = "other-org"
+			})
+
+			It("opts apps in regardless of the white list", func() {
+				cc.addApp("app-guid", "my-app", "space-guid", annotations(caching.EnabledMetadataKey, "true"))
+				cache.Initialize()
+
+				Expect(cache.GetAppInfo("app-guid").Monitored).To(BeTrue())
+			})
+		})
+
+		It("restricts the log types forwarded", func() {
+			cc.addSpace("space-guid", "dev", "org-guid", annotations(caching.LogTypesMetadataKey, "log, http"))
+			cc.addApp("label-app-guid", "label-app", "space-guid", labels(caching.LogTypesMetadataKey, "METRIC_LOG"))
+			cache.Initialize()
+
+			appInfo := cache.GetAppInfo("app-guid")
+			Expect(appInfo.LogTypes).To(Equal([]string{caching.LogTypeLog, caching.LogTypeHTTP}))
+			Expect(appInfo.Forwards(caching.LogTypeLog)).To(BeTrue())
+			Expect(appInfo.Forwards(caching.LogTypeMetric)).To(BeFalse())
+
+			appInfo = cache.GetAppInfo("label-app-guid")
+			Expect(appInfo.Forwards(caching.LogTypeMetric)).To(BeTrue())
+			Expect(appInfo.Forwards(caching.LogTypeHTTP)).To(BeFalse())
+		})
+
+		It("prefers annotations to labels", func() {
+			metadata := labels(caching.EnabledMetadataKey, "true")
+			metadata.Annotations = map[string]string{caching.EnabledMetadataKey: "false"}
+			cc.addApp("app-guid", "my-app", "space-guid", metadata)
+			cache.Initialize()
+
+			Expect(cache.GetAppInfo("app-guid").Monitored).To(BeFalse())
+		})
+
+		It("ignores invalid values", func() {
+			cc.addSpace("space-guid", "dev", "org-guid", annotations(caching.LogTypesMetadataKey, "LOG"))
+			cc.addApp("app-guid", "my-app", "space-guid", annotations(
+				caching.EnabledMetadataKey, "maybe",
+				caching.LogTypesMetadataKey, "LOG,TRACES"))
+			cache.Initialize()
+
+			appInfo := cache.GetAppInfo("app-guid")
+			Expect(appInfo.Monitored).To(BeTrue())
+			Expect(appInfo.LogTypes).To(Equal([]string{caching.LogTypeLog}))
+		})
+
+		It("applies to apps looked up after the cache was loaded", func() {
+			cache.Initialize()
+			cc.addApp("new-app-guid", "new-app", "space-guid", labels(caching.EnabledMetadataKey, "false"))
+
+			Expect(cache.GetAppInfo("new-app-guid").Monitored).To(BeFalse())
+		})
+	})
+
+	Describe("app metadata", func() {
+		BeforeEach(func() {
+			cc.addOrg("org-guid", "my-org", labels("team", "platform", "cost-center", "42"))
+			cc.addSpace("space-guid", "dev", "org-guid", annotations("example.com/owner", "space-owner"))
+			cc.addApp("app-guid", "my-app", "space-guid", cfclient.V3Metadata{
+				Labels:      map[string]string{"team": "payments", "tier": "backend"},
+				Annotations: map[string]string{"example.com/owner": "app-owner", "example.com/docs": "https://docs"},
+			})
+			cc.setLifecycle("app-guid", cfclient.V3Lifecycle{Type: "buildpack", BuildpackData: cfclient.V3BuildpackLifecycle{
+				Buildpacks: []string{"java_buildpack_offline"},
+				Stack:      "cflinuxfs4",
+			}})
+		})
+
+		It("adds the stack and buildpacks", func() {
+			cache.Initialize()
+
+			appInfo := cache.GetAppInfo("app-guid")
+			Expect(appInfo.Stack).To(Equal("cflinuxfs4"))
+			Expect(appInfo.Buildpacks).To(Equal([]string{"java_buildpack_offline"}))
+			Expect(appInfo.Labels).To(BeNil())
+			Expect(appInfo.Annotations).To(BeNil())
+		})
+
+		It("adds the allowed labels and annotations, overridden by the app and its space", func() {
+			cachingConfig.MetadataKeys = []string{"team", "cost-center", "example.com/owner", "missing"}
+			cache.Initialize()
+
+			appInfo := cache.GetAppInfo("app-guid")
+			Expect(appInfo.Labels).To(Equal(map[string]string{"team": "payments", "cost-center": "42"}))
+			Expect(appInfo.Annotations).To(Equal(map[string]string{"example.com/owner": "app-owner"}))
+		})
+
+		It("adds the labels and annotations matching key prefixes", func() {
+			cachingConfig.MetadataKeys = []string{"example.com/*"}
+			cache.Initialize()
+
+			appInfo := cache.GetAppInfo("app-guid")
+			Expect(appInfo.Labels).To(BeNil())
+			Expect(appInfo.Annotations).To(Equal(map[string]string{"example.com/owner": "app-owner", "example.com/docs": "https://docs"}))
+		})
+	})
+
+	It("names the nozzle instance after its host unless configured", func() {
+		cache.Initialize()
+		Expect(cache.GetInstanceName()).To(MatchRegexp(`^pid-\d+@.+`))
+
+		cachingConfig.InstanceName = "oms_nozzle/1"
+		named := caching.NewCaching(cc.config(), mocks.NewMockLogger(), cachingConfig, nil)
+		named.Initialize()
+		Expect(named.GetInstanceName()).To(Equal("oms_nozzle/1"))
+	})
+
+	It("forwards nothing for apps that are not monitored", func() {
+		appInfo := caching.AppInfo{Monitored: false}
+		Expect(appInfo.Forwards(caching.LogTypeLog)).To(BeFalse())
+		appInfo = caching.AppInfo{Monitored: true, LogTypes: []string{}}
+		Expect(appInfo.Forwards(caching.LogTypeLog)).To(BeFalse())
+	})
+})
@@ -0,0 +1,255 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// fakeCloudController serves the CC and UAA endpoints the cache uses from apps, spaces and orgs
+type fakeCloudController struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	apps     map[string]cfclient.V3App
+	spaces   map[string]cfclient.V3Space
+	orgs     map[string]cfclient.V3Organization
+	clock    time.Time     // updated_at of the next added resource
+	pageSize int           // max resources per page
+	requests []string      // request URIs
+	gate     chan struct{} // app requests wait for it to be closed if not nil
+}
+
+func newFakeCloudController() *fakeCloudController {
+	cc := &fakeCloudController{
+		apps:     make(map[string]cfclient.V3App),
+		spaces:   make(map[string]cfclient.V3Space),
+		orgs:     make(map[string]cfclient.V3Organization),
+		clock:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		pageSize: 5000,
+	}
+	cc.Server = httptest.NewServer(http.HandlerFunc(cc.serveHTTP))
+	return cc
+}
+
+func (cc *fakeCloudController) config() *cfclient.Config {
+	return &cfclient.Config{ApiAddress: cc.URL, Username: "admin", Password: "secret"}
+}
+
+// tick returns the updated_at of a resource added now. Callers hold the mutex.
+func (cc *fakeCloudController) tick() string {
+	cc.clock = cc.clock.Add(time.Second)
+	return cc.clock.Format(time.RFC3339)
+}
+
+func (cc *fakeCloudController) addOrg(guid string, name string, metadata cfclient.V3Metadata) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.orgs[guid] = cfclient.V3Organization{GUID: guid, Name: name, UpdatedAt: cc.tick(), Metadata: metadata}
+}
+
+func (cc *fakeCloudController) addSpace(guid string, name string, orgGuid string, metadata cfclient.V3Metadata) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.spaces[guid] = cfclient.V3Space{
+		GUID:          guid,
+		Name:          name,
+		UpdatedAt:     cc.tick(),
+		Relationships: map[string]cfclient.V3ToOneRelationship{"organization": {Data: cfclient.V3Relationship{GUID: orgGuid}}},
+		Metadata:      metadata,
+	}
+}
+
+func (cc *fakeCloudController) addApp(guid string, name string, spaceGuid string, metadata cfclient.V3Metadata) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.apps[guid] = cfclient.V3App{
+		GUID:          guid,
+		Name:          name,
+		UpdatedAt:     cc.tick(),
+		Relationships: map[string]cfclient.V3ToOneRelationship{"space": {Data: cfclient.V3Relationship{GUID: spaceGuid}}},
+		Metadata:      metadata,
+	}
+}
+
+func (cc *fakeCloudController) setLifecycle(appGuid string, lifecycle cfclient.V3Lifecycle) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	app := cc.apps[appGuid]
+	app.Lifecycle = lifecycle
+	app.UpdatedAt = cc.tick()
+	cc.apps[appGuid] = app
+}
+
+func (cc *fakeCloudController) deleteApp(guid string) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	delete(cc.apps, guid)
+}
+
+func (cc *fakeCloudController) setPageSize(pageSize int) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.pageSize = pageSize
+}
+
+// requestsTo returns the request URIs starting with prefix
+func (cc *fakeCloudController) requestsTo(prefix string) []string {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	var requests []string
+	for _, uri := range cc.requests {
+		if strings.HasPrefix(uri, prefix) {
+			requests = append(requests, uri)
+		}
+	}
+	return requests
+}
+
+// blockApps makes requests for single apps wait until the returned channel is closed
+func (cc *fakeCloudController) blockApps() chan struct{} {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.gate = make(chan struct{})
+	return cc.gate
+}
+
+func (cc *fakeCloudController) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	cc.mutex.Lock()
+	cc.requests = append(cc.requests, r.URL.RequestURI())
+	gate := cc.gate
+	cc.mutex.Unlock()
+	if gate != nil && strings.HasPrefix(r.URL.Path, "/v3/apps/") {
+		<-gate
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/v2/info":
+		writeJSON(w, map[string]string{"authorization_endpoint": cc.URL, "token_endpoint": cc.URL})
+		return
+	case "/oauth/token":
+		writeJSON(w, map[string]interface{}{"access_token": "token", "token_type": "bearer", "expires_in": 3600})
+		return
+	}
+
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	switch parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/"), "/"); {
+	case len(parts) == 1 && parts[0] == "apps":
+		apps := filterUpdated(cc.apps, query, func(app cfclient.V3App) string { return app.UpdatedAt })
+		page, pagination := paginate(r, apps, cc.pageSize)
+		list := map[string]interface{}{"pagination": pagination, "resources": page}
+		if query.Get("include") == "space.organization" {
+			list["included"] = cc.included(page...)
+		}
+		writeJSON(w, list)
+	case len(parts) == 1 && parts[0] == "spaces":
+		spaces := filterUpdated(cc.spaces, query, func(space cfclient.V3Space) string { return space.UpdatedAt })
+		page, pagination := paginate(r, spaces, cc.pageSize)
+		writeJSON(w, map[string]interface{}{"pagination": pagination, "resources": page})
+	case len(parts) == 1 && parts[0] == "organizations":
+		orgs := filterUpdated(cc.orgs, query, func(org cfclient.V3Organization) string { return org.UpdatedAt })
+		page, pagination := paginate(r, orgs, cc.pageSize)
+		writeJSON(w, map[string]interface{}{"pagination": pagination, "resources": page})
+	case len(parts) == 2 && parts[0] == "apps":
+		app, ok := cc.apps[parts[1]]
+		if !ok {
+			writeNotFound(w)
+			return
+		}
+		writeJSON(w, struct {
+			cfclient.V3App
+			Included map[string]interface{} `json:"included"`
+		}{app, cc.included(app)})
+	default:
+		writeNotFound(w)
+	}
+}
+
+// included returns the spaces and orgs of apps. Callers hold the mutex.
+func (cc *fakeCloudController) included(apps ...cfclient.V3App) map[string]interface{} {
+	spaces := make(map[string]cfclient.V3Space)
+	orgs := make(map[string]cfclient.V3Organization)
+	for _, app := range apps {
+		if space, ok := cc.spaces[app.Relationships["space"].Data.GUID]; ok {
+			spaces[space.GUID] = space
+			if org, ok := cc.orgs[space.Relationships["organization"].Data.GUID]; ok {
+				orgs[org.GUID] = org
+			}
+		}
+	}
+	return map[string]interface{}{"spaces": sortedValues(spaces), "organizations": sortedValues(orgs)}
+}
+
+// paginate returns the page of resources requested by r, of at most pageSize resources, and its pagination
+func paginate[T any](r *http.Request, resources []T, pageSize int) ([]T, map[string]interface{}) {
+	query := r.URL.Query()
+	if perPage, err := strconv.Atoi(query.Get("per_page")); err == nil && perPage < pageSize {
+		pageSize = perPage
+	}
+	page := 1
+	if p, err := strconv.Atoi(query.Get("page")); err == nil {
+		page = p
+	}
+	start := min((page-1)*pageSize, len(resources))
+	end := min(start+pageSize, len(resources))
+	pagination := map[string]interface{}{"total_results": len(resources), "next": nil}
+	if end < len(resources) {
+		query.Set("page", strconv.Itoa(page+1))
+		pagination["next"] = map[string]string{"href": fmt.Sprintf("https://%s%s?%s", r.Host, r.URL.Path, query.Encode())}
+	}
+	return resources[start:end], pagination
+}
+
+// filterUpdated returns the resources matching the updated_ats[gte] filter, sorted by GUID
+func filterUpdated[T any](resources map[string]T, query map[string][]string, updatedAt func(T) string) []T {
+	var since string
+	if values := query["updated_ats[gte]"]; len(values) > 0 {
+		since = values[0]
+	}
+	var filtered []T
+	for _, resource := range sortedValues(resources) {
+		if updatedAt(resource) >= since {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
+
+func sortedValues[T any](resources map[string]T) []T {
+	keys := make([]string, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]T, len(keys))
+	for i, key := range keys {
+		values[i] = resources[key]
+	}
+	return values
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	writeJSON(w, map[string]interface{}{"errors": []map[string]interface{}{{"code": 10010, "title": "CF-ResourceNotFound", "detail": "not found"}}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	json.NewEncoder(w).Encode(v) //nolint:errcheck
+}
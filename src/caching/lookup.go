@@ -0,0 +1,108 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching
+
+import (
+	"sync"
+	"time"
+)
+
+// lookup is an in-flight lookup of an app from the CC API, which concurrent misses of the same
+// app wait for instead of looking it up again
+type lookup struct {
+	done    chan struct{} // closed once appInfo is set
+	appInfo AppInfo
+}
+
+// rateLimiter is a token bucket that allows rate events per second on average, in bursts of at
+// most burst events. A nil rateLimiter allows all events.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow reports whether an event may happen now, and takes a token if so
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// startLookup starts a lookup of appGuid after a cache miss and returns it with its result:
+//   - miss: a new lookup that the caller has to finish with finishLookup
+//   - coalesced: the in-flight lookup of appGuid, to wait for
+//   - hit: a finished lookup, as the app was added to the cache since the miss
+//   - unknown or throttled: nil, as appGuid was not found recently or the CC API rate limit is reached
+func (c *Caching) startLookup(appGuid string) (*lookup, string) {
+	c.lookupLock.Lock()
+	defer c.lookupLock.Unlock()
+	if l, ok := c.inFlight[appGuid]; ok {
+		return l, "coalesced"
+	}
+	// a lookup may have finished since the caller missed the cache
+	c.appInfoLock.RLock()
+	appInfo, ok := c.appInfosByGuid[appGuid]
+	c.appInfoLock.RUnlock()
+	if ok {
+		return &lookup{appInfo: appInfo}, "hit"
+	}
+	if expiry, ok := c.unknown[appGuid]; ok && time.Now().Before(expiry) {
+		return nil, "unknown"
+	}
+	if !c.lookupLimiter.allow() {
+		return nil, "throttled"
+	}
+	l := &lookup{done: make(chan struct{})}
+	c.inFlight[appGuid] = l
+	return l, "miss"
+}
+
+// finishLookup stores the app info found by l, or remembers appGuid as unknown if it was not
+// found, and wakes up the lookups waiting for l
+func (c *Caching) finishLookup(appGuid string, l *lookup, found bool) {
+	c.lookupLock.Lock()
+	defer c.lookupLock.Unlock()
+	if found {
+		c.addAppinfoRecord(appGuid, l.appInfo)
+	} else if c.config.NegativeTTL > 0 {
+		c.unknown[appGuid] = time.Now().Add(c.config.NegativeTTL)
+	}
+	delete(c.inFlight, appGuid)
+	close(l.done)
+}
+
+// purgeUnknown forgets the unknown apps whose negative cache entries have expired
+func (c *Caching) purgeUnknown() {
+	c.lookupLock.Lock()
+	defer c.lookupLock.Unlock()
+	now := time.Now()
+	for appGuid, expiry := range c.unknown {
+		if !now.Before(expiry) {
+			delete(c.unknown, appGuid)
+		}
+	}
+}
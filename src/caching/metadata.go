@@ -0,0 +1,111 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching
+
+import (
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/lager/v3"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// keys of the labels and annotations of apps, spaces and orgs that control what is forwarded
+const (
+	MetadataKeyPrefix   = "azure-log-analytics.nozzle/"
+	EnabledMetadataKey  = MetadataKeyPrefix + "enabled"
+	LogTypesMetadataKey = MetadataKeyPrefix + "log-types"
+)
+
+// log types that can be listed in LogTypesMetadataKey
+const (
+	LogTypeMetric = "METRIC"
+	LogTypeLog    = "LOG"
+	LogTypeHTTP   = "HTTP"
+)
+
+// applyMetadata overrides whether appInfo is monitored and which of its log types are forwarded
+// with the given labels and annotations, from the least to the most specific, so that an app
+// overrides its space and a space its org. Annotations take precedence over labels, as label
+// values cannot hold a comma separated list.
+func (c *Caching) applyMetadata(appInfo *AppInfo, appGuid string, metadata ...cfclient.V3Metadata) {
+	for _, m := range metadata {
+		if value, ok := metadataValue(m, EnabledMetadataKey); ok {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				c.logger.Info("ignoring invalid metadata value", lager.Data{"guid": appGuid},
+					lager.Data{"key": EnabledMetadataKey}, lager.Data{"value": value})
+			} else {
+				appInfo.Monitored = enabled
+			}
+		}
+		if value, ok := metadataValue(m, LogTypesMetadataKey); ok {
+			logTypes, valid := parseLogTypes(value)
+			if !valid {
+				c.logger.Info("ignoring invalid metadata value", lager.Data{"guid": appGuid},
+					lager.Data{"key": LogTypesMetadataKey}, lager.Data{"value": value})
+			} else {
+				appInfo.LogTypes = logTypes
+			}
+		}
+	}
+}
+
+func metadataValue(m cfclient.V3Metadata, key string) (string, bool) {
+	if value, ok := m.Annotations[key]; ok {
+		return value, true
+	}
+	value, ok := m.Labels[key]
+	return value, ok
+}
+
+// parseLogTypes parses a list of log types separated by commas, or underscores as allowed in
+// label values. An empty list forwards no log types.
+func parseLogTypes(value string) ([]string, bool) {
+	logTypes := []string{}
+	for _, t := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '_' || r == ' ' }) {
+		t = strings.ToUpper(t)
+		switch t {
+		case LogTypeMetric, LogTypeLog, LogTypeHTTP:
+			logTypes = append(logTypes, t)
+		default:
+			return nil, false
+		}
+	}
+	return logTypes, true
+}
+
+// selectMetadata adds the labels and annotations matching MetadataKeys to appInfo, from the
+// least to the most specific as applyMetadata does
+func (c *Caching) selectMetadata(appInfo *AppInfo, metadata ...cfclient.V3Metadata) {
+	if len(c.config.MetadataKeys) == 0 {
+		return
+	}
+	for _, m := range metadata {
+		appInfo.Labels = c.selectKeys(appInfo.Labels, m.Labels)
+		appInfo.Annotations = c.selectKeys(appInfo.Annotations, m.Annotations)
+	}
+}
+
+func (c *Caching) selectKeys(selected map[string]string, values map[string]string) map[string]string {
+	for key, value := range values {
+		if !c.selectsKey(key) {
+			continue
+		}
+		if selected == nil {
+			selected = make(map[string]string)
+		}
+		selected[key] = value
+	}
+	return selected
+}
+
+func (c *Caching) selectsKey(key string) bool {
+	for _, k := range c.config.MetadataKeys {
+		if prefix, ok := strings.CutSuffix(k, "*"); ok && strings.HasPrefix(key, prefix) || k == key {
+			return true
+		}
+	}
+	return false
+}
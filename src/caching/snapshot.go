@@ -0,0 +1,136 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package caching
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// snapshotVersion is the format version of snapshots; snapshots of other versions are ignored
+const snapshotVersion = 1
+
+// SnapshotStore stores the latest snapshot of the app cache
+type SnapshotStore interface {
+	// Load returns the latest snapshot, or os.ErrNotExist if there is none
+	Load() ([]byte, error)
+	Save(snapshot []byte) error
+}
+
+// FileSnapshotStore stores the snapshot in a file, replaced atomically on every save
+type FileSnapshotStore struct {
+	Path string
+}
+
+func (s *FileSnapshotStore) Load() ([]byte, error) {
+	return os.ReadFile(s.Path)
+}
+
+func (s *FileSnapshotStore) Save(snapshot []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, snapshot, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// snapshot holds the apps, spaces and orgs of an appStore, so that a restarted nozzle can
+// enrich envelopes before it has loaded the apps from the CC API, and then only load the
+// ones updated since
+type snapshot struct {
+	Version         int                       `json:"version"`
+	SavedAt         time.Time                 `json:"savedAt"`
+	LastFullRefresh time.Time                 `json:"lastFullRefresh"`
+	UpdatedAt       string                    `json:"updatedAt"`
+	Apps            []cfclient.V3App          `json:"apps"`
+	Spaces          []cfclient.V3Space        `json:"spaces"`
+	Organizations   []cfclient.V3Organization `json:"organizations"`
+}
+
+// saveSnapshot saves the store to the snapshot store, if there is one
+func (c *Caching) saveSnapshot() {
+	if c.config.SnapshotStore == nil {
+		return
+	}
+	s := snapshot{
+		Version:         snapshotVersion,
+		SavedAt:         time.Now(),
+		LastFullRefresh: c.lastFullRefresh,
+		UpdatedAt:       c.store.updatedAt,
+		Apps:            make([]cfclient.V3App, 0, len(c.store.apps)),
+		Spaces:          make([]cfclient.V3Space, 0, len(c.store.spaces)),
+		Organizations:   make([]cfclient.V3Organization, 0, len(c.store.orgs)),
+	}
+	for _, app := range c.store.apps {
+		s.Apps = append(s.Apps, app)
+	}
+	for _, space := range c.store.spaces {
+		s.Spaces = append(s.Spaces, space)
+	}
+	for _, org := range c.store.orgs {
+		s.Organizations = append(s.Organizations, org)
+	}
+	data, err := json.Marshal(&s)
+	if err == nil {
+		err = c.config.SnapshotStore.Save(data)
+	}
+	if err != nil {
+		c.logger.Error("error saving app cache snapshot", err)
+		c.snapshots.Inc("save", "error")
+		return
+	}
+	c.snapshots.Inc("save", "success")
+	c.logger.Debug("saved app cache snapshot", lager.Data{"apps": len(s.Apps)}, lager.Data{"bytes": len(data)})
+}
+
+// loadSnapshot loads the store from the snapshot store, and reports whether it did
+func (c *Caching) loadSnapshot() bool {
+	if c.config.SnapshotStore == nil {
+		return false
+	}
+	data, err := c.config.SnapshotStore.Load()
+	if errors.Is(err, os.ErrNotExist) {
+		c.logger.Info("no app cache snapshot to load")
+		return false
+	}
+	var s snapshot
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	if err == nil && s.Version != snapshotVersion {
+		err = fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	if err != nil {
+		c.logger.Error("error loading app cache snapshot", err)
+		c.snapshots.Inc("load", "error")
+		return false
+	}
+	store := newAppStore()
+	for _, app := range s.Apps {
+		store.apps[app.GUID] = app
+	}
+	for _, space := range s.Spaces {
+		store.spaces[space.GUID] = space
+	}
+	for _, org := range s.Organizations {
+		store.orgs[org.GUID] = org
+	}
+	store.updatedAt = s.UpdatedAt
+	c.store = store
+	c.lastFullRefresh = s.LastFullRefresh
+	c.snapshots.Inc("load", "success")
+	c.logger.Info("loaded app cache snapshot", lager.Data{"apps": len(s.Apps)},
+		lager.Data{"saved at": s.SavedAt.Format(time.RFC3339)})
+	return true
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostError is returned by PostData when Log Analytics answers a post with an error status
+type PostError struct {
+	StatusCode int
+	Status     string
+	// excerpt of the response body
+	Message string
+	// how long the server asked to wait before retrying, zero if it did not say
+	RetryAfter time.Duration
+}
+
+func (e *PostError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Post Error. HTTP response code:%d message:%s", e.StatusCode, e.Status)
+	}
+	return fmt.Sprintf("Post Error. HTTP response code:%d message:%s %s", e.StatusCode, e.Status, e.Message)
+}
+
+// Retryable reports whether the post may succeed when retried. Throttling, timeouts and
+// server errors are retryable, other client errors such as 400, 403 or 413 are not.
+func (e *PostError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests, e.StatusCode == http.StatusRequestTimeout:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// IsRetryable reports whether a post that failed with err may succeed when retried.
+// Errors other than a PostError, such as connection errors and timeouts, are retryable.
+func IsRetryable(err error) bool {
+	var postError *PostError
+	if errors.As(err, &postError) {
+		return postError.Retryable()
+	}
+	return err != nil
+}
+
+// RetryAfter returns how long the server asked to wait before retrying a post that failed with err
+func RetryAfter(err error) time.Duration {
+	var postError *PostError
+	if errors.As(err, &postError) {
+		return postError.RetryAfter
+	}
+	return 0
+}
+
+// newPostError creates the PostError for a response with an error status
+func newPostError(resp *http.Response) *PostError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &PostError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
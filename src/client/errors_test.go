@@ -0,0 +1,108 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+var _ = Describe("PostError", func() {
+	DescribeTable("tells retryable from permanent failures",
+		func(statusCode int, retryable bool) {
+			err := &client.PostError{StatusCode: statusCode}
+
+			Expect(err.Retryable()).To(Equal(retryable))
+			Expect(client.IsRetryable(fmt.Errorf("wrapped: %w", err))).To(Equal(retryable))
+		},
+		Entry("throttled", http.StatusTooManyRequests, true),
+		Entry("request timeout", http.StatusRequestTimeout, true),
+		Entry("internal server error", http.StatusInternalServerError, true),
+		Entry("service unavailable", http.StatusServiceUnavailable, true),
+		Entry("bad request", http.StatusBadRequest, false),
+		Entry("forbidden", http.StatusForbidden, false),
+		Entry("request entity too large", http.StatusRequestEntityTooLarge, false),
+	)
+
+	It("treats other errors, such as connection errors, as retryable", func() {
+		Expect(client.IsRetryable(errors.New("connection refused"))).To(BeTrue())
+		Expect(client.IsRetryable(nil)).To(BeFalse())
+	})
+
+	Describe("returned by PostData", func() {
+		var (
+			server     *httptest.Server
+			retryAfter string
+			c          client.Client
+		)
+
+		BeforeEach(func() {
+			retryAfter = ""
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"error":{"code":"TooManyRequests"}}`)
+			}))
+			c = client.NewLogsIngestionClient(&client.LogsIngestionConfig{
+				Endpoint:    server.URL,
+				RuleID:      "dcr-0123",
+				PostTimeout: 5 * time.Second,
+			}, &fakeTokenProvider{token: "token"}, mocks.NewMockLogger())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("exposes status and response of a failed post", func() {
+			msg := []byte(`[]`)
+
+			err := c.PostData(&msg, "CF_LogMessage")
+
+			var postError *client.PostError
+			Expect(errors.As(err, &postError)).To(BeTrue())
+			Expect(postError.StatusCode).To(Equal(http.StatusTooManyRequests))
+			Expect(postError.Message).To(ContainSubstring("TooManyRequests"))
+			Expect(postError.RetryAfter).To(BeZero())
+			Expect(err.Error()).To(ContainSubstring("HTTP response code:429"))
+		})
+
+		It("exposes Retry-After given in seconds", func() {
+			retryAfter = "7"
+			msg := []byte(`[]`)
+
+			err := c.PostData(&msg, "CF_LogMessage")
+
+			Expect(client.RetryAfter(err)).To(Equal(7 * time.Second))
+		})
+
+		It("exposes Retry-After given as a date", func() {
+			retryAfter = time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+			msg := []byte(`[]`)
+
+			err := c.PostData(&msg, "CF_LogMessage")
+
+			Expect(client.RetryAfter(err)).To(BeNumerically("~", time.Minute, 2*time.Second))
+		})
+
+		It("ignores a malformed Retry-After", func() {
+			retryAfter = "soon"
+			msg := []byte(`[]`)
+
+			err := c.PostData(&msg, "CF_LogMessage")
+
+			Expect(client.RetryAfter(err)).To(BeZero())
+		})
+	})
+})
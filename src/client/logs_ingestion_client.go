@@ -0,0 +1,143 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+)
+
+const logsIngestionApiVersion = "2023-01-01"
+
+// LogsIngestionConfig describes the Data Collection Rule to post to
+type LogsIngestionConfig struct {
+	// Data Collection Endpoint, e.g. https://my-dce-abcd.eastus-1.ingest.monitor.azure.com
+	Endpoint string
+	// immutable ID of the Data Collection Rule, e.g. dcr-00000000000000000000000000000000
+	RuleID string
+	// stream names by log type. Log types without an entry are posted to "Custom-<log type>_CL"
+	Streams     map[string]string
+	PostTimeout time.Duration
+	// compress request bodies with gzip
+	Gzip bool
+}
+
+// logsIngestionClient posts messages to the Azure Monitor Logs Ingestion API
+type logsIngestionClient struct {
+	config        *LogsIngestionConfig
+	tokenProvider TokenProvider
+	httpClient    *http.Client
+	logger        lager.Logger
+	gzipWriters   sync.Pool
+}
+
+// NewLogsIngestionClient creates a Client posting to the streams of a Data Collection Rule
+func NewLogsIngestionClient(config *LogsIngestionConfig, tokenProvider TokenProvider, logger lager.Logger) Client {
+	return &logsIngestionClient{
+		config:        config,
+		tokenProvider: tokenProvider,
+		httpClient: &http.Client{
+			Timeout:   config.PostTimeout,
+			Transport: transport(),
+		},
+		logger: logger,
+	}
+}
+
+// PostData posts message to the stream mapped to logType
+func (c *logsIngestionClient) PostData(msg *[]byte, logType string) error {
+	token, err := c.tokenProvider.Token()
+	if err != nil {
+		c.logger.Debug("Error getting token")
+		return err
+	}
+	body := *msg
+	if c.config.Gzip {
+		if body, err = c.compress(body); err != nil {
+			c.logger.Debug("Error compressing HTTP request")
+			return err
+		}
+	}
+	// a bytes.Reader body sets the Content-Length of the request
+	req, err := http.NewRequest(method, c.streamUrl(logType), bytes.NewReader(body))
+	if err != nil {
+		c.logger.Debug("Error creating HTTP request")
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", contentType)
+	if c.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return newPostError(resp)
+	}
+	return nil
+}
+
+// compress gzips msg, reusing writers as they are expensive to allocate
+func (c *logsIngestionClient) compress(msg []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(msg)/4))
+	w, ok := c.gzipWriters.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w, _ = gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	}
+	defer c.gzipWriters.Put(w)
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *logsIngestionClient) streamUrl(logType string) string {
+	return strings.TrimSuffix(c.config.Endpoint, "/") +
+		"/dataCollectionRules/" + url.PathEscape(c.config.RuleID) +
+		"/streams/" + url.PathEscape(c.streamName(logType)) +
+		"?api-version=" + logsIngestionApiVersion
+}
+
+// streamName returns the stream of the Data Collection Rule that logType is posted to
+func (c *logsIngestionClient) streamName(logType string) string {
+	if stream, ok := c.config.Streams[logType]; ok {
+		return stream
+	}
+	return "Custom-" + logType + "_CL"
+}
+
+// ParseStreamMap parses a comma separated list of LOG_TYPE=STREAM pairs
+func ParseStreamMap(s string) (map[string]string, error) {
+	streams := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		logType, stream, ok := strings.Cut(pair, "=")
+		logType, stream = strings.TrimSpace(logType), strings.TrimSpace(stream)
+		if !ok || logType == "" || stream == "" {
+			return nil, fmt.Errorf("invalid stream mapping %q, expected LOG_TYPE=STREAM", pair)
+		}
+		streams[logType] = stream
+	}
+	return streams, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+// logMessageBatch returns a batch of n LogMessages as posted by the nozzle
+func logMessageBatch(n int) []byte {
+	batch := make([]*messages.LogMessage, n)
+	for i := range batch {
+		batch[i] = &messages.LogMessage{
+			BaseMessage: messages.BaseMessage{
+				EventType:      "LogMessage",
+				Deployment:     "cf",
+				Environment:    "prod",
+				EventTime:      time.Unix(0, int64(i)),
+				Job:            "diego-cell",
+				Index:          "3f2b6c1e-0d4a-4c5e-9b1a-7f6e5d4c3b2a",
+				IP:             "10.0.16.21",
+				Tags:           messages.Tags{Values: map[string]string{"source_id": "app-guid"}},
+				NozzleInstance: "0",
+				MessageHash:    fmt.Sprintf("%032x", i),
+				Origin:         "rep",
+			},
+			Message:            fmt.Sprintf(`{"level":"info","ts":%d,"msg":"handled request","path":"/api/v1/orders/%d","status":200}`, i, i),
+			MessageType:        "OUT",
+			Timestamp:          int64(i),
+			AppID:              "6e1f9c2a-5b4d-4e3f-8a2b-1c0d9e8f7a6b",
+			ApplicationName:    "orders",
+			ApplicationOrg:     "retail",
+			ApplicationOrgID:   "0a1b2c3d-4e5f-6a7b-8c9d-0e1f2a3b4c5d",
+			ApplicationSpace:   "production",
+			ApplicationSpaceID: "5d4c3b2a-1f0e-9d8c-7b6a-5f4e3d2c1b0a",
+			SourceType:         "APP/PROC/WEB",
+			SourceInstance:     "0",
+			SourceTypeKey:      "APP/PROC/WEB-OUT",
+		}
+	}
+	msg, err := json.Marshal(batch)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func benchmarkPostData(b *testing.B, gzip bool) {
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Add(n)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	c := client.NewLogsIngestionClient(&client.LogsIngestionConfig{
+		Endpoint:    server.URL,
+		RuleID:      "dcr-0123",
+		PostTimeout: 5 * time.Second,
+		Gzip:        gzip,
+	}, &fakeTokenProvider{token: "token"}, mocks.NewMockLogger())
+	msg := logMessageBatch(1000)
+
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.PostData(&msg, "CF_LogMessage"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(received.Load())/float64(b.N), "sent-bytes/op")
+}
+
+func BenchmarkPostDataUncompressed(b *testing.B) {
+	benchmarkPostData(b, false)
+}
+
+func BenchmarkPostDataGzip(b *testing.B) {
+	benchmarkPostData(b, true)
+}
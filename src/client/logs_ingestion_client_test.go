@@ -0,0 +1,174 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+type fakeTokenProvider struct {
+	token string
+	err   error
+}
+
+func (f *fakeTokenProvider) Token() (string, error) {
+	return f.token, f.err
+}
+
+type ingestionRequest struct {
+	path            string
+	query           string
+	authorization   string
+	contentType     string
+	contentEncoding string
+	contentLength   int64
+	body            string
+}
+
+var _ = Describe("LogsIngestionClient", func() {
+	var (
+		server     *httptest.Server
+		mutex      sync.Mutex
+		requests   []ingestionRequest
+		statusCode int
+		tokens     *fakeTokenProvider
+		c          client.Client
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		statusCode = http.StatusNoContent
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mutex.Lock()
+			defer mutex.Unlock()
+			requests = append(requests, ingestionRequest{
+				path:            r.URL.EscapedPath(),
+				query:           r.URL.RawQuery,
+				authorization:   r.Header.Get("Authorization"),
+				contentType:     r.Header.Get("Content-Type"),
+				contentEncoding: r.Header.Get("Content-Encoding"),
+				contentLength:   r.ContentLength,
+				body:            string(body),
+			})
+			w.WriteHeader(statusCode)
+		}))
+		tokens = &fakeTokenProvider{token: "token"}
+		c = client.NewLogsIngestionClient(&client.LogsIngestionConfig{
+			Endpoint:    server.URL + "/",
+			RuleID:      "dcr-0123",
+			Streams:     map[string]string{"CF_LogMessage": "Custom-CFLogs_CL"},
+			PostTimeout: 5 * time.Second,
+		}, tokens, mocks.NewMockLogger())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("posts to the mapped stream of the rule with a bearer token", func() {
+		msg := []byte(`[{"Message":"hello"}]`)
+
+		Expect(c.PostData(&msg, "CF_LogMessage")).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].path).To(Equal("/dataCollectionRules/dcr-0123/streams/Custom-CFLogs_CL"))
+		Expect(requests[0].query).To(Equal("api-version=2023-01-01"))
+		Expect(requests[0].authorization).To(Equal("Bearer token"))
+		Expect(requests[0].contentType).To(Equal("application/json"))
+		Expect(requests[0].body).To(Equal(`[{"Message":"hello"}]`))
+		Expect(requests[0].contentEncoding).To(BeEmpty())
+	})
+
+	It("compresses posts with gzip if enabled", func() {
+		c = client.NewLogsIngestionClient(&client.LogsIngestionConfig{
+			Endpoint:    server.URL,
+			RuleID:      "dcr-0123",
+			PostTimeout: 5 * time.Second,
+			Gzip:        true,
+		}, tokens, mocks.NewMockLogger())
+		msg := []byte(`[{"Message":"` + strings.Repeat("hello ", 1000) + `"}]`)
+
+		for i := 0; i < 2; i++ {
+			Expect(c.PostData(&msg, "CF_LogMessage")).To(Succeed())
+		}
+
+		Expect(requests).To(HaveLen(2))
+		for _, r := range requests {
+			Expect(r.contentEncoding).To(Equal("gzip"))
+			Expect(r.contentLength).To(Equal(int64(len(r.body))))
+			Expect(len(r.body)).To(BeNumerically("<", len(msg)/10))
+			reader, err := gzip.NewReader(strings.NewReader(r.body))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(io.ReadAll(reader)).To(Equal(msg))
+		}
+		Expect(string(msg)).To(HavePrefix(`[{"Message":"hello`))
+	})
+
+	It("posts unmapped log types to their custom table stream", func() {
+		msg := []byte(`[]`)
+
+		Expect(c.PostData(&msg, "CF_CounterEvent")).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].path).To(Equal("/dataCollectionRules/dcr-0123/streams/Custom-CF_CounterEvent_CL"))
+	})
+
+	It("returns an error on a failed post", func() {
+		statusCode = http.StatusForbidden
+		msg := []byte(`[]`)
+
+		err := c.PostData(&msg, "CF_LogMessage")
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("HTTP response code:403"))
+	})
+
+	It("does not post without a token", func() {
+		tokens.err = errors.New("no token")
+		msg := []byte(`[]`)
+
+		Expect(c.PostData(&msg, "CF_LogMessage")).To(MatchError("no token"))
+		Expect(requests).To(BeEmpty())
+	})
+
+	Describe("ParseStreamMap", func() {
+		It("parses log type to stream pairs", func() {
+			streams, err := client.ParseStreamMap(" CF_LogMessage=Custom-CFLogs_CL, CF_ValueMetric = Custom-CFMetrics_CL,")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(Equal(map[string]string{
+				"CF_LogMessage":  "Custom-CFLogs_CL",
+				"CF_ValueMetric": "Custom-CFMetrics_CL",
+			}))
+		})
+
+		It("accepts an empty map", func() {
+			streams, err := client.ParseStreamMap("")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(streams).To(BeEmpty())
+		})
+
+		It("rejects malformed pairs", func() {
+			_, err := client.ParseStreamMap("CF_LogMessage")
+			Expect(err).To(HaveOccurred())
+
+			_, err = client.ParseStreamMap("CF_LogMessage=")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
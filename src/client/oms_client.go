@@ -94,7 +94,7 @@ func (c *client) PostData(msg *[]byte, logType string) error {
 
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 || resp.StatusCode < 200 {
-		return fmt.Errorf("Post Error. HTTP response code:%d message:%s", resp.StatusCode, resp.Status)
+		return newPostError(resp)
 	}
 	return nil
 }
@@ -0,0 +1,375 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	// DefaultAuthorityHost is the Entra ID authority of the Azure public cloud
+	DefaultAuthorityHost = "https://login.microsoftonline.com"
+	// scope of tokens for the Azure Monitor Logs Ingestion API
+	monitorScope = "https://monitor.azure.com//.default"
+	// tokens are refreshed in the background this long before they expire
+	tokenRefreshMargin = 5 * time.Minute
+	// tokens are not handed out anymore this long before they expire
+	tokenExpiryMargin = 30 * time.Second
+	// wait before retrying a failed background refresh
+	tokenRefreshRetryDelay = 30 * time.Second
+	// lifetime of client assertions signed with a certificate
+	clientAssertionLifetime = 10 * time.Minute
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// TokenProvider provides bearer tokens for Azure Monitor
+type TokenProvider interface {
+	Token() (string, error)
+}
+
+// EntraIDConfig identifies an Entra ID app registration and its credential.
+// Exactly one of ClientSecret, CertificatePath and FederatedTokenFile is used, in that order.
+type EntraIDConfig struct {
+	AuthorityHost string
+	TenantID      string
+	ClientID      string
+	ClientSecret  string
+	// PEM file holding certificate and unencrypted private key, or PFX file
+	CertificatePath     string
+	CertificatePassword string
+	// file holding a federated token, such as a projected service account token, re-read on every refresh
+	FederatedTokenFile string
+}
+
+// NewTokenProvider returns a TokenProvider for the credential set in config
+func NewTokenProvider(config *EntraIDConfig, logger lager.Logger) (TokenProvider, error) {
+	if config.TenantID == "" || config.ClientID == "" {
+		return nil, errors.New("tenant ID and client ID are required")
+	}
+	switch {
+	case config.ClientSecret != "":
+		return NewClientSecretTokenProvider(config, logger), nil
+	case config.CertificatePath != "":
+		return NewClientCertificateTokenProvider(config, logger)
+	case config.FederatedTokenFile != "":
+		return NewFederatedTokenProvider(config, logger), nil
+	}
+	return nil, errors.New("one of client secret, client certificate or federated token file is required")
+}
+
+// NewClientSecretTokenProvider returns a TokenProvider that authenticates with a client secret
+func NewClientSecretTokenProvider(config *EntraIDConfig, logger lager.Logger) TokenProvider {
+	secret := config.ClientSecret
+	return newEntraTokenProvider(config, func(string) (url.Values, error) {
+		return url.Values{"client_secret": {secret}}, nil
+	}, logger)
+}
+
+// NewClientCertificateTokenProvider returns a TokenProvider that authenticates with client
+// assertions signed by the private key of a certificate registered with the app
+func NewClientCertificateTokenProvider(config *EntraIDConfig, logger lager.Logger) (TokenProvider, error) {
+	data, err := os.ReadFile(config.CertificatePath)
+	if err != nil {
+		return nil, err
+	}
+	cert, key, err := parseCertificate(data, config.CertificatePassword)
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate %s: %w", config.CertificatePath, err)
+	}
+	clientID := config.ClientID
+	return newEntraTokenProvider(config, func(tokenUrl string) (url.Values, error) {
+		assertion, err := signClientAssertion(clientID, tokenUrl, cert, key)
+		if err != nil {
+			return nil, err
+		}
+		return url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {assertion}}, nil
+	}, logger), nil
+}
+
+// NewFederatedTokenProvider returns a TokenProvider that authenticates with a federated
+// token read from a file, as used by workload identity federation
+func NewFederatedTokenProvider(config *EntraIDConfig, logger lager.Logger) TokenProvider {
+	tokenFile := config.FederatedTokenFile
+	return newEntraTokenProvider(config, func(string) (url.Values, error) {
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		return url.Values{"client_assertion_type": {clientAssertionType}, "client_assertion": {strings.TrimSpace(string(assertion))}}, nil
+	}, logger)
+}
+
+// credentialFunc returns the form values proving the identity of the client to tokenUrl
+type credentialFunc func(tokenUrl string) (url.Values, error)
+
+// entraTokenProvider runs the client credentials flow against the Entra ID token endpoint.
+// Tokens are cached, and refreshed in the background shortly before they expire so that
+// callers are not blocked by the token endpoint.
+type entraTokenProvider struct {
+	tokenUrl   string
+	clientID   string
+	credential credentialFunc
+	httpClient *http.Client
+	logger     lager.Logger
+
+	mutex      sync.Mutex
+	token      string
+	expiresAt  time.Time // token is not handed out from then on
+	refreshAt  time.Time // token is refreshed in the background from then on
+	refreshing bool
+	fetch      *tokenFetch // acquisition in flight, nil if none
+}
+
+// tokenFetch is the acquisition of a token that callers without a valid token wait for
+type tokenFetch struct {
+	done  chan struct{} // closed once token or err is set
+	token string
+	err   error
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+func newEntraTokenProvider(config *EntraIDConfig, credential credentialFunc, logger lager.Logger) *entraTokenProvider {
+	authorityHost := config.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = DefaultAuthorityHost
+	}
+	return &entraTokenProvider{
+		tokenUrl:   strings.TrimSuffix(authorityHost, "/") + "/" + url.PathEscape(config.TenantID) + "/oauth2/v2.0/token",
+		clientID:   config.ClientID,
+		credential: credential,
+		httpClient: &http.Client{Timeout: 30 * time.Second, Transport: transport()},
+		logger:     logger,
+	}
+}
+
+// Token returns the cached token, acquiring a new one if there is none or it is about to expire.
+// Concurrent callers wait for the same acquisition, which does not hold the lock.
+func (p *entraTokenProvider) Token() (string, error) {
+	p.mutex.Lock()
+	now := time.Now()
+	if p.token != "" && now.Before(p.expiresAt) {
+		if !now.Before(p.refreshAt) && !p.refreshing {
+			p.refreshing = true
+			go p.refresh()
+		}
+		token := p.token
+		p.mutex.Unlock()
+		return token, nil
+	}
+	f := p.fetch
+	if f == nil {
+		f = &tokenFetch{done: make(chan struct{})}
+		p.fetch = f
+		p.mutex.Unlock()
+		p.acquire(f)
+	} else {
+		p.mutex.Unlock()
+		<-f.done
+	}
+	return f.token, f.err
+}
+
+// refresh acquires a new token without holding the lock, so callers keep getting the cached token meanwhile
+func (p *entraTokenProvider) refresh() {
+	token, lifetime, err := p.requestToken()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.refreshing = false
+	if err != nil {
+		p.logger.Error("error refreshing token", err)
+		p.refreshAt = time.Now().Add(tokenRefreshRetryDelay)
+		return
+	}
+	p.storeLocked(token, lifetime)
+}
+
+// acquire requests a token for the callers waiting for f, and caches it
+func (p *entraTokenProvider) acquire(f *tokenFetch) {
+	token, lifetime, err := p.requestToken()
+
+	p.mutex.Lock()
+	if err == nil {
+		p.storeLocked(token, lifetime)
+	}
+	p.fetch = nil
+	p.mutex.Unlock()
+
+	f.token, f.err = token, err
+	close(f.done)
+}
+
+func (p *entraTokenProvider) storeLocked(token string, lifetime time.Duration) {
+	now := time.Now()
+	p.token = token
+	p.expiresAt = now.Add(lifetime - minDuration(tokenExpiryMargin, lifetime/10))
+	p.refreshAt = now.Add(lifetime - minDuration(tokenRefreshMargin, lifetime/2))
+	p.logger.Debug("acquired token", lager.Data{"expires at": p.expiresAt.String()}, lager.Data{"refresh at": p.refreshAt.String()})
+}
+
+func (p *entraTokenProvider) requestToken() (string, time.Duration, error) {
+	form, err := p.credential(p.tokenUrl)
+	if err != nil {
+		return "", 0, err
+	}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", p.clientID)
+	form.Set("scope", monitorScope)
+
+	resp, err := p.httpClient.PostForm(p.tokenUrl, form)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("Token Error. HTTP response code:%d message:%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, err
+	}
+	if token.AccessToken == "" || token.ExpiresIn <= 0 {
+		return "", 0, errors.New("Token Error. no access token in response")
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseCertificate reads the certificate and RSA private key from PEM or PFX data
+func parseCertificate(data []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	var certs []*x509.Certificate
+	var key *rsa.PrivateKey
+	if strings.Contains(string(data), "-----BEGIN") {
+		for rest := data; ; {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, err
+				}
+				certs = append(certs, cert)
+			case strings.HasSuffix(block.Type, "PRIVATE KEY") && key == nil:
+				parsed, err := parsePrivateKey(block.Bytes)
+				if err != nil {
+					return nil, nil, err
+				}
+				key = parsed
+			}
+		}
+	} else {
+		// PFX files of OpenSSL 3 and Azure Key Vault are encrypted with AES by default
+		privateKey, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return nil, nil, err
+		}
+		rsaKey, ok := privateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("private key is not an RSA key")
+		}
+		key = rsaKey
+		certs = append([]*x509.Certificate{cert}, caCerts...)
+	}
+	if key == nil {
+		return nil, nil, errors.New("no RSA private key found")
+	}
+	for _, cert := range certs {
+		if key.PublicKey.Equal(cert.PublicKey) {
+			return cert, key, nil
+		}
+	}
+	return nil, nil, errors.New("no certificate matching the private key found")
+}
+
+func parsePrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signClientAssertion creates the JWT proving possession of the certificate's private key
+func signClientAssertion(clientID string, audience string, cert *x509.Certificate, key *rsa.PrivateKey) (string, error) {
+	thumbprint := sha1.Sum(cert.Raw) //nolint:gosec
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
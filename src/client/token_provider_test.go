@@ -0,0 +1,289 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package client_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+// tokenServer is a local stand-in for the Entra ID token endpoint
+type tokenServer struct {
+	server    *httptest.Server
+	mutex     sync.Mutex
+	forms     []map[string]string
+	expiresIn int
+	delay     time.Duration
+}
+
+func newTokenServer() *tokenServer {
+	s := &tokenServer{expiresIn: 3600}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.URL.Path != "/tenant/oauth2/v2.0/token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		form := make(map[string]string)
+		for k := range r.PostForm {
+			form[k] = r.PostForm.Get(k)
+		}
+		s.mutex.Lock()
+		s.forms = append(s.forms, form)
+		n := len(s.forms)
+		expiresIn, delay := s.expiresIn, s.delay
+		s.mutex.Unlock()
+
+		time.Sleep(delay)
+		if form["client_secret"] == "wrong" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":%d,"token_type":"Bearer"}`, n, expiresIn)
+	}))
+	return s
+}
+
+func (s *tokenServer) requests() []map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]map[string]string(nil), s.forms...)
+}
+
+func (s *tokenServer) config() *client.EntraIDConfig {
+	return &client.EntraIDConfig{
+		AuthorityHost: s.server.URL + "/",
+		TenantID:      "tenant",
+		ClientID:      "client",
+	}
+}
+
+// verifyAssertion checks the signature and claims of a client assertion signed with the test certificate
+func verifyAssertion(assertion string, audience string) {
+	data, err := os.ReadFile("testdata/client-certificate.pem")
+	Expect(err).NotTo(HaveOccurred())
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+
+	parts := strings.Split(assertion, ".")
+	Expect(parts).To(HaveLen(3))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	Expect(err).NotTo(HaveOccurred())
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	Expect(rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)).To(Succeed())
+
+	var header map[string]string
+	headerJson, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	Expect(json.Unmarshal(headerJson, &header)).To(Succeed())
+	Expect(header["alg"]).To(Equal("RS256"))
+	Expect(header["x5t"]).NotTo(BeEmpty())
+
+	var claims map[string]interface{}
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	Expect(json.Unmarshal(claimsJson, &claims)).To(Succeed())
+	Expect(claims["aud"]).To(Equal(audience))
+	Expect(claims["iss"]).To(Equal("client"))
+	Expect(claims["sub"]).To(Equal("client"))
+	Expect(claims["jti"]).NotTo(BeEmpty())
+	Expect(claims["exp"]).To(BeNumerically(">", time.Now().Unix()))
+}
+
+var _ = Describe("TokenProvider", func() {
+	var (
+		server *tokenServer
+		config *client.EntraIDConfig
+		logger *mocks.MockLogger
+	)
+
+	BeforeEach(func() {
+		server = newTokenServer()
+		config = server.config()
+		logger = mocks.NewMockLogger()
+	})
+
+	AfterEach(func() {
+		server.server.Close()
+	})
+
+	Context("with a client secret", func() {
+		BeforeEach(func() {
+			config.ClientSecret = "secret"
+		})
+
+		It("acquires a token and caches it", func() {
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Token()).To(Equal("token-1"))
+			Expect(p.Token()).To(Equal("token-1"))
+
+			requests := server.requests()
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0]).To(Equal(map[string]string{
+				"grant_type":    "client_credentials",
+				"client_id":     "client",
+				"client_secret": "secret",
+				"scope":         "https://monitor.azure.com//.default",
+			}))
+		})
+
+		It("returns an error when the token is refused", func() {
+			config.ClientSecret = "wrong"
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = p.Token()
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid_client"))
+		})
+
+		It("refreshes the token in the background before it expires", func() {
+			server.expiresIn = 2
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Token()).To(Equal("token-1"))
+
+			// within the refresh margin the cached token is still handed out
+			time.Sleep(1100 * time.Millisecond)
+			server.mutex.Lock()
+			server.delay = 300 * time.Millisecond
+			server.mutex.Unlock()
+			Expect(p.Token()).To(Equal("token-1"))
+			Expect(p.Token()).To(Equal("token-1"))
+
+			Eventually(p.Token).Should(Equal("token-2"))
+			Expect(server.requests()).To(HaveLen(2))
+		})
+
+		It("acquires a single token for concurrent callers", func() {
+			server.delay = 200 * time.Millisecond
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			tokens := make(chan string, 10)
+			for i := 0; i < cap(tokens); i++ {
+				go func() {
+					defer GinkgoRecover()
+					token, err := p.Token()
+					Expect(err).NotTo(HaveOccurred())
+					tokens <- token
+				}()
+			}
+			for i := 0; i < cap(tokens); i++ {
+				Eventually(tokens).Should(Receive(Equal("token-1")))
+			}
+			Expect(server.requests()).To(HaveLen(1))
+		})
+
+		It("acquires a new token once the cached one expired", func() {
+			server.expiresIn = 1
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Token()).To(Equal("token-1"))
+
+			time.Sleep(1100 * time.Millisecond)
+
+			Expect(p.Token()).NotTo(Equal("token-1"))
+		})
+	})
+
+	Context("with a client certificate", func() {
+		It("signs a client assertion with a PEM certificate", func() {
+			config.CertificatePath = "testdata/client-certificate.pem"
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Token()).To(Equal("token-1"))
+
+			requests := server.requests()
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0]["client_assertion_type"]).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+			Expect(requests[0]).NotTo(HaveKey("client_secret"))
+			verifyAssertion(requests[0]["client_assertion"], server.server.URL+"/tenant/oauth2/v2.0/token")
+		})
+
+		It("signs a client assertion with a PFX certificate", func() {
+			config.CertificatePath = "testdata/client-certificate.pfx"
+			config.CertificatePassword = "secret"
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Token()).To(Equal("token-1"))
+
+			requests := server.requests()
+			Expect(requests).To(HaveLen(1))
+			verifyAssertion(requests[0]["client_assertion"], server.server.URL+"/tenant/oauth2/v2.0/token")
+		})
+
+		It("signs a client assertion with a PFX certificate encrypted with AES", func() {
+			// exported by OpenSSL 3 with its defaults: AES-256-CBC, PBKDF2 and a SHA-256 MAC
+			config.CertificatePath = "testdata/client-certificate-aes.pfx"
+			config.CertificatePassword = "secret"
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Token()).To(Equal("token-1"))
+
+			requests := server.requests()
+			Expect(requests).To(HaveLen(1))
+			verifyAssertion(requests[0]["client_assertion"], server.server.URL+"/tenant/oauth2/v2.0/token")
+		})
+
+		It("fails on a wrong PFX password", func() {
+			config.CertificatePath = "testdata/client-certificate.pfx"
+			config.CertificatePassword = "wrong"
+
+			_, err := client.NewTokenProvider(config, logger)
+
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with a federated token file", func() {
+		It("posts the current content of the file as client assertion", func() {
+			tokenFile := filepath.Join(GinkgoT().TempDir(), "token")
+			Expect(os.WriteFile(tokenFile, []byte("federated-1\n"), 0600)).To(Succeed())
+			config.FederatedTokenFile = tokenFile
+			server.expiresIn = 1
+			p, err := client.NewTokenProvider(config, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(p.Token()).To(Equal("token-1"))
+			Expect(os.WriteFile(tokenFile, []byte("federated-2\n"), 0600)).To(Succeed())
+			time.Sleep(1100 * time.Millisecond)
+			Expect(p.Token()).NotTo(Equal("token-1"))
+
+			requests := server.requests()
+			Expect(requests[0]["client_assertion"]).To(Equal("federated-1"))
+			Expect(requests[0]["client_assertion_type"]).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+			Expect(requests[len(requests)-1]["client_assertion"]).To(Equal("federated-2"))
+		})
+	})
+
+	It("requires a credential", func() {
+		_, err := client.NewTokenProvider(config, logger)
+
+		Expect(err).To(HaveOccurred())
+	})
+})
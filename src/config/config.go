@@ -0,0 +1,553 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package config holds the configuration of the nozzle, which comes from an optional YAML file
+// overridden by command line flags and environment variables. See Flags for the flags and
+// environment variables, and the README for the file.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/redact"
+	"gopkg.in/yaml.v3"
+)
+
+// APIs to post events to
+const (
+	DataCollectorAPI = "data-collector"
+	LogsIngestionAPI = "logs-ingestion"
+)
+
+const (
+	minPostTimeout     = 1 * time.Second
+	maxPostTimeout     = 60 * time.Second
+	maxMessagesPerPost = 10000
+	// a post to the HTTP Data Collector API is at most 30MB, and records are up to 32KB per field
+	minBatchSize              = 1 * units.MiB
+	maxDataCollectorBatchSize = 30 * units.MiB
+	// just under the limit of the HTTP Data Collector API
+	defaultDataCollectorBatchSize = 29 * units.MiB
+	// a post to the Logs Ingestion API is at most 1MB
+	maxLogsIngestionBatchSize = 1 * units.MiB
+	// placeholder of secrets in Masked configs
+	mask = "*****"
+	// name of the output the Output settings configure
+	defaultOutput = "default"
+)
+
+// names of outputs are also the suffixes of their spool directories
+var outputNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Config is the configuration of the nozzle
+type Config struct {
+	CF                    CF            `yaml:"cf"`
+	Firehose              Firehose      `yaml:"firehose"`
+	Output                Output        `yaml:"output"`
+	Outputs               []NamedOutput `yaml:"outputs"`
+	Routes                []string      `yaml:"routes"` // see filter.Router
+	Batch                 Batch         `yaml:"batch"`
+	Retry                 Retry         `yaml:"retry"`
+	Filter                Filter        `yaml:"filter"`
+	Caching               Caching       `yaml:"caching"`
+	Events                Events        `yaml:"events"`
+	JSONLogs              JSONLogs      `yaml:"json_logs"`
+	Multiline             Multiline     `yaml:"multiline"`
+	Redaction             Redaction     `yaml:"redaction"`
+	Spool                 Spool         `yaml:"spool"`
+	Metrics               Metrics       `yaml:"metrics"`
+	LogLevel              string        `yaml:"log_level"`
+	LogEventCount         bool          `yaml:"log_event_count"`
+	LogEventCountInterval Duration      `yaml:"log_event_count_interval"`
+	ShutdownTimeout       Duration      `yaml:"shutdown_timeout"`
+}
+
+// CF is the CF environment the nozzle reads from
+type CF struct {
+	APIAddress        string `yaml:"api_address"`
+	User              string `yaml:"user"`
+	Password          string `yaml:"password"`
+	Environment       string `yaml:"environment"`
+	SkipSSLValidation bool   `yaml:"skip_ssl_validation"`
+}
+
+// Firehose is how the nozzle reads envelopes
+type Firehose struct {
+	DopplerAddress     string   `yaml:"doppler_address"`
+	UseRLPGateway      bool     `yaml:"use_rlp_gateway"`
+	RLPGatewayAddress  string   `yaml:"rlp_gateway_address"`
+	RLPGatewayNativeV2 bool     `yaml:"rlp_gateway_native_v2"`
+	IdleTimeout        Duration `yaml:"idle_timeout"`
+}
+
+// Output is where the nozzle posts events
+type Output struct {
+	API             string        `yaml:"api"`
+	PostTimeout     Duration      `yaml:"post_timeout"`
+	Gzip            bool          `yaml:"gzip"`
+	AzureResourceID string        `yaml:"azure_resource_id"`
+	DataCollector   DataCollector `yaml:"data_collector"`
+	LogsIngestion   LogsIngestion `yaml:"logs_ingestion"`
+	EntraID         EntraID       `yaml:"entra_id"`
+}
+
+// NamedOutput is an output besides the default one, which routes post events to by name.
+// Settings missing from the file have the defaults of the default output.
+type NamedOutput struct {
+	Name string `yaml:"name"`
+	// batch.max_size of the output, batch.max_size if not set
+	BatchMaxSize ByteSize `yaml:"batch_max_size"`
+	// drop the events routed to the output when it cannot keep up, rather than holding up the
+	// other outputs
+	DropWhenFull bool `yaml:"drop_when_full"`
+	Output       `yaml:",inline"`
+}
+
+// UnmarshalYAML decodes the output over the defaults
+func (o *NamedOutput) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NamedOutput
+	output := plain{Output: Default().Output}
+	if err := unmarshal(&output); err != nil {
+		return err
+	}
+	*o = NamedOutput(output)
+	return nil
+}
+
+// DataCollector is the workspace events are posted to with the HTTP Data Collector API
+type DataCollector struct {
+	Workspace string `yaml:"workspace"`
+	Key       string `yaml:"key"`
+}
+
+// LogsIngestion is the Data Collection Rule events are posted to with the Logs Ingestion API
+type LogsIngestion struct {
+	DCEEndpoint    string `yaml:"dce_endpoint"`
+	DCRImmutableID string `yaml:"dcr_immutable_id"`
+	// streams by log type, log types not listed are posted to Custom-<LOG_TYPE>_CL
+	Streams map[string]string `yaml:"streams"`
+}
+
+// EntraID is the app registration posting to the Logs Ingestion API
+type EntraID struct {
+	TenantID            string `yaml:"tenant_id"`
+	ClientID            string `yaml:"client_id"`
+	ClientSecret        string `yaml:"client_secret"`
+	CertificatePath     string `yaml:"certificate_path"`
+	CertificatePassword string `yaml:"certificate_password"`
+	FederatedTokenFile  string `yaml:"federated_token_file"`
+	AuthorityHost       string `yaml:"authority_host"`
+}
+
+// Batch is how events are batched into posts
+type Batch struct {
+	Time        Duration `yaml:"time"`
+	MaxMessages int      `yaml:"max_messages"`
+	// the limit of the output API if not set
+	MaxSize ByteSize `yaml:"max_size"`
+}
+
+// Retry is how failed posts are retried
+type Retry struct {
+	MaxAttempts int      `yaml:"max_attempts"`
+	BaseDelay   Duration `yaml:"base_delay"`
+	MaxDelay    Duration `yaml:"max_delay"`
+	Jitter      float64  `yaml:"jitter"`
+}
+
+// Filter is which events are posted
+type Filter struct {
+	// ORG.SPACE or ORG.* of the apps whose events are posted, all if empty
+	SpaceWhitelist []string `yaml:"space_whitelist"`
+	// METRIC, LOG or HTTP
+	ExcludedTypes []string `yaml:"excluded_types"`
+	// rules of the filter package, applied after ExcludedTypes
+	Rules []string `yaml:"rules"`
+}
+
+// Caching is how the app info cache is loaded
+type Caching struct {
+	Interval            Duration `yaml:"interval"`
+	FullRefreshInterval Duration `yaml:"full_refresh_interval"`
+	NegativeTTL         Duration `yaml:"negative_ttl"`
+	LookupRate          float64  `yaml:"lookup_rate"`
+	LookupBurst         int      `yaml:"lookup_burst"`
+	SnapshotFile        string   `yaml:"snapshot_file"`
+}
+
+// Events is what events carry besides the fields of their envelopes
+type Events struct {
+	LegacyTags      bool     `yaml:"legacy_tags"`
+	PromotedTags    []string `yaml:"promoted_tags"`
+	AppMetadataKeys []string `yaml:"app_metadata_keys"`
+}
+
+// JSONLogs is which JSON app logs are parsed into columns
+type JSONLogs struct {
+	// ORG, ORG.SPACE or ORG.SPACE.APP, or * for all apps; disabled if empty
+	Scope     []string `yaml:"scope"`
+	MaxSize   ByteSize `yaml:"max_size"`
+	MaxFields int      `yaml:"max_fields"`
+}
+
+// Multiline is how the lines of multiline app logs are joined; disabled without a start pattern
+type Multiline struct {
+	StartPattern string   `yaml:"start_pattern"`
+	MaxLines     int      `yaml:"max_lines"`
+	MaxSize      ByteSize `yaml:"max_size"`
+	MaxWait      Duration `yaml:"max_wait"`
+}
+
+// Redaction is what is redacted from events; disabled without detectors and patterns
+type Redaction struct {
+	// built-in detectors, or all
+	Detectors []string `yaml:"detectors"`
+	Patterns  []string `yaml:"patterns"`
+}
+
+// Spool is where batches that fail to post are spooled; disabled without a directory
+type Spool struct {
+	Dir     string   `yaml:"dir"`
+	MaxSize ByteSize `yaml:"max_size"`
+	MaxAge  Duration `yaml:"max_age"`
+}
+
+// Metrics is where metrics and health checks are served; disabled without an address
+type Metrics struct {
+	Address           string   `yaml:"address"`
+	MaxEnvelopeAge    Duration `yaml:"max_envelope_age"`
+	MaxPostFailureAge Duration `yaml:"max_post_failure_age"`
+}
+
+// Default returns the default config
+func Default() *Config {
+	return &Config{
+		CF: CF{
+			Environment: "cf",
+		},
+		Firehose: Firehose{
+			IdleTimeout: Duration(25 * time.Second),
+		},
+		Output: Output{
+			API:         DataCollectorAPI,
+			PostTimeout: Duration(5 * time.Second),
+			EntraID: EntraID{
+				AuthorityHost: client.DefaultAuthorityHost,
+			},
+		},
+		Batch: Batch{
+			Time:        Duration(5 * time.Second),
+			MaxMessages: 1000,
+		},
+		Retry: Retry{
+			MaxAttempts: 4,
+			BaseDelay:   Duration(time.Second),
+			MaxDelay:    Duration(30 * time.Second),
+			Jitter:      0.2,
+		},
+		Caching: Caching{
+			Interval:            Duration(60 * time.Second),
+			FullRefreshInterval: Duration(time.Hour),
+			NegativeTTL:         Duration(time.Minute),
+			LookupRate:          10,
+			LookupBurst:         20,
+		},
+		JSONLogs: JSONLogs{
+			MaxSize:   ByteSize(64 * units.KiB),
+			MaxFields: 100,
+		},
+		Multiline: Multiline{
+			MaxLines: 500,
+			MaxSize:  ByteSize(32 * units.KiB),
+			MaxWait:  Duration(time.Second),
+		},
+		Spool: Spool{
+			MaxSize: ByteSize(units.GiB),
+			MaxAge:  Duration(24 * time.Hour),
+		},
+		Metrics: Metrics{
+			MaxEnvelopeAge:    Duration(5 * time.Minute),
+			MaxPostFailureAge: Duration(10 * time.Minute),
+		},
+		LogLevel:              "INFO",
+		LogEventCountInterval: Duration(60 * time.Second),
+		ShutdownTimeout:       Duration(8 * time.Second),
+	}
+}
+
+// LoadFile overrides c with the settings of a YAML file. Unknown settings are errors.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return nil
+}
+
+// Validate returns the errors of all invalid settings
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.CF.APIAddress != "", "cf.api_address is required unless the nozzle runs as a CF app")
+	check(c.CF.User != "", "cf.user is required")
+	check(c.CF.Password != "", "cf.password is required")
+	c.Output.validate("output", check)
+	c.Output.validateBatchMaxSize("batch.max_size", c.Batch.MaxSize, check)
+	outputs := map[string]bool{defaultOutput: true}
+	for i, o := range c.Outputs {
+		check(outputNamePattern.MatchString(o.Name), "outputs[%d].name must be made of letters, digits, _ and -, not %q", i, o.Name)
+		check(!outputs[o.Name], "outputs[%d].name %q is already taken", i, o.Name)
+		outputs[o.Name] = true
+		o.validate(fmt.Sprintf("outputs.%s", o.Name), check)
+		if o.BatchMaxSize > 0 {
+			o.validateBatchMaxSize(fmt.Sprintf("outputs.%s.batch_max_size", o.Name), o.BatchMaxSize, check)
+		} else {
+			o.validateBatchMaxSize(fmt.Sprintf("batch.max_size of outputs.%s", o.Name), c.Batch.MaxSize, check)
+		}
+	}
+	router, err := c.Router()
+	check(err == nil, "routes: %s", err)
+	for _, name := range router.Outputs() {
+		check(outputs[name], "routes: output %q is not %s or the name of one of outputs", name, defaultOutput)
+	}
+
+	check(c.Batch.Time > 0, "batch.time must be positive")
+	check(c.Batch.MaxMessages > 0 && c.Batch.MaxMessages <= maxMessagesPerPost,
+		"batch.max_messages must be between 1 and %d", maxMessagesPerPost)
+	check(c.Retry.MaxAttempts >= 1, "retry.max_attempts must be at least 1")
+	check(c.Retry.BaseDelay >= 0 && c.Retry.MaxDelay >= 0, "retry.base_delay and max_delay cannot be negative")
+	check(c.Retry.Jitter >= 0 && c.Retry.Jitter <= 1, "retry.jitter must be between 0 and 1")
+
+	_, err = filter.Parse(c.FilterRules())
+	check(err == nil, "filter: %s", err)
+	check(c.Caching.Interval > 0 && c.Caching.FullRefreshInterval > 0, "caching.interval and full_refresh_interval must be positive")
+	check(c.Caching.NegativeTTL >= 0 && c.Caching.LookupRate >= 0, "caching.negative_ttl and lookup_rate cannot be negative")
+	check(c.Caching.LookupBurst > 0, "caching.lookup_burst must be positive")
+	tags := c.TagsConfig()
+	err = tags.Validate()
+	check(err == nil, "events.promoted_tags: %s", err)
+
+	if len(c.JSONLogs.Scope) > 0 {
+		_, err = messages.NewJSONLogParser(strings.Join(c.JSONLogs.Scope, ","), int(c.JSONLogs.MaxSize), c.JSONLogs.MaxFields)
+		check(err == nil, "json_logs: %s", err)
+	}
+	if c.Multiline.StartPattern != "" {
+		_, err = regexp.Compile(c.Multiline.StartPattern)
+		check(err == nil, "multiline.start_pattern: %s", err)
+		check(c.Multiline.MaxLines > 0 && c.Multiline.MaxSize > 0 && c.Multiline.MaxWait > 0,
+			"multiline.max_lines, max_size and max_wait must be positive")
+	}
+	if c.Redaction.Enabled() {
+		_, err = redact.New(c.RedactionDetectors(), c.Redaction.Patterns, nil)
+		check(err == nil, "redaction: %s", err)
+	}
+	if c.Spool.Dir != "" {
+		check(c.Spool.MaxSize > 0 && c.Spool.MaxAge > 0, "spool.max_size and max_age must be positive")
+	}
+	check(c.Metrics.MaxEnvelopeAge >= 0 && c.Metrics.MaxPostFailureAge >= 0,
+		"metrics.max_envelope_age and max_post_failure_age cannot be negative")
+
+	switch strings.ToUpper(c.LogLevel) {
+	case "DEBUG", "INFO", "ERROR":
+	default:
+		check(false, "log_level must be DEBUG, INFO or ERROR, not %q", c.LogLevel)
+	}
+	check(!c.LogEventCount || c.LogEventCountInterval > 0, "log_event_count_interval must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	return errors.Join(errs...)
+}
+
+// validate checks the settings of o, named name in errors
+func (o *Output) validate(name string, check func(ok bool, format string, args ...interface{})) {
+	switch o.API {
+	case DataCollectorAPI:
+		check(o.DataCollector.Workspace != "" && o.DataCollector.Key != "",
+			"%s.data_collector.workspace and key are required by the %s API", name, DataCollectorAPI)
+	case LogsIngestionAPI:
+		check(o.LogsIngestion.DCEEndpoint != "" && o.LogsIngestion.DCRImmutableID != "",
+			"%s.logs_ingestion.dce_endpoint and dcr_immutable_id are required by the %s API", name, LogsIngestionAPI)
+		o.EntraID.validate(name+".entra_id", check)
+	default:
+		check(false, "%s.api must be %s or %s, not %q", name, DataCollectorAPI, LogsIngestionAPI, o.API)
+	}
+	check(time.Duration(o.PostTimeout) >= minPostTimeout && time.Duration(o.PostTimeout) <= maxPostTimeout,
+		"%s.post_timeout must be between %s and %s", name, minPostTimeout, maxPostTimeout)
+}
+
+// validate checks that e identifies the app registration and has one credential, named name in
+// errors. The credential files are only read by the nozzle, as they may not exist where the
+// config is validated.
+func (e *EntraID) validate(name string, check func(ok bool, format string, args ...interface{})) {
+	check(e.TenantID != "" && e.ClientID != "", "%s.tenant_id and client_id are required by the %s API", name, LogsIngestionAPI)
+	credentials := 0
+	for _, credential := range []string{e.ClientSecret, e.CertificatePath, e.FederatedTokenFile} {
+		if credential != "" {
+			credentials++
+		}
+	}
+	check(credentials == 1, "%s requires exactly one of client_secret, certificate_path and federated_token_file, not %d", name, credentials)
+}
+
+// validateBatchMaxSize checks the max size of the batches posted to o against the limit of its
+// API, naming the setting name in errors. Sizes that are not set default to the limit.
+func (o *Output) validateBatchMaxSize(name string, size ByteSize, check func(ok bool, format string, args ...interface{})) {
+	if size == 0 {
+		return
+	}
+	check(units.Base2Bytes(size) >= minBatchSize, "%s must be at least %s", name, minBatchSize)
+	limit := o.batchSizeLimit()
+	check(units.Base2Bytes(size) <= limit, "%s cannot exceed %s with the %s API", name, limit, o.API)
+}
+
+// batchSizeLimit returns the max size of a post to the API of o
+func (o *Output) batchSizeLimit() units.Base2Bytes {
+	if o.API == LogsIngestionAPI {
+		return maxLogsIngestionBatchSize
+	}
+	return maxDataCollectorBatchSize
+}
+
+// MaxBatchSize returns the max size of the batches posted to o, size if set and otherwise the
+// default for the API of o
+func (o *Output) MaxBatchSize(size ByteSize) ByteSize {
+	switch {
+	case size > 0:
+		return size
+	case o.API == LogsIngestionAPI:
+		return ByteSize(maxLogsIngestionBatchSize)
+	default:
+		return ByteSize(defaultDataCollectorBatchSize)
+	}
+}
+
+// MaxBatchSize returns the max size of the batches posted to the default output
+func (c *Config) MaxBatchSize() ByteSize {
+	return c.Output.MaxBatchSize(c.Batch.MaxSize)
+}
+
+// MaxBatchSize returns the max size of the batches posted to o, given the batch settings b of
+// the nozzle
+func (o *NamedOutput) MaxBatchSize(b Batch) ByteSize {
+	if o.BatchMaxSize > 0 {
+		return o.Output.MaxBatchSize(o.BatchMaxSize)
+	}
+	return o.Output.MaxBatchSize(b.MaxSize)
+}
+
+// OutputSpool returns the spool settings of the output of the given name. The spools of
+// named outputs are siblings of the spool directory, e.g. spool-payments next to spool, and
+// all spools share the max size evenly.
+func (c *Config) OutputSpool(name string) Spool {
+	s := c.Spool
+	if s.Dir == "" {
+		return s
+	}
+	if name != defaultOutput {
+		s.Dir = filepath.Clean(s.Dir) + "-" + name
+	}
+	s.MaxSize /= ByteSize(len(c.Outputs) + 1)
+	return s
+}
+
+// Router returns the router of events to outputs, nil if all events go to the default output
+func (c *Config) Router() (*filter.Router, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+	return filter.ParseRoutes(strings.Join(c.Routes, ";"))
+}
+
+// FilterRules returns the rules of the envelope filter, empty if no events are filtered
+func (c *Config) FilterRules() string {
+	if len(c.Filter.ExcludedTypes) == 0 && len(c.Filter.Rules) == 0 {
+		return ""
+	}
+	return filter.LegacyRules(strings.Join(c.Filter.ExcludedTypes, ",")) + ";" + strings.Join(c.Filter.Rules, ";")
+}
+
+// TagsConfig returns how the tags of envelopes are posted
+func (c *Config) TagsConfig() messages.TagsConfig {
+	return messages.TagsConfig{Legacy: c.Events.LegacyTags, Promoted: c.Events.PromotedTags}
+}
+
+// Enabled returns whether anything is redacted
+func (r *Redaction) Enabled() bool {
+	return len(r.Detectors) > 0 || len(r.Patterns) > 0
+}
+
+// RedactionDetectors returns the built-in detectors to redact with
+func (c *Config) RedactionDetectors() []string {
+	for _, name := range c.Redaction.Detectors {
+		if name == "all" {
+			return redact.Detectors
+		}
+	}
+	return c.Redaction.Detectors
+}
+
+// EntraIDConfig returns the credential of the app registration posting to the Logs Ingestion API
+func (o *Output) EntraIDConfig() *client.EntraIDConfig {
+	return &client.EntraIDConfig{
+		AuthorityHost:       o.EntraID.AuthorityHost,
+		TenantID:            o.EntraID.TenantID,
+		ClientID:            o.EntraID.ClientID,
+		ClientSecret:        o.EntraID.ClientSecret,
+		CertificatePath:     o.EntraID.CertificatePath,
+		CertificatePassword: o.EntraID.CertificatePassword,
+		FederatedTokenFile:  o.EntraID.FederatedTokenFile,
+	}
+}
+
+// Masked returns a copy of c with its secrets masked, to print or log
+func (c *Config) Masked() *Config {
+	masked := *c
+	masked.Outputs = append([]NamedOutput(nil), c.Outputs...)
+	outputs := []*Output{&masked.Output}
+	for i := range masked.Outputs {
+		outputs = append(outputs, &masked.Outputs[i].Output)
+	}
+	secrets := []*string{&masked.CF.Password}
+	for _, o := range outputs {
+		secrets = append(secrets, &o.DataCollector.Key, &o.EntraID.ClientSecret, &o.EntraID.CertificatePassword)
+	}
+	for _, secret := range secrets {
+		if *secret != "" {
+			*secret = mask
+		}
+	}
+	return &masked
+}
+
+// YAML returns c in the format of the config file
+func (c *Config) YAML() string {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		// all fields can be encoded
+		panic(err)
+	}
+	return b.String()
+}
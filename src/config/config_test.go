@@ -0,0 +1,335 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/config"
+)
+
+const configFile = `
+cf:
+  api_address: https://api.example.com
+  user: admin
+  password: cf-secret
+output:
+  api: logs-ingestion
+  logs_ingestion:
+    dce_endpoint: https://dce.ingest.monitor.azure.com
+    dcr_immutable_id: dcr-123
+    streams:
+      CF_LogMessage: Custom-CFLogs_CL
+  entra_id:
+    tenant_id: tenant
+    client_id: client
+    client_secret: azure-secret
+batch:
+  time: 10s
+  max_size: 1MB
+filter:
+  excluded_types: [METRIC]
+  rules:
+    - exclude org=system
+redaction:
+  detectors: [jwt, email]
+  patterns:
+    - 'apikey=(?P<secret>\w+)'
+`
+
+var _ = Describe("Config", func() {
+	var (
+		dir   string
+		app   *kingpin.Application
+		flags *config.Flags
+	)
+
+	writeFile := func(content string) string {
+		path := filepath.Join(dir, "config.yml")
+		Expect(os.WriteFile(path, []byte(content), 0600)).To(Succeed())
+		return path
+	}
+
+	setenv := func(key string, value string) {
+		Expect(os.Setenv(key, value)).To(Succeed())
+		DeferCleanup(os.Unsetenv, key)
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		app = kingpin.New("nozzle", "")
+		flags = config.RegisterFlags(app)
+	})
+
+	It("defaults to the defaults of the flags", func() {
+		_, err := app.Parse(nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		c, err := flags.Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(Equal(config.Default()))
+		Expect(c.Batch.MaxMessages).To(Equal(1000))
+		Expect(c.MaxBatchSize().String()).To(Equal("29MiB"))
+		Expect(c.Output.PostTimeout.Duration()).To(Equal(5 * time.Second))
+	})
+
+	It("loads the config file", func() {
+		_, err := app.Parse([]string{"--config-file", writeFile(configFile)})
+		Expect(err).NotTo(HaveOccurred())
+
+		c, err := flags.Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Validate()).To(Succeed())
+		Expect(c.Output.API).To(Equal(config.LogsIngestionAPI))
+		Expect(c.Output.LogsIngestion.Streams).To(Equal(map[string]string{"CF_LogMessage": "Custom-CFLogs_CL"}))
+		Expect(c.Batch.Time.Duration()).To(Equal(10 * time.Second))
+		Expect(int(c.Batch.MaxSize)).To(Equal(1024 * 1024))
+		// settings missing from the file keep their defaults
+		Expect(c.Batch.MaxMessages).To(Equal(1000))
+		Expect(c.FilterRules()).To(Equal("exclude eventType=ValueMetric,CounterEvent,ContainerMetric,Gauge;exclude org=system"))
+		Expect(c.RedactionDetectors()).To(Equal([]string{"jwt", "email"}))
+	})
+
+	It("overrides the config file with environment variables, and those with flags", func() {
+		setenv("CONFIG_FILE", writeFile(configFile))
+		setenv("OMS_BATCH_TIME", "20s")
+		setenv("OMS_MAX_MSG_NUM_PER_BATCH", "500")
+		setenv("REDACT_PATTERNS", "a+\nb+")
+		_, err := app.Parse([]string{"--oms-batch-time", "30s", "--promoted-tags", "source_id, product", "--no-gzip-posts"})
+		Expect(err).NotTo(HaveOccurred())
+
+		c, err := flags.Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Batch.Time.Duration()).To(Equal(30 * time.Second))
+		Expect(c.Batch.MaxMessages).To(Equal(500))
+		Expect(c.Events.PromotedTags).To(Equal([]string{"source_id", "product"}))
+		Expect(c.Redaction.Patterns).To(Equal([]string{"a+", "b+"}))
+		// flags not set leave the file as it is
+		Expect(c.CF.User).To(Equal("admin"))
+		Expect(c.Batch.MaxSize.String()).To(Equal("1MiB"))
+	})
+
+	It("rejects unknown settings", func() {
+		_, err := app.Parse([]string{"--config-file", writeFile("batch:\n  max_message: 10\n")})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = flags.Load()
+		Expect(err).To(MatchError(ContainSubstring("field max_message not found")))
+	})
+
+	It("rejects invalid values of the config file", func() {
+		_, err := app.Parse([]string{"--config-file", writeFile("batch:\n  time: soon\n")})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = flags.Load()
+		Expect(err).To(MatchError(ContainSubstring("line 2")))
+	})
+
+	It("reports all invalid settings instead of defaulting them", func() {
+		c := config.Default()
+		c.Output.PostTimeout = config.Duration(2 * time.Minute)
+		c.Batch.MaxMessages = 20000
+		c.Retry.Jitter = 2
+		c.Filter.Rules = []string{"include planet=mars"}
+		c.Events.PromotedTags = []string{"not a column"}
+		c.Multiline.StartPattern = "("
+		c.Redaction.Detectors = []string{"passport"}
+		c.LogLevel = "VERBOSE"
+
+		err := c.Validate()
+		Expect(err).To(HaveOccurred())
+		for _, setting := range []string{"cf.api_address", "cf.user", "cf.password", "output.data_collector",
+			"output.post_timeout", "batch.max_messages", "retry.jitter", "filter", "events.promoted_tags",
+			"multiline.start_pattern", "redaction", "log_level"} {
+			Expect(err.Error()).To(ContainSubstring(setting))
+		}
+		Expect(err.Error()).NotTo(ContainSubstring("batch.max_size"))
+	})
+
+	It("requires the credentials of the output API", func() {
+		c := config.Default()
+		c.CF = config.CF{APIAddress: "https://api.example.com", User: "admin", Password: "secret"}
+		c.Output.API = config.LogsIngestionAPI
+		c.Output.LogsIngestion = config.LogsIngestion{DCEEndpoint: "https://dce", DCRImmutableID: "dcr-123"}
+		Expect(c.Validate()).To(MatchError(ContainSubstring("output.entra_id")))
+
+		c.Output.EntraID = config.EntraID{TenantID: "tenant", ClientID: "client", FederatedTokenFile: "/var/run/token"}
+		Expect(c.Validate()).To(Succeed())
+
+		c.Output.EntraID.ClientSecret = "secret"
+		Expect(c.Validate()).To(MatchError(ContainSubstring("output.entra_id requires exactly one of client_secret, certificate_path and federated_token_file, not 2")))
+
+		c.Output.EntraID = config.EntraID{ClientID: "client", CertificatePath: "/var/vcap/jobs/nozzle/config/entra-id.pem"}
+		Expect(c.Validate()).To(MatchError(ContainSubstring("output.entra_id.tenant_id and client_id are required")))
+	})
+
+	Describe("outputs and routes", func() {
+		const routesFile = `
+cf:
+  api_address: https://api.example.com
+  user: admin
+  password: cf-secret
+output:
+  data_collector:
+    workspace: default-workspace
+    key: default-key
+outputs:
+  - name: payments
+    drop_when_full: true
+    data_collector:
+      workspace: payments-workspace
+      key: payments-key
+  - name: platform
+    api: logs-ingestion
+    logs_ingestion:
+      dce_endpoint: https://dce.ingest.monitor.azure.com
+      dcr_immutable_id: dcr-platform
+    entra_id:
+      tenant_id: tenant
+      client_id: client
+      client_secret: platform-secret
+routes:
+  - payments org=payments
+  - platform eventType=ValueMetric,CounterEvent
+  - default org=system
+`
+
+		It("loads outputs over the defaults of the default output", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile(routesFile)})
+			Expect(err).NotTo(HaveOccurred())
+
+			c, err := flags.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Validate()).To(Succeed())
+			Expect(c.Outputs).To(HaveLen(2))
+			Expect(c.Outputs[0].Name).To(Equal("payments"))
+			Expect(c.Outputs[0].API).To(Equal(config.DataCollectorAPI))
+			Expect(c.Outputs[0].PostTimeout.Duration()).To(Equal(5 * time.Second))
+			Expect(c.Outputs[0].DropWhenFull).To(BeTrue())
+			Expect(c.Outputs[1].DropWhenFull).To(BeFalse())
+			Expect(c.Outputs[1].EntraIDConfig().ClientSecret).To(Equal("platform-secret"))
+			Expect(c.Outputs[1].EntraIDConfig().AuthorityHost).To(Equal(config.Default().Output.EntraID.AuthorityHost))
+
+			router, err := c.Router()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(router.Outputs()).To(Equal([]string{"payments", "platform", "default"}))
+		})
+
+		It("routes all events to the default output without routes", func() {
+			router, err := config.Default().Router()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(router).To(BeNil())
+		})
+
+		It("rejects unknown settings of outputs", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile("outputs:\n  - name: payments\n    workspace: id\n")})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = flags.Load()
+			Expect(err).To(MatchError(ContainSubstring("field workspace not found")))
+		})
+
+		It("reports invalid outputs and routes", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile(routesFile)})
+			Expect(err).NotTo(HaveOccurred())
+			c, err := flags.Load()
+			Expect(err).NotTo(HaveOccurred())
+			c.Outputs[0].DataCollector.Key = ""
+			c.Outputs[1].Name = "payments"
+			c.Outputs = append(c.Outputs, config.NamedOutput{Name: "audit/logs", Output: config.Default().Output})
+			c.Routes = append(c.Routes, "billing org=billing", "shipping color=red")
+
+			err = c.Validate()
+			Expect(err).To(HaveOccurred())
+			for _, message := range []string{
+				"outputs.payments.data_collector.workspace and key are required",
+				`outputs[1].name "payments" is already taken`,
+				`outputs[2].name must be made of letters, digits, _ and -, not "audit/logs"`,
+				`routes: invalid route "shipping color=red"`,
+			} {
+				Expect(err.Error()).To(ContainSubstring(message))
+			}
+
+			c.Routes = c.Routes[:len(c.Routes)-1]
+			Expect(c.Validate()).To(MatchError(ContainSubstring(`routes: output "billing" is not default or the name of one of outputs`)))
+		})
+
+		It("limits the batch size of outputs to their API", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile(routesFile)})
+			Expect(err).NotTo(HaveOccurred())
+			c, err := flags.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.MaxBatchSize().String()).To(Equal("29MiB"))
+			Expect(c.Outputs[0].MaxBatchSize(c.Batch).String()).To(Equal("29MiB"))
+			Expect(c.Outputs[1].MaxBatchSize(c.Batch).String()).To(Equal("1MiB"))
+
+			c.Batch.MaxSize = config.ByteSize(8 * 1024 * 1024)
+			err = c.Validate()
+			Expect(err).To(MatchError(ContainSubstring("batch.max_size of outputs.platform cannot exceed 1MiB with the logs-ingestion API")))
+			Expect(err.Error()).NotTo(ContainSubstring("outputs.payments"))
+
+			c.Outputs[1].BatchMaxSize = config.ByteSize(1024 * 1024)
+			Expect(c.Validate()).To(Succeed())
+			Expect(c.Outputs[0].MaxBatchSize(c.Batch).String()).To(Equal("8MiB"))
+			Expect(c.Outputs[1].MaxBatchSize(c.Batch).String()).To(Equal("1MiB"))
+
+			c.Outputs[0].BatchMaxSize = config.ByteSize(31 * 1024 * 1024)
+			Expect(c.Validate()).To(MatchError(ContainSubstring("outputs.payments.batch_max_size cannot exceed 30MiB with the data-collector API")))
+		})
+
+		It("spools outputs next to the spool of the default output", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile(routesFile)})
+			Expect(err).NotTo(HaveOccurred())
+			c, err := flags.Load()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.OutputSpool("payments").Dir).To(BeEmpty())
+
+			c.Spool.Dir = "/var/spool/nozzle/"
+			c.Spool.MaxSize = config.ByteSize(300 * 1024 * 1024)
+			Expect(c.OutputSpool("default").Dir).To(Equal("/var/spool/nozzle/"))
+			Expect(c.OutputSpool("payments").Dir).To(Equal("/var/spool/nozzle-payments"))
+			Expect(c.OutputSpool("payments").MaxSize.String()).To(Equal("100MiB"))
+			Expect(c.OutputSpool("payments").MaxAge).To(Equal(c.Spool.MaxAge))
+		})
+
+		It("masks the secrets of outputs", func() {
+			_, err := app.Parse([]string{"--config-file", writeFile(routesFile)})
+			Expect(err).NotTo(HaveOccurred())
+			c, err := flags.Load()
+			Expect(err).NotTo(HaveOccurred())
+
+			yaml := c.Masked().YAML()
+			Expect(yaml).NotTo(Or(ContainSubstring("payments-key"), ContainSubstring("platform-secret")))
+			Expect(c.Outputs[0].DataCollector.Key).To(Equal("payments-key"))
+
+			var reloaded config.Config
+			Expect(reloaded.LoadFile(writeFile(c.YAML()))).To(Succeed())
+			Expect(reloaded.YAML()).To(Equal(c.YAML()))
+		})
+	})
+
+	It("masks secrets", func() {
+		_, err := app.Parse([]string{"--config-file", writeFile(configFile)})
+		Expect(err).NotTo(HaveOccurred())
+		c, err := flags.Load()
+		Expect(err).NotTo(HaveOccurred())
+
+		yaml := c.Masked().YAML()
+		Expect(yaml).NotTo(Or(ContainSubstring("cf-secret"), ContainSubstring("azure-secret")))
+		Expect(yaml).To(ContainSubstring("client_secret: '*****'"))
+		Expect(yaml).To(ContainSubstring(`certificate_password: ""`))
+		// the config is left as it is
+		Expect(c.CF.Password).To(Equal("cf-secret"))
+
+		// the printed config can be loaded again
+		var reloaded config.Config
+		Expect(reloaded.LoadFile(writeFile(c.YAML()))).To(Succeed())
+		Expect(reloaded.YAML()).To(Equal(c.YAML()))
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/redact"
+)
+
+// Flags are the command line flags and environment variables of the settings, which override
+// the settings of the config file
+type Flags struct {
+	configFile string
+	// the settings of the flags, only copied to the config if set
+	values   Config
+	bindings []*binding
+}
+
+type binding struct {
+	clause    *kingpin.FlagClause
+	setByUser bool
+	copy      func(dst *Config)
+}
+
+// RegisterFlags registers the flags of all settings with app
+func RegisterFlags(app *kingpin.Application) *Flags {
+	f := &Flags{}
+	app.Flag("config-file", "YAML file with the settings, overridden by flags and environment variables").
+		OverrideDefaultFromEnvar("CONFIG_FILE").StringVar(&f.configFile)
+
+	bind(f, app, "api-addr", "API_ADDR", "Api URL",
+		func(c *Config) *string { return &c.CF.APIAddress }, str)
+	bind(f, app, "firehose-user", "FIREHOSE_USER", "CF user with admin and firehose access",
+		func(c *Config) *string { return &c.CF.User }, str)
+	bind(f, app, "firehose-user-password", "FIREHOSE_USER_PASSWORD", "Password of the CF user",
+		func(c *Config) *string { return &c.CF.Password }, str)
+	bind(f, app, "cf-environment", "CF_ENVIRONMENT", "CF environment name",
+		func(c *Config) *string { return &c.CF.Environment }, str)
+	bind(f, app, "skip-ssl-validation", "SKIP_SSL_VALIDATION", "Skip SSL validation",
+		func(c *Config) *bool { return &c.CF.SkipSSLValidation }, boolean)
+
+	bind(f, app, "doppler-addr", "DOPPLER_ADDR", "Traffic controller URL",
+		func(c *Config) *string { return &c.Firehose.DopplerAddress }, str)
+	bind(f, app, "use-rlp-gateway", "USE_RLP_GATEWAY", "Read Loggregator V2 envelopes from the RLP Gateway instead of the V1 firehose",
+		func(c *Config) *bool { return &c.Firehose.UseRLPGateway }, boolean)
+	bind(f, app, "rlp-gateway-addr", "RLP_GATEWAY_ADDR", "RLP Gateway URL",
+		func(c *Config) *string { return &c.Firehose.RLPGatewayAddress }, str)
+	bind(f, app, "rlp-gateway-native-v2", "RLP_GATEWAY_NATIVE_V2", "Post V2 envelopes from the RLP Gateway as Gauge, Timer and Event records instead of converting them to V1",
+		func(c *Config) *bool { return &c.Firehose.RLPGatewayNativeV2 }, boolean)
+	bind(f, app, "idle-timeout", "IDLE_TIMEOUT", "Keep Alive duration for the firehose consumer",
+		func(c *Config) *Duration { return &c.Firehose.IdleTimeout }, duration)
+
+	bind(f, app, "output-api", "OUTPUT_API", "Azure Monitor API to post events to: data-collector or logs-ingestion",
+		func(c *Config) *string { return &c.Output.API }, str)
+	bind(f, app, "oms-post-timeout", "OMS_POST_TIMEOUT", "HTTP timeout for posting events to OMS Log Analytics",
+		func(c *Config) *Duration { return &c.Output.PostTimeout }, duration)
+	bind(f, app, "gzip-posts", "GZIP_POSTS", "Compress posts with gzip, supported by the logs-ingestion API",
+		func(c *Config) *bool { return &c.Output.Gzip }, boolean)
+	bind(f, app, "azure-resource-id", "AZURE_RESOURCE_ID", "Resource Id to include as an HTTP header when posting events",
+		func(c *Config) *string { return &c.Output.AzureResourceID }, str)
+	bind(f, app, "oms-workspace", "OMS_WORKSPACE", "OMS workspace ID, required by the data-collector API",
+		func(c *Config) *string { return &c.Output.DataCollector.Workspace }, str)
+	bind(f, app, "oms-key", "OMS_KEY", "OMS workspace key, required by the data-collector API",
+		func(c *Config) *string { return &c.Output.DataCollector.Key }, str)
+	bind(f, app, "dce-endpoint", "DCE_ENDPOINT", "Logs ingestion URL of the Data Collection Endpoint",
+		func(c *Config) *string { return &c.Output.LogsIngestion.DCEEndpoint }, str)
+	bind(f, app, "dcr-id", "DCR_IMMUTABLE_ID", "Immutable ID of the Data Collection Rule",
+		func(c *Config) *string { return &c.Output.LogsIngestion.DCRImmutableID }, str)
+	bind(f, app, "dcr-stream-map", "DCR_STREAM_MAP", "Comma separated list of LOG_TYPE=STREAM, log types not listed are posted to Custom-<LOG_TYPE>_CL",
+		func(c *Config) *map[string]string { return &c.Output.LogsIngestion.Streams }, streamMap)
+	bind(f, app, "azure-tenant-id", "AZURE_TENANT_ID", "Entra ID tenant of the app registration posting to the Data Collection Rule",
+		func(c *Config) *string { return &c.Output.EntraID.TenantID }, str)
+	bind(f, app, "azure-client-id", "AZURE_CLIENT_ID", "Client ID of the app registration posting to the Data Collection Rule",
+		func(c *Config) *string { return &c.Output.EntraID.ClientID }, str)
+	bind(f, app, "azure-client-secret", "AZURE_CLIENT_SECRET", "Client secret of the app registration posting to the Data Collection Rule",
+		func(c *Config) *string { return &c.Output.EntraID.ClientSecret }, str)
+	bind(f, app, "azure-client-certificate-path", "AZURE_CLIENT_CERTIFICATE_PATH", "PEM or PFX file with the certificate and private key of the app registration",
+		func(c *Config) *string { return &c.Output.EntraID.CertificatePath }, str)
+	bind(f, app, "azure-client-certificate-password", "AZURE_CLIENT_CERTIFICATE_PASSWORD", "Password of the PFX file",
+		func(c *Config) *string { return &c.Output.EntraID.CertificatePassword }, str)
+	bind(f, app, "azure-federated-token-file", "AZURE_FEDERATED_TOKEN_FILE", "File with a federated token of the app registration",
+		func(c *Config) *string { return &c.Output.EntraID.FederatedTokenFile }, str)
+	bind(f, app, "azure-authority-host", "AZURE_AUTHORITY_HOST", "Entra ID authority host",
+		func(c *Config) *string { return &c.Output.EntraID.AuthorityHost }, str)
+
+	bind(f, app, "oms-batch-time", "OMS_BATCH_TIME", "Interval to post an OMS batch",
+		func(c *Config) *Duration { return &c.Batch.Time }, duration)
+	bind(f, app, "oms-max-msg-num-per-batch", "OMS_MAX_MSG_NUM_PER_BATCH", "Max number of messages per OMS batch",
+		func(c *Config) *int { return &c.Batch.MaxMessages }, integer)
+	bind(f, app, "oms-max-batch-size", "OMS_MAX_BATCH_SIZE", "Max size of an OMS batch, 0B for the limit of the output API",
+		func(c *Config) *ByteSize { return &c.Batch.MaxSize }, byteSize)
+
+	bind(f, app, "post-max-attempts", "POST_MAX_ATTEMPTS", "Max number of attempts to post a batch",
+		func(c *Config) *int { return &c.Retry.MaxAttempts }, integer)
+	bind(f, app, "post-retry-base-delay", "POST_RETRY_BASE_DELAY", "Delay before the first retry of a failed post, doubled with every retry",
+		func(c *Config) *Duration { return &c.Retry.BaseDelay }, duration)
+	bind(f, app, "post-retry-max-delay", "POST_RETRY_MAX_DELAY", "Max delay between retries of a failed post",
+		func(c *Config) *Duration { return &c.Retry.MaxDelay }, duration)
+	bind(f, app, "post-retry-jitter", "POST_RETRY_JITTER", "Fraction of the retry delay that is randomized, between 0 and 1",
+		func(c *Config) *float64 { return &c.Retry.Jitter }, float)
+
+	bind(f, app, "appFilter", "SPACE_WHITELIST", "Comma separated white list of orgs/spaces/apps",
+		func(c *Config) *[]string { return &c.Filter.SpaceWhitelist }, commaList)
+	bind(f, app, "envelopeFilter", "ENVELOPE_FILTER", "Comma separated list of types to exclude: METRIC, LOG, HTTP",
+		func(c *Config) *[]string { return &c.Filter.ExcludedTypes }, commaList)
+	bind(f, app, "envelope-filter-rules", "ENVELOPE_FILTER_RULES", "Include and exclude rules for envelopes, separated by semicolons, evaluated after ENVELOPE_FILTER",
+		func(c *Config) *[]string { return &c.Filter.Rules }, semicolonList)
+
+	bind(f, app, "caching-interval", "CACHING_INTERVAL", "The interval to load the apps updated since the last refresh of the app cache",
+		func(c *Config) *Duration { return &c.Caching.Interval }, duration)
+	bind(f, app, "caching-full-refresh-interval", "CACHING_FULL_REFRESH_INTERVAL", "The interval to reload all apps into the app cache",
+		func(c *Config) *Duration { return &c.Caching.FullRefreshInterval }, duration)
+	bind(f, app, "caching-negative-ttl", "CACHING_NEGATIVE_TTL", "How long apps that could not be looked up from the CC API are not looked up again, 0 to disable",
+		func(c *Config) *Duration { return &c.Caching.NegativeTTL }, duration)
+	bind(f, app, "caching-lookup-rate", "CACHING_LOOKUP_RATE", "Max lookups of apps missing from the app cache per second, 0 to disable the limit",
+		func(c *Config) *float64 { return &c.Caching.LookupRate }, float)
+	bind(f, app, "caching-lookup-burst", "CACHING_LOOKUP_BURST", "Max lookups of apps missing from the app cache in a burst",
+		func(c *Config) *int { return &c.Caching.LookupBurst }, integer)
+	bind(f, app, "caching-snapshot-file", "CACHING_SNAPSHOT_FILE", "File to save a snapshot of the app cache to after every refresh and load it from at startup. Disabled if empty",
+		func(c *Config) *string { return &c.Caching.SnapshotFile }, str)
+
+	bind(f, app, "legacy-tags", "LEGACY_TAGS", "Post the tags of envelopes in the former Go map format, e.g. map[a:b c:d], instead of a JSON object",
+		func(c *Config) *bool { return &c.Events.LegacyTags }, boolean)
+	bind(f, app, "promoted-tags", "PROMOTED_TAGS", "Comma separated keys of the tags of envelopes also posted as columns of their own",
+		func(c *Config) *[]string { return &c.Events.PromotedTags }, commaList)
+	bind(f, app, "app-metadata-keys", "APP_METADATA_KEYS", "Comma separated keys of the labels and annotations of apps, spaces and orgs to add to events, or key prefixes ending with *",
+		func(c *Config) *[]string { return &c.Events.AppMetadataKeys }, commaList)
+
+	bind(f, app, "json-log-scope", "JSON_LOG_SCOPE", "Comma separated list of orgs, spaces and apps whose JSON log lines are parsed into columns, as ORG, ORG.SPACE or ORG.SPACE.APP, or * for all apps. Disabled if empty",
+		func(c *Config) *[]string { return &c.JSONLogs.Scope }, commaList)
+	bind(f, app, "json-log-max-size", "JSON_LOG_MAX_SIZE", "Max size of JSON log lines to parse, longer lines are posted as they are",
+		func(c *Config) *ByteSize { return &c.JSONLogs.MaxSize }, byteSize)
+	bind(f, app, "json-log-max-fields", "JSON_LOG_MAX_FIELDS", "Max number of fields of JSON log lines to parse, lines with more fields are posted as they are",
+		func(c *Config) *int { return &c.JSONLogs.MaxFields }, integer)
+
+	bind(f, app, "multiline-start-pattern", "MULTILINE_START_PATTERN", "Regular expression matching the first line of app logs, the following lines that do not match it are joined into a single record. Disabled if empty",
+		func(c *Config) *string { return &c.Multiline.StartPattern }, str)
+	bind(f, app, "multiline-max-lines", "MULTILINE_MAX_LINES", "Max number of lines joined into a record",
+		func(c *Config) *int { return &c.Multiline.MaxLines }, integer)
+	bind(f, app, "multiline-max-size", "MULTILINE_MAX_SIZE", "Max size of the records lines are joined into",
+		func(c *Config) *ByteSize { return &c.Multiline.MaxSize }, byteSize)
+	bind(f, app, "multiline-max-wait", "MULTILINE_MAX_WAIT", "Time to wait for the next line of a record before posting it",
+		func(c *Config) *Duration { return &c.Multiline.MaxWait }, duration)
+
+	bind(f, app, "redact-detectors", "REDACT_DETECTORS", "Comma separated built-in detectors of the secrets and personal data to redact from log messages, URIs and errors: "+strings.Join(redact.Detectors, ", ")+", or all",
+		func(c *Config) *[]string { return &c.Redaction.Detectors }, commaList)
+	bind(f, app, "redact-pattern", "REDACT_PATTERNS", "Regular expression of other text to redact, only its group named secret if it has one. Repeatable, one per line in the environment variable",
+		func(c *Config) *[]string { return &c.Redaction.Patterns }, repeated)
+
+	bind(f, app, "spool-dir", "SPOOL_DIR", "Directory to spool batches that failed to post to. Spooling is disabled if empty",
+		func(c *Config) *string { return &c.Spool.Dir }, str)
+	bind(f, app, "spool-max-size", "SPOOL_MAX_SIZE", "Max size of the spool, shared evenly by the spools of all outputs, oldest batches are discarded beyond it",
+		func(c *Config) *ByteSize { return &c.Spool.MaxSize }, byteSize)
+	bind(f, app, "spool-max-age", "SPOOL_MAX_AGE", "Max age of spooled batches, older batches are discarded",
+		func(c *Config) *Duration { return &c.Spool.MaxAge }, duration)
+
+	bind(f, app, "metrics-addr", "METRICS_ADDR", "Address to serve Prometheus metrics on at /metrics and health checks at /healthz and /readyz, e.g. :9090. Disabled if empty",
+		func(c *Config) *string { return &c.Metrics.Address }, str)
+	bind(f, app, "health-max-envelope-age", "HEALTH_MAX_ENVELOPE_AGE", "Time without receiving an envelope after which the nozzle is unhealthy, 0 to disable",
+		func(c *Config) *Duration { return &c.Metrics.MaxEnvelopeAge }, duration)
+	bind(f, app, "health-max-post-failure-age", "HEALTH_MAX_POST_FAILURE_AGE", "Time posts keep failing after which the nozzle is unhealthy, 0 to disable",
+		func(c *Config) *Duration { return &c.Metrics.MaxPostFailureAge }, duration)
+
+	bind(f, app, "log-level", "LOG_LEVEL", "Log level: DEBUG, INFO, ERROR",
+		func(c *Config) *string { return &c.LogLevel }, str)
+	bind(f, app, "log-event-count", "LOG_EVENT_COUNT", "Whether to log the total count of received and sent events to OMS",
+		func(c *Config) *bool { return &c.LogEventCount }, boolean)
+	bind(f, app, "log-event-count-interval", "LOG_EVENT_COUNT_INTERVAL", "The interval to log the total count of received and sent events to OMS",
+		func(c *Config) *Duration { return &c.LogEventCountInterval }, duration)
+	bind(f, app, "shutdown-timeout", "SHUTDOWN_TIMEOUT", "The time to post pending events for after a termination signal",
+		func(c *Config) *Duration { return &c.ShutdownTimeout }, duration)
+	return f
+}
+
+// bind registers a flag and environment variable of the setting field
+func bind[T any](f *Flags, app *kingpin.Application, name string, envar string, help string,
+	field func(*Config) *T, value func(*T) kingpin.Value) {
+	b := &binding{clause: app.Flag(name, help).OverrideDefaultFromEnvar(envar)}
+	// the default is only shown in the help, the flag is not set unless given
+	if def := value(field(Default())).String(); def != "" {
+		b.clause.Default(def)
+	}
+	b.clause.IsSetByUser(&b.setByUser)
+	b.clause.SetValue(value(field(&f.values)))
+	b.copy = func(dst *Config) { *field(dst) = *field(&f.values) }
+	f.bindings = append(f.bindings, b)
+}
+
+// Load returns the config of the config file overridden by the flags and environment variables
+// that are set, after the app parsed them. The config is not validated.
+func (f *Flags) Load() (*Config, error) {
+	c := Default()
+	if f.configFile != "" {
+		if err := c.LoadFile(f.configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range f.bindings {
+		if b.setByUser || b.clause.HasEnvarValue() {
+			b.copy(c)
+		}
+	}
+	return c, nil
+}
+
+func str(v *string) kingpin.Value                  { return stringValue{v} }
+func boolean(v *bool) kingpin.Value                { return boolValue{v} }
+func integer(v *int) kingpin.Value                 { return intValue{v} }
+func float(v *float64) kingpin.Value               { return floatValue{v} }
+func duration(v *Duration) kingpin.Value           { return v }
+func byteSize(v *ByteSize) kingpin.Value           { return v }
+func commaList(v *[]string) kingpin.Value          { return listValue{v, ","} }
+func semicolonList(v *[]string) kingpin.Value      { return listValue{v, ";"} }
+func repeated(v *[]string) kingpin.Value           { return repeatedValue{v} }
+func streamMap(v *map[string]string) kingpin.Value { return streamMapValue{v} }
@@ -0,0 +1,171 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as in Go, e.g. 1m30s
+type Duration time.Duration
+
+// Set parses a duration
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// MarshalText writes d as a string in YAML and JSON
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalYAML reads a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if err := d.Set(value.Value); err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+	return nil
+}
+
+// ByteSize is a size in bytes, written with base 2 units, e.g. 32KB or 1GiB
+type ByteSize units.Base2Bytes
+
+// Set parses a size, in bytes if it has no unit
+func (b *ByteSize) Set(s string) error {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*b = ByteSize(n)
+		return nil
+	}
+	v, err := units.ParseBase2Bytes(s)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(v)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	return units.Base2Bytes(b).String()
+}
+
+// MarshalText writes b as a string in YAML and JSON
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalYAML reads a size
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	if err := b.Set(value.Value); err != nil {
+		return fmt.Errorf("line %d: %s", value.Line, err)
+	}
+	return nil
+}
+
+// the kingpin values of the other types of settings
+
+type stringValue struct{ v *string }
+
+func (s stringValue) Set(v string) error { *s.v = v; return nil }
+func (s stringValue) String() string     { return *s.v }
+
+type boolValue struct{ v *bool }
+
+func (b boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+	*b.v = parsed
+	return nil
+}
+func (b boolValue) String() string   { return strconv.FormatBool(*b.v) }
+func (b boolValue) IsBoolFlag() bool { return true }
+
+type intValue struct{ v *int }
+
+func (i intValue) Set(v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*i.v = parsed
+	return nil
+}
+func (i intValue) String() string { return strconv.Itoa(*i.v) }
+
+type floatValue struct{ v *float64 }
+
+func (f floatValue) Set(v string) error {
+	parsed, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*f.v = parsed
+	return nil
+}
+func (f floatValue) String() string { return strconv.FormatFloat(*f.v, 'g', -1, 64) }
+
+// listValue is a list separated by sep, with the blank items dropped
+type listValue struct {
+	v   *[]string
+	sep string
+}
+
+func (l listValue) Set(v string) error {
+	*l.v = nil
+	for _, item := range strings.Split(v, l.sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			*l.v = append(*l.v, item)
+		}
+	}
+	return nil
+}
+func (l listValue) String() string { return strings.Join(*l.v, l.sep) }
+
+// repeatedValue is a list set by repeating a flag, or with an item per line of its environment variable
+type repeatedValue struct{ v *[]string }
+
+func (r repeatedValue) Set(v string) error { *r.v = append(*r.v, v); return nil }
+func (r repeatedValue) String() string     { return strings.Join(*r.v, "\n") }
+func (r repeatedValue) IsCumulative() bool { return true }
+
+// streamMapValue is a comma separated list of LOG_TYPE=STREAM
+type streamMapValue struct{ v *map[string]string }
+
+func (s streamMapValue) Set(v string) error {
+	streams, err := client.ParseStreamMap(v)
+	*s.v = streams
+	return err
+}
+
+func (s streamMapValue) String() string {
+	var items []string
+	for logType, stream := range *s.v {
+		items = append(items, logType+"="+stream)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"strings"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+)
+
+// Event holds the fields of an envelope that rules match
+type Event struct {
+	EventType   string
+	Origin      string
+	Deployment  string
+	Job         string
+	Index       string
+	IP          string
+	Names       []string // metric names
+	SourceType  string
+	MessageType string
+	AppID       string
+	Tags        map[string]string
+
+	caching caching.CachingClient
+	appInfo *caching.AppInfo
+}
+
+// NewEvent creates the Event of a V1 envelope. App info is only looked up in c if a rule
+// matches on app, org, space or labels.
+func NewEvent(e *events.Envelope, c caching.CachingClient) *Event {
+	r := &Event{
+		EventType:  e.GetEventType().String(),
+		Origin:     e.GetOrigin(),
+		Deployment: e.GetDeployment(),
+		Job:        e.GetJob(),
+		Index:      e.GetIndex(),
+		IP:         e.GetIp(),
+		Tags:       e.GetTags(),
+		caching:    c,
+	}
+	switch e.GetEventType() {
+	case events.Envelope_ValueMetric:
+		r.Names = []string{e.GetValueMetric().GetName()}
+	case events.Envelope_CounterEvent:
+		r.Names = []string{e.GetCounterEvent().GetName()}
+	case events.Envelope_ContainerMetric:
+		r.AppID = e.GetContainerMetric().GetApplicationId()
+	case events.Envelope_LogMessage:
+		m := e.GetLogMessage()
+		r.SourceType = m.GetSourceType()
+		r.MessageType = m.GetMessageType().String()
+		r.AppID = m.GetAppId()
+	case events.Envelope_HttpStartStop:
+		if id := e.GetHttpStartStop().GetApplicationId(); id != nil {
+			r.AppID = messages.CfUUIDToString(id)
+		}
+	}
+	return r
+}
+
+// NewEventV2 creates the Event of a V2 envelope, posted with eventType. App info is only
+// looked up in c if a rule matches on app, org, space or labels.
+func NewEventV2(e *loggregator.Envelope, eventType string, c caching.CachingClient) *Event {
+	r := &Event{
+		EventType:  eventType,
+		Origin:     e.Tags["origin"],
+		Deployment: e.Tags["deployment"],
+		Job:        e.Tags["job"],
+		Index:      e.Tags["index"],
+		IP:         e.Tags["ip"],
+		SourceType: e.Tags["source_type"],
+		AppID:      e.AppID(),
+		Tags:       e.Tags,
+		caching:    c,
+	}
+	switch {
+	case e.Log != nil:
+		r.MessageType = "OUT"
+		if e.Log.Type != "" {
+			r.MessageType = e.Log.Type
+		}
+	case e.Counter != nil:
+		r.Names = []string{e.Counter.Name}
+	case e.Gauge != nil:
+		for name := range e.Gauge.Metrics {
+			r.Names = append(r.Names, name)
+		}
+	case e.Timer != nil:
+		r.Names = []string{e.Timer.Name}
+	}
+	return r
+}
+
+// values returns the values of field, which has no value if it is empty
+func (e *Event) values(field string) []string {
+	var value string
+	switch field {
+	case "eventtype":
+		value = e.EventType
+	case "origin":
+		value = e.Origin
+	case "deployment":
+		value = e.Deployment
+	case "job":
+		value = e.Job
+	case "index":
+		value = e.Index
+	case "ip":
+		value = e.IP
+	case "name":
+		return e.Names
+	case "sourcetype":
+		value = e.SourceType
+	case "messagetype":
+		value = e.MessageType
+	case "appid":
+		value = e.AppID
+	case "app":
+		value = e.app().Name
+	case "org":
+		value = e.app().Org
+	case "space":
+		value = e.app().Space
+	default:
+		if strings.HasPrefix(field, labelFieldPrefix) {
+			return lookup(e.app().Labels, strings.TrimPrefix(field, labelFieldPrefix))
+		}
+		return lookup(e.Tags, strings.TrimPrefix(field, tagFieldPrefix))
+	}
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// lookup returns the value of name in m, which has no value if it is empty. Tag and label names
+// are case sensitive, but field names are lower case by now.
+func lookup(m map[string]string, name string) []string {
+	for k, v := range m {
+		if strings.ToLower(k) == name && v != "" {
+			return []string{v}
+		}
+	}
+	return nil
+}
+
+func (e *Event) app() caching.AppInfo {
+	if e.appInfo == nil {
+		var appInfo caching.AppInfo
+		if e.AppID != "" && e.caching != nil {
+			appInfo = e.caching.GetAppInfo(e.AppID)
+		}
+		e.appInfo = &appInfo
+	}
+	return *e.appInfo
+}
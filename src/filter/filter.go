@@ -0,0 +1,258 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package filter decides which envelopes are posted to Log Analytics, following rules such as
+//
+//	exclude eventType=ValueMetric origin=garden-linux; exclude eventType=LogMessage sourceType=RTR
+//
+// Rules are separated by semicolons or new lines and evaluated in order; the first rule whose
+// conditions all match an event decides whether it is included or excluded. Events that match
+// no rule are included, so a final rule without conditions, "exclude", turns the include rules
+// before it into an allow list.
+//
+// A condition is field=values or field!=values, where values is a comma separated list of
+// values that may contain * wildcards. Fields and values are compared case insensitively.
+// See Fields for the fields that can be matched. Router picks outputs with conditions in the
+// same syntax.
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fields are the fields conditions can match, besides tag.<name> for envelope tags and
+// label.<name> for the labels of apps selected by the app metadata keys
+var Fields = []string{
+	"eventType", "origin", "deployment", "job", "index", "ip",
+	"name", "sourceType", "messageType", "appId", "app", "org", "space",
+}
+
+const (
+	tagFieldPrefix   = "tag."
+	labelFieldPrefix = "label."
+)
+
+// EventTypes are the valid values of the eventType field
+var EventTypes = []string{
+	// V1 envelopes
+	"ValueMetric", "CounterEvent", "ContainerMetric", "LogMessage", "Error", "HttpStartStop",
+	// V2 envelopes
+	"Gauge", "Timer", "Event",
+}
+
+// Filter holds parsed rules. A nil Filter includes all events.
+type Filter struct {
+	rules []rule
+}
+
+type rule struct {
+	text       string
+	include    bool
+	conditions []condition
+}
+
+type condition struct {
+	field    string // lower case
+	negated  bool
+	patterns []string // lower case
+}
+
+// Parse parses and validates rules
+func Parse(rules string) (*Filter, error) {
+	f := &Filter{}
+	for _, text := range strings.FieldsFunc(rules, func(r rune) bool { return r == ';' || r == '\n' }) {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		r, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter rule %q: %s", text, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+func parseRule(text string) (rule, error) {
+	words := strings.Fields(text)
+	r := rule{text: strings.Join(words, " ")}
+	switch strings.ToLower(words[0]) {
+	case "include":
+		r.include = true
+	case "exclude":
+	default:
+		return r, fmt.Errorf("rule must start with include or exclude")
+	}
+	for _, word := range words[1:] {
+		c, err := parseCondition(word)
+		if err != nil {
+			return r, err
+		}
+		r.conditions = append(r.conditions, c)
+	}
+	return r, nil
+}
+
+func parseCondition(text string) (condition, error) {
+	var c condition
+	i := strings.Index(text, "=")
+	if i <= 0 {
+		return c, fmt.Errorf("condition %q must be field=values or field!=values", text)
+	}
+	field, values := text[:i], text[i+1:]
+	if strings.HasSuffix(field, "!") {
+		c.negated = true
+		field = strings.TrimSuffix(field, "!")
+	}
+	c.field = strings.ToLower(field)
+	if !validField(c.field) {
+		return c, fmt.Errorf("unknown field %q, valid fields are %s, tag.<name> and label.<name>", field, strings.Join(Fields, ", "))
+	}
+	for _, value := range strings.Split(values, ",") {
+		if value == "" {
+			return c, fmt.Errorf("condition %q has an empty value", text)
+		}
+		if err := validateValue(c.field, value); err != nil {
+			return c, err
+		}
+		c.patterns = append(c.patterns, strings.ToLower(value))
+	}
+	return c, nil
+}
+
+func validField(field string) bool {
+	for _, prefix := range []string{tagFieldPrefix, labelFieldPrefix} {
+		if strings.HasPrefix(field, prefix) {
+			return len(field) > len(prefix)
+		}
+	}
+	for _, f := range Fields {
+		if strings.ToLower(f) == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validateValue rejects values that can never match, which are most likely typos
+func validateValue(field string, value string) error {
+	var valid []string
+	switch field {
+	case "eventtype":
+		valid = EventTypes
+	case "messagetype":
+		valid = []string{"OUT", "ERR"}
+	default:
+		return nil
+	}
+	for _, v := range valid {
+		if matchPattern(strings.ToLower(value), strings.ToLower(v)) {
+			return nil
+		}
+	}
+	sorted := append([]string(nil), valid...)
+	sort.Strings(sorted)
+	return fmt.Errorf("%q matches no %s, valid values are %s", value, field, strings.Join(sorted, ", "))
+}
+
+// Len returns the number of rules
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.rules)
+}
+
+// String returns the rules in their canonical form
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	texts := make([]string, len(f.rules))
+	for i, r := range f.rules {
+		texts[i] = r.text
+	}
+	return strings.Join(texts, "; ")
+}
+
+// Include reports whether e is to be posted
+func (f *Filter) Include(e *Event) bool {
+	if f == nil {
+		return true
+	}
+	for _, r := range f.rules {
+		if r.matches(e) {
+			return r.include
+		}
+	}
+	return true
+}
+
+func (r *rule) matches(e *Event) bool {
+	for _, c := range r.conditions {
+		if !c.matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *condition) matches(e *Event) bool {
+	matched := false
+	for _, value := range e.values(c.field) {
+		value = strings.ToLower(value)
+		for _, pattern := range c.patterns {
+			if matchPattern(pattern, value) {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != c.negated
+}
+
+// matchPattern matches s against pattern, in which * matches any sequence of characters
+func matchPattern(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// legacyCategories are the event categories of the former ENVELOPE_FILTER and the event types they hold
+var legacyCategories = []struct {
+	name       string
+	eventTypes string
+}{
+	{"METRIC", "ValueMetric,CounterEvent,ContainerMetric,Gauge"},
+	{"LOG", "LogMessage,Error,Event"},
+	{"HTTP", "HttpStartStop,Timer"},
+}
+
+// LegacyRules converts a list of METRIC, LOG and HTTP event categories to exclude, the former
+// format of ENVELOPE_FILTER, to rules
+func LegacyRules(categories string) string {
+	categories = strings.ToUpper(categories)
+	var rules []string
+	for _, category := range legacyCategories {
+		if strings.Contains(categories, category.name) {
+			rules = append(rules, "exclude eventType="+category.eventTypes)
+		}
+	}
+	return strings.Join(rules, "; ")
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter_test
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+func mustParse(rules string) *filter.Filter {
+	f, err := filter.Parse(rules)
+	Expect(err).NotTo(HaveOccurred())
+	return f
+}
+
+var _ = Describe("Filter", func() {
+	var (
+		cache      *mocks.MockCaching
+		lookups    int
+		valueEvent *filter.Event
+		logEvent   *filter.Event
+	)
+
+	BeforeEach(func() {
+		lookups = 0
+		cache = &mocks.MockCaching{
+			MockGetAppInfo: func(appGuid string) caching.AppInfo {
+				lookups++
+				Expect(appGuid).To(Or(Equal("app-guid"), Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8")))
+				return caching.AppInfo{Name: "my-app", Org: "my-org", Space: "dev", Labels: map[string]string{"Team": "payments"}}
+			},
+		}
+
+		eventType := events.Envelope_ValueMetric
+		origin, job, deployment, index, ip, name := "garden-linux", "diego_cell", "cf-123", "3", "10.0.0.4", "numCPUS"
+		valueEvent = filter.NewEvent(&events.Envelope{
+			EventType:   &eventType,
+			Origin:      &origin,
+			Job:         &job,
+			Deployment:  &deployment,
+			Index:       &index,
+			Ip:          &ip,
+			Tags:        map[string]string{"Zone": "z1"},
+			ValueMetric: &events.ValueMetric{Name: &name},
+		}, cache)
+
+		logEventType := events.Envelope_LogMessage
+		messageType := events.LogMessage_ERR
+		sourceType, appId := "RTR", "app-guid"
+		logEvent = filter.NewEvent(&events.Envelope{
+			EventType: &logEventType,
+			LogMessage: &events.LogMessage{
+				MessageType: &messageType,
+				SourceType:  &sourceType,
+				AppId:       &appId,
+			},
+		}, cache)
+	})
+
+	It("includes all events without rules", func() {
+		var nilFilter *filter.Filter
+		Expect(nilFilter.Include(valueEvent)).To(BeTrue())
+		Expect(mustParse("").Include(valueEvent)).To(BeTrue())
+		Expect(mustParse(" ; \n").Len()).To(BeZero())
+	})
+
+	It("matches event types", func() {
+		f := mustParse("exclude eventType=ValueMetric")
+		Expect(f.Include(valueEvent)).To(BeFalse())
+		Expect(f.Include(logEvent)).To(BeTrue())
+	})
+
+	It("matches envelope fields case insensitively", func() {
+		Expect(mustParse("exclude origin=Garden-Linux").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude job=diego_cell").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude deployment=cf-123").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude index=3").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude ip=10.0.0.4").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude origin=rep").Include(valueEvent)).To(BeTrue())
+	})
+
+	It("matches tags", func() {
+		Expect(mustParse("exclude tag.zone=z1").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude tag.zone=z2").Include(valueEvent)).To(BeTrue())
+		Expect(mustParse("exclude tag.other=z1").Include(valueEvent)).To(BeTrue())
+	})
+
+	It("matches metric names", func() {
+		Expect(mustParse("exclude name=numCPUS").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude name=memory").Include(valueEvent)).To(BeTrue())
+		Expect(mustParse("exclude name=numCPUS").Include(logEvent)).To(BeTrue())
+	})
+
+	It("matches source and message types", func() {
+		Expect(mustParse("exclude sourceType=RTR").Include(logEvent)).To(BeFalse())
+		Expect(mustParse("exclude messageType=ERR").Include(logEvent)).To(BeFalse())
+		Expect(mustParse("exclude messageType=OUT").Include(logEvent)).To(BeTrue())
+	})
+
+	It("matches apps, looking them up only when needed", func() {
+		Expect(mustParse("exclude appId=app-guid").Include(logEvent)).To(BeFalse())
+		Expect(lookups).To(BeZero())
+
+		Expect(mustParse("exclude app=my-app").Include(logEvent)).To(BeFalse())
+		Expect(mustParse("exclude org=my-org").Include(logEvent)).To(BeFalse())
+		Expect(mustParse("exclude space=prod").Include(logEvent)).To(BeTrue())
+		Expect(lookups).To(Equal(1))
+
+		Expect(mustParse("exclude org=my-org").Include(valueEvent)).To(BeTrue())
+		Expect(lookups).To(Equal(1))
+	})
+
+	It("matches the labels of apps", func() {
+		Expect(mustParse("exclude label.team=payments").Include(logEvent)).To(BeFalse())
+		Expect(mustParse("exclude label.team=billing").Include(logEvent)).To(BeTrue())
+		Expect(mustParse("exclude label.owner=payments").Include(logEvent)).To(BeTrue())
+		Expect(mustParse("exclude label.team=payments").Include(valueEvent)).To(BeTrue())
+	})
+
+	It("matches wildcards and alternatives", func() {
+		Expect(mustParse("exclude origin=garden*").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude origin=*-lin*").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude origin=*linux").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude origin=*garden").Include(valueEvent)).To(BeTrue())
+		Expect(mustParse("exclude origin=rep,garden-linux").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude sourceType=*").Include(valueEvent)).To(BeTrue())
+	})
+
+	It("negates conditions", func() {
+		Expect(mustParse("exclude origin!=garden-linux").Include(valueEvent)).To(BeTrue())
+		Expect(mustParse("exclude origin!=rep,bbs").Include(valueEvent)).To(BeFalse())
+		Expect(mustParse("exclude sourceType!=RTR").Include(valueEvent)).To(BeFalse())
+	})
+
+	It("requires all conditions of a rule to match", func() {
+		f := mustParse("exclude eventType=ValueMetric origin=rep")
+		Expect(f.Include(valueEvent)).To(BeTrue())
+		f = mustParse("exclude eventType=ValueMetric origin=garden-linux")
+		Expect(f.Include(valueEvent)).To(BeFalse())
+	})
+
+	It("applies the first matching rule", func() {
+		f := mustParse("include org=my-org\nexclude eventType=LogMessage")
+		Expect(f.Include(logEvent)).To(BeTrue())
+
+		f = mustParse("include eventType=LogMessage; exclude")
+		Expect(f.Include(logEvent)).To(BeTrue())
+		Expect(f.Include(valueEvent)).To(BeFalse())
+		Expect(f.String()).To(Equal("include eventType=LogMessage; exclude"))
+	})
+
+	It("matches V2 envelopes", func() {
+		gauge := filter.NewEventV2(&loggregator.Envelope{
+			SourceId: "rep",
+			Tags:     map[string]string{"origin": "rep", "app_id": "app-guid"},
+			Gauge: &loggregator.Gauge{Metrics: map[string]*loggregator.GaugeValue{
+				"cpu":    {Value: 1},
+				"memory": {Value: 2},
+			}},
+		}, "Gauge", cache)
+		Expect(mustParse("exclude eventType=Gauge name=memory").Include(gauge)).To(BeFalse())
+		Expect(mustParse("exclude origin=rep space=dev").Include(gauge)).To(BeFalse())
+
+		log := filter.NewEventV2(&loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     map[string]string{"source_type": "APP/PROC/WEB"},
+			Log:      &loggregator.Log{Payload: []byte("hello")},
+		}, "LogMessage", cache)
+		Expect(mustParse("exclude sourceType=APP/* messageType=OUT app=my-app").Include(log)).To(BeFalse())
+
+		platformLog := filter.NewEventV2(&loggregator.Envelope{
+			SourceId: "gorouter",
+			Tags:     map[string]string{"source_type": "RTR"},
+			Log:      &loggregator.Log{Payload: []byte("GET /")},
+		}, "LogMessage", cache)
+		Expect(mustParse("exclude org=my-org").Include(platformLog)).To(BeTrue())
+		Expect(lookups).To(Equal(2))
+	})
+
+	It("matches the apps of V2 gauges and timers by source id without an app_id tag", func() {
+		gauge := filter.NewEventV2(&loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     map[string]string{"origin": "rep"},
+			Gauge:    &loggregator.Gauge{Metrics: map[string]*loggregator.GaugeValue{"cpu": {Value: 1}}},
+		}, "Gauge", cache)
+		timer := filter.NewEventV2(&loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     map[string]string{"origin": "gorouter"},
+			Timer:    &loggregator.Timer{Name: "http", Start: 1, Stop: 3},
+		}, "Timer", cache)
+
+		f := mustParse("exclude org=my-org space=dev; exclude label.team=payments")
+		Expect(f.Include(gauge)).To(BeFalse())
+		Expect(f.Include(timer)).To(BeFalse())
+		Expect(mustParse("include app=other-app; exclude").Include(gauge)).To(BeFalse())
+		Expect(mustParse("exclude appId=6ba7b810-9dad-11d1-80b4-00c04fd430c8").Include(timer)).To(BeFalse())
+	})
+
+	DescribeTable("rejects invalid rules",
+		func(rules string, message string) {
+			_, err := filter.Parse(rules)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("unknown action", "drop origin=rep", "must start with include or exclude"),
+		Entry("missing operator", "exclude origin", "must be field=values"),
+		Entry("missing field", "exclude =rep", "must be field=values"),
+		Entry("unknown field", "exclude color=red", `unknown field "color"`),
+		Entry("empty tag name", "exclude tag.=red", `unknown field "tag."`),
+		Entry("empty label name", "exclude label.=red", `unknown field "label."`),
+		Entry("empty value", "exclude origin=rep,", "empty value"),
+		Entry("unknown event type", "exclude eventType=ValueMetrics", `"ValueMetrics" matches no eventtype`),
+		Entry("unknown message type", "exclude messageType=STDOUT", `"STDOUT" matches no messagetype`),
+	)
+
+	It("converts the former category list", func() {
+		Expect(filter.LegacyRules("")).To(BeEmpty())
+		rules := filter.LegacyRules("metric,http")
+		Expect(rules).To(Equal("exclude eventType=ValueMetric,CounterEvent,ContainerMetric,Gauge; exclude eventType=HttpStartStop,Timer"))
+		f := mustParse(rules)
+		Expect(f.Include(valueEvent)).To(BeFalse())
+		Expect(f.Include(logEvent)).To(BeTrue())
+		Expect(mustParse(filter.LegacyRules("LOG")).Include(logEvent)).To(BeFalse())
+	})
+})
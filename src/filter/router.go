@@ -0,0 +1,109 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Router picks the output events are posted to, following routes such as
+//
+//	payments org=payments; platform eventType=ValueMetric,CounterEvent,Gauge
+//
+// A route is the name of an output followed by conditions in the syntax of filter rules. Routes
+// are separated by semicolons or new lines and evaluated in order; the first route whose
+// conditions all match an event picks its output. A route without conditions matches all events.
+// A nil Router routes no event.
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	text       string
+	output     string
+	conditions []condition
+}
+
+// ParseRoutes parses and validates routes
+func ParseRoutes(routes string) (*Router, error) {
+	r := &Router{}
+	for _, text := range strings.FieldsFunc(routes, func(r rune) bool { return r == ';' || r == '\n' }) {
+		words := strings.Fields(text)
+		if len(words) == 0 {
+			continue
+		}
+		rt := route{text: strings.Join(words, " "), output: words[0]}
+		if strings.Contains(rt.output, "=") {
+			return nil, fmt.Errorf("invalid route %q: route must start with the name of an output", rt.text)
+		}
+		for _, word := range words[1:] {
+			c, err := parseCondition(word)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route %q: %s", rt.text, err)
+			}
+			rt.conditions = append(rt.conditions, c)
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// Len returns the number of routes
+func (r *Router) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.routes)
+}
+
+// String returns the routes in their canonical form
+func (r *Router) String() string {
+	if r == nil {
+		return ""
+	}
+	texts := make([]string, len(r.routes))
+	for i, rt := range r.routes {
+		texts[i] = rt.text
+	}
+	return strings.Join(texts, "; ")
+}
+
+// Outputs returns the outputs routes pick, in the order of the routes
+func (r *Router) Outputs() []string {
+	if r == nil {
+		return nil
+	}
+	var outputs []string
+	seen := make(map[string]bool)
+	for _, rt := range r.routes {
+		if !seen[rt.output] {
+			seen[rt.output] = true
+			outputs = append(outputs, rt.output)
+		}
+	}
+	return outputs
+}
+
+// Route returns the output of e, empty if no route matches it
+func (r *Router) Route(e *Event) string {
+	if r == nil {
+		return ""
+	}
+	for _, rt := range r.routes {
+		if rt.matches(e) {
+			return rt.output
+		}
+	}
+	return ""
+}
+
+func (rt *route) matches(e *Event) bool {
+	for _, c := range rt.conditions {
+		if !c.matches(e) {
+			return false
+		}
+	}
+	return true
+}
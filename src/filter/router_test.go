@@ -0,0 +1,102 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package filter_test
+
+import (
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+func mustParseRoutes(routes string) *filter.Router {
+	r, err := filter.ParseRoutes(routes)
+	Expect(err).NotTo(HaveOccurred())
+	return r
+}
+
+var _ = Describe("Router", func() {
+	var (
+		cache       *mocks.MockCaching
+		metricEvent *filter.Event
+		logEvent    *filter.Event
+	)
+
+	BeforeEach(func() {
+		cache = &mocks.MockCaching{
+			MockGetAppInfo: func(appGuid string) caching.AppInfo {
+				return caching.AppInfo{Name: "checkout", Org: "payments", Space: "prod", Labels: map[string]string{"tier": "gold"}}
+			},
+		}
+
+		eventType := events.Envelope_CounterEvent
+		origin, name := "gorouter", "requests"
+		metricEvent = filter.NewEvent(&events.Envelope{
+			EventType:    &eventType,
+			Origin:       &origin,
+			CounterEvent: &events.CounterEvent{Name: &name},
+		}, cache)
+
+		logEventType := events.Envelope_LogMessage
+		logOrigin, messageType, appID, sourceType := "rep", events.LogMessage_OUT, "app-guid", "APP/PROC/WEB"
+		logEvent = filter.NewEvent(&events.Envelope{
+			EventType: &logEventType,
+			Origin:    &logOrigin,
+			LogMessage: &events.LogMessage{
+				MessageType: &messageType,
+				SourceType:  &sourceType,
+				AppId:       &appID,
+			},
+		}, cache)
+	})
+
+	It("routes no event without routes", func() {
+		var nilRouter *filter.Router
+		Expect(nilRouter.Route(logEvent)).To(BeEmpty())
+		Expect(nilRouter.Outputs()).To(BeEmpty())
+		Expect(mustParseRoutes(" ; \n").Len()).To(BeZero())
+		Expect(mustParseRoutes("").Route(logEvent)).To(BeEmpty())
+	})
+
+	It("picks the output of the first matching route", func() {
+		r := mustParseRoutes("audit eventType=LogMessage org=payments sourceType=RTR\npayments org=payments; platform eventType=CounterEvent,Gauge")
+		Expect(r.Route(logEvent)).To(Equal("payments"))
+		Expect(r.Route(metricEvent)).To(Equal("platform"))
+		Expect(r.Len()).To(Equal(3))
+		Expect(r.String()).To(Equal("audit eventType=LogMessage org=payments sourceType=RTR; payments org=payments; platform eventType=CounterEvent,Gauge"))
+	})
+
+	It("routes events matching no route to no output", func() {
+		r := mustParseRoutes("payments org=payments")
+		Expect(r.Route(metricEvent)).To(BeEmpty())
+	})
+
+	It("matches all events with a route without conditions", func() {
+		r := mustParseRoutes("gold label.tier=gold; other")
+		Expect(r.Route(logEvent)).To(Equal("gold"))
+		Expect(r.Route(metricEvent)).To(Equal("other"))
+	})
+
+	It("matches the fields of log records", func() {
+		r := mustParseRoutes("web sourceType=APP/PROC/* messageType=OUT origin=rep app=checkout space=prod")
+		Expect(r.Route(logEvent)).To(Equal("web"))
+	})
+
+	It("returns the outputs of the routes", func() {
+		r := mustParseRoutes("payments org=payments; platform eventType=CounterEvent; payments space=payments")
+		Expect(r.Outputs()).To(Equal([]string{"payments", "platform"}))
+	})
+
+	DescribeTable("rejects invalid routes",
+		func(routes string, message string) {
+			_, err := filter.ParseRoutes(routes)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		},
+		Entry("missing output", "org=payments", "must start with the name of an output"),
+		Entry("unknown field", "payments color=red", `unknown field "color"`),
+		Entry("unknown event type", "platform eventType=Gauges", `"Gauges" matches no eventtype`),
+	)
+})
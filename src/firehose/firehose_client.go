@@ -12,6 +12,7 @@ import (
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/cloudfoundry/noaa/v2/consumer"
 	events "github.com/cloudfoundry/sonde-go/events"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
 )
 
 type Client interface {
@@ -19,6 +20,12 @@ type Client interface {
 	CloseConsumer() error
 }
 
+// V2Client is implemented by clients that can stream native Loggregator V2 envelopes
+type V2Client interface {
+	Client
+	ConnectV2() (<-chan *loggregator.Envelope, <-chan error)
+}
+
 type client struct {
 	cfClientConfig *cfclient.Config
 	firehoseConfig *FirehoseConfig
@@ -0,0 +1,252 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package firehose
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/cloudfoundry-community/go-cfclient"
+	events "github.com/cloudfoundry/sonde-go/events"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+)
+
+// envelope types requested from the RLP Gateway. Events have no V1 equivalent
+// and are only requested for V2 streams.
+var (
+	rlpGatewayV1Selectors = []string{"log", "counter", "gauge", "timer"}
+	rlpGatewayV2Selectors = []string{"log", "counter", "gauge", "timer", "event"}
+)
+
+const (
+	// delay before reporting a failed stream, so the nozzle doesn't reconnect in a tight loop
+	rlpGatewayReconnectDelay = time.Second
+)
+
+// TokenRefresher provides the UAA token used to authenticate against the RLP Gateway
+type TokenRefresher interface {
+	RefreshAuthToken() (string, error)
+}
+
+type RlpGatewayConfig struct {
+	ShardId           string
+	GatewayUrl        string
+	IdleTimeout       time.Duration
+	SkipSslValidation bool
+}
+
+// envelopeHandler passes an envelope read from the gateway on to the consumer
+type envelopeHandler func(context.Context, *loggregator.Envelope) error
+
+type rlpGatewayClient struct {
+	tokenRefresher TokenRefresher
+	config         *RlpGatewayConfig
+	logger         lager.Logger
+	httpClient     *http.Client
+	cancel         context.CancelFunc
+	mutex          sync.Mutex
+}
+
+// NewCfClientTokenRefresh logs in to CF and returns a TokenRefresher backed by the resulting client
+func NewCfClientTokenRefresh(cfClientConfig *cfclient.Config) (*CfClientTokenRefresh, error) {
+	cfClient, err := cfclient.NewClient(cfClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &CfClientTokenRefresh{cfClient: cfClient}, nil
+}
+
+// NewRlpGatewayClient creates a Client reading Loggregator V2 envelopes from the RLP Gateway.
+// Connect converts envelopes to their V1 equivalents so the nozzle can process them unchanged,
+// ConnectV2 passes them on as they are.
+func NewRlpGatewayClient(tokenRefresher TokenRefresher, config *RlpGatewayConfig, logger lager.Logger) V2Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig(config.SkipSslValidation)
+	return &rlpGatewayClient{
+		tokenRefresher: tokenRefresher,
+		config:         config,
+		logger:         logger,
+		httpClient:     &http.Client{Transport: transport},
+	}
+}
+
+func (c *rlpGatewayClient) Connect() (<-chan *events.Envelope, <-chan error) {
+	msgChan := make(chan *events.Envelope, 100)
+	errChan := c.connect(rlpGatewayV1Selectors, func(ctx context.Context, e *loggregator.Envelope) error {
+		for _, v1 := range loggregator.ToV1(e) {
+			select {
+			case msgChan <- v1:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	return msgChan, errChan
+}
+
+func (c *rlpGatewayClient) ConnectV2() (<-chan *loggregator.Envelope, <-chan error) {
+	msgChan := make(chan *loggregator.Envelope, 100)
+	errChan := c.connect(rlpGatewayV2Selectors, func(ctx context.Context, e *loggregator.Envelope) error {
+		select {
+		case msgChan <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+	return msgChan, errChan
+}
+
+func (c *rlpGatewayClient) connect(selectors []string, handle envelopeHandler) <-chan error {
+	c.logger.Info("connect", lager.Data{"rlpGatewayAddress": c.config.GatewayUrl})
+	errChan := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mutex.Lock()
+	c.cancel = cancel
+	c.mutex.Unlock()
+
+	go func() {
+		err := c.stream(ctx, selectors, handle)
+		if ctx.Err() != nil {
+			// closed by CloseConsumer
+			return
+		}
+		select {
+		case <-time.After(rlpGatewayReconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+		errChan <- err
+	}()
+	return errChan
+}
+
+func (c *rlpGatewayClient) CloseConsumer() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	return nil
+}
+
+// stream reads server-sent events until the connection fails, the gateway
+// closes the stream or the context is cancelled. It always returns a non-nil error.
+func (c *rlpGatewayClient) stream(ctx context.Context, selectors []string, handle envelopeHandler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	token, err := c.tokenRefresher.RefreshAuthToken()
+	if err != nil {
+		return fmt.Errorf("error getting auth token: %w", err)
+	}
+	query := url.Values{"shard_id": {c.config.ShardId}}
+	for _, selector := range selectors {
+		query.Set(selector, "")
+	}
+	address := strings.TrimSuffix(c.config.GatewayUrl, "/") + "/v2/read?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("RLP Gateway error. HTTP response code:%d message:%s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	// the gateway sends heartbeats, so a stream without any data is considered dead
+	var idle atomic.Bool
+	var idleTimer *time.Timer
+	if c.config.IdleTimeout > 0 {
+		idleTimer = time.AfterFunc(c.config.IdleTimeout, func() {
+			idle.Store(true)
+			cancel()
+		})
+		defer idleTimer.Stop()
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	var eventType string
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if idle.Load() {
+				return fmt.Errorf("no data received from RLP Gateway for %s", c.config.IdleTimeout)
+			}
+			return err
+		}
+		if idleTimer != nil {
+			idleTimer.Reset(c.config.IdleTimeout)
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			field, value, _ := bytes.Cut(line, []byte(":"))
+			value = bytes.TrimPrefix(value, []byte(" "))
+			switch string(field) {
+			case "event":
+				eventType = string(value)
+			case "data":
+				if data.Len() > 0 {
+					data.WriteByte('\n')
+				}
+				data.Write(value)
+			}
+			continue
+		}
+
+		// a blank line dispatches the event
+		switch eventType {
+		case "heartbeat":
+		case "closing":
+			return errors.New("RLP Gateway closed the stream")
+		default:
+			if data.Len() > 0 {
+				if err := c.dispatch(ctx, data.Bytes(), handle); err != nil {
+					return err
+				}
+			}
+		}
+		eventType = ""
+		data.Reset()
+	}
+}
+
+func (c *rlpGatewayClient) dispatch(ctx context.Context, data []byte, handle envelopeHandler) error {
+	var batch loggregator.EnvelopeBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		c.logger.Error("error unmarshalling envelope batch", err)
+		return nil
+	}
+	for _, e := range batch.Batch {
+		if err := handle(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
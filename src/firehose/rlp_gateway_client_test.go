@@ -0,0 +1,216 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package firehose_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/firehose"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+type fakeTokenRefresher struct {
+	token string
+}
+
+func (f *fakeTokenRefresher) RefreshAuthToken() (string, error) {
+	return f.token, nil
+}
+
+// sseServer is a local stand-in for the RLP Gateway /v2/read endpoint
+type sseServer struct {
+	server     *httptest.Server
+	events     chan string
+	statusCode int
+	mutex      sync.Mutex
+	requests   []*http.Request
+}
+
+func newSSEServer() *sseServer {
+	s := &sseServer{
+		events:     make(chan string, 10),
+		statusCode: http.StatusOK,
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests = append(s.requests, r)
+		statusCode := s.statusCode
+		s.mutex.Unlock()
+
+		if statusCode != http.StatusOK {
+			w.WriteHeader(statusCode)
+			fmt.Fprint(w, "unauthorized")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case e := <-s.events:
+				fmt.Fprint(w, e)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	return s
+}
+
+func (s *sseServer) setStatusCode(statusCode int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statusCode = statusCode
+}
+
+func (s *sseServer) getRequests() []*http.Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+var _ = Describe("RlpGatewayClient", func() {
+	var (
+		server *sseServer
+		client firehose.V2Client
+	)
+
+	BeforeEach(func() {
+		server = newSSEServer()
+		client = firehose.NewRlpGatewayClient(&fakeTokenRefresher{token: "bearer some-token"}, &firehose.RlpGatewayConfig{
+			ShardId:     "oms-nozzle",
+			GatewayUrl:  server.server.URL,
+			IdleTimeout: time.Minute,
+		}, mocks.NewMockLogger())
+	})
+
+	AfterEach(func() {
+		client.CloseConsumer() //nolint:errcheck
+		server.server.Close()
+	})
+
+	It("requests all envelope types with the shard id and auth token", func() {
+		client.Connect()
+
+		Eventually(server.getRequests).Should(HaveLen(1))
+		r := server.getRequests()[0]
+		Expect(r.URL.Path).To(Equal("/v2/read"))
+		Expect(r.URL.Query()).To(Equal(url.Values{
+			"shard_id": {"oms-nozzle"},
+			"log":      {""},
+			"counter":  {""},
+			"gauge":    {""},
+			"timer":    {""},
+		}))
+		Expect(r.Header.Get("Authorization")).To(Equal("bearer some-token"))
+	})
+
+	It("escapes the shard id", func() {
+		client.CloseConsumer() //nolint:errcheck
+		client = firehose.NewRlpGatewayClient(&fakeTokenRefresher{token: "bearer some-token"}, &firehose.RlpGatewayConfig{
+			ShardId:     "oms nozzle&log=x",
+			GatewayUrl:  server.server.URL,
+			IdleTimeout: time.Minute,
+		}, mocks.NewMockLogger())
+		client.Connect()
+
+		Eventually(server.getRequests).Should(HaveLen(1))
+		query := server.getRequests()[0].URL.Query()
+		Expect(query["shard_id"]).To(Equal([]string{"oms nozzle&log=x"}))
+		Expect(query["log"]).To(Equal([]string{""}))
+	})
+
+	It("converts a batch of V2 envelopes into V1 envelopes", func() {
+		msgChan, _ := client.Connect()
+
+		server.events <- "event: heartbeat\ndata: 1580428783\n\n"
+		server.events <- `data: {"batch":[` +
+			`{"timestamp":"1580428783743933019","sourceId":"app-guid","instanceId":"1","tags":{"origin":"rep","job":"diego-cell","source_type":"APP/PROC/WEB"},"log":{"payload":"aGVsbG8=","type":"ERR"}},` +
+			`{"timestamp":"1580428783743933020","sourceId":"doppler","tags":{"origin":"loggregator.doppler"},"counter":{"name":"dropped","delta":"2","total":"10"}}` +
+			"]}\n\n"
+
+		var log *events.Envelope
+		Eventually(msgChan).Should(Receive(&log))
+		Expect(log.GetEventType()).To(Equal(events.Envelope_LogMessage))
+		Expect(log.GetTimestamp()).To(Equal(int64(1580428783743933019)))
+		Expect(log.GetOrigin()).To(Equal("rep"))
+		Expect(log.GetJob()).To(Equal("diego-cell"))
+		Expect(log.GetTags()).To(Equal(map[string]string{"source_type": "APP/PROC/WEB"}))
+		Expect(string(log.GetLogMessage().GetMessage())).To(Equal("hello"))
+		Expect(log.GetLogMessage().GetMessageType()).To(Equal(events.LogMessage_ERR))
+		Expect(log.GetLogMessage().GetAppId()).To(Equal("app-guid"))
+		Expect(log.GetLogMessage().GetSourceType()).To(Equal("APP/PROC/WEB"))
+		Expect(log.GetLogMessage().GetSourceInstance()).To(Equal("1"))
+
+		var counter *events.Envelope
+		Eventually(msgChan).Should(Receive(&counter))
+		Expect(counter.GetEventType()).To(Equal(events.Envelope_CounterEvent))
+		Expect(counter.GetCounterEvent().GetName()).To(Equal("dropped"))
+		Expect(counter.GetCounterEvent().GetDelta()).To(Equal(uint64(2)))
+		Expect(counter.GetCounterEvent().GetTotal()).To(Equal(uint64(10)))
+	})
+
+	It("streams V2 envelopes including events without conversion", func() {
+		msgChan, _ := client.ConnectV2()
+
+		server.events <- `data: {"batch":[` +
+			`{"timestamp":"1","sourceId":"rep","gauge":{"metrics":{"a":{"unit":"ms","value":1},"b":{"unit":"ms","value":2}}}},` +
+			`{"timestamp":"2","sourceId":"bosh","event":{"title":"deployed","body":"cf"}}` +
+			"]}\n\n"
+
+		var gauge *loggregator.Envelope
+		Eventually(msgChan).Should(Receive(&gauge))
+		Expect(gauge.Gauge.Metrics).To(HaveLen(2))
+
+		var event *loggregator.Envelope
+		Eventually(msgChan).Should(Receive(&event))
+		Expect(event.Event).To(Equal(&loggregator.Event{Title: "deployed", Body: "cf"}))
+
+		Eventually(server.getRequests).Should(HaveLen(1))
+		Expect(server.getRequests()[0].URL.Query()).To(HaveKey("event"))
+	})
+
+	It("reports an error when the gateway closes the stream", func() {
+		_, errChan := client.Connect()
+
+		server.events <- "event: closing\ndata: closing due to server shutdown\n\n"
+
+		Eventually(errChan, 5*time.Second).Should(Receive(MatchError("RLP Gateway closed the stream")))
+	})
+
+	It("reports an error when the gateway rejects the request", func() {
+		server.setStatusCode(http.StatusUnauthorized)
+		_, errChan := client.Connect()
+
+		Eventually(errChan, 5*time.Second).Should(Receive(MatchError("RLP Gateway error. HTTP response code:401 message:unauthorized")))
+	})
+
+	It("reports an error when the stream is idle", func() {
+		client = firehose.NewRlpGatewayClient(&fakeTokenRefresher{}, &firehose.RlpGatewayConfig{
+			GatewayUrl:  server.server.URL,
+			IdleTimeout: 50 * time.Millisecond,
+		}, mocks.NewMockLogger())
+		_, errChan := client.Connect()
+
+		Eventually(errChan, 5*time.Second).Should(Receive(MatchError(ContainSubstring("no data received from RLP Gateway"))))
+	})
+
+	It("stops streaming when the consumer is closed", func() {
+		_, errChan := client.Connect()
+		Eventually(server.getRequests).Should(HaveLen(1))
+
+		Expect(client.CloseConsumer()).To(Succeed())
+		Consistently(errChan, 1500*time.Millisecond).ShouldNot(Receive())
+	})
+})
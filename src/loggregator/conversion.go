@@ -0,0 +1,205 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package loggregator
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	events "github.com/cloudfoundry/sonde-go/events"
+)
+
+// tags that are promoted to fields of the V1 envelope rather than kept as tags
+var v1EnvelopeTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+// the gauge metrics that together make up a V1 ContainerMetric
+var containerMetricNames = []string{"cpu", "memory", "disk", "memory_quota", "disk_quota"}
+
+// ToV1 converts a V2 envelope into the V1 envelopes understood by the nozzle.
+// A Gauge may expand into several ValueMetrics; an Event has no V1 equivalent
+// and yields no envelopes.
+func ToV1(e *Envelope) []*events.Envelope {
+	switch {
+	case e.Log != nil:
+		return []*events.Envelope{convertLog(e)}
+	case e.Counter != nil:
+		return []*events.Envelope{convertCounter(e)}
+	case e.Gauge != nil:
+		return convertGauge(e)
+	case e.Timer != nil:
+		return []*events.Envelope{convertTimer(e)}
+	}
+	return nil
+}
+
+func newV1Envelope(e *Envelope, eventType events.Envelope_EventType) *events.Envelope {
+	timestamp := int64(e.Timestamp)
+	v1 := &events.Envelope{
+		EventType:  &eventType,
+		Timestamp:  &timestamp,
+		Origin:     stringPtr(e.Tags["origin"]),
+		Deployment: stringPtr(e.Tags["deployment"]),
+		Job:        stringPtr(e.Tags["job"]),
+		Index:      stringPtr(e.Tags["index"]),
+		Ip:         stringPtr(e.Tags["ip"]),
+	}
+	for k, v := range e.Tags {
+		if v1EnvelopeTags[k] {
+			continue
+		}
+		if v1.Tags == nil {
+			v1.Tags = make(map[string]string)
+		}
+		v1.Tags[k] = v
+	}
+	return v1
+}
+
+func convertLog(e *Envelope) *events.Envelope {
+	v1 := newV1Envelope(e, events.Envelope_LogMessage)
+	messageType := events.LogMessage_OUT
+	if strings.EqualFold(e.Log.Type, "ERR") {
+		messageType = events.LogMessage_ERR
+	}
+	v1.LogMessage = &events.LogMessage{
+		Message:        e.Log.Payload,
+		MessageType:    &messageType,
+		Timestamp:      v1.Timestamp,
+		AppId:          stringPtr(e.SourceId),
+		SourceType:     stringPtr(e.Tags["source_type"]),
+		SourceInstance: stringPtr(e.InstanceId),
+	}
+	return v1
+}
+
+func convertCounter(e *Envelope) *events.Envelope {
+	v1 := newV1Envelope(e, events.Envelope_CounterEvent)
+	delta := uint64(e.Counter.Delta)
+	total := uint64(e.Counter.Total)
+	v1.CounterEvent = &events.CounterEvent{
+		Name:  stringPtr(e.Counter.Name),
+		Delta: &delta,
+		Total: &total,
+	}
+	return v1
+}
+
+func convertGauge(e *Envelope) []*events.Envelope {
+	if isContainerMetric(e.Gauge) {
+		v1 := newV1Envelope(e, events.Envelope_ContainerMetric)
+		instanceIndex := int32(atoi(e.InstanceId))
+		cpu := e.Gauge.Metrics["cpu"].Value
+		memory := uint64(e.Gauge.Metrics["memory"].Value)
+		disk := uint64(e.Gauge.Metrics["disk"].Value)
+		memoryQuota := uint64(e.Gauge.Metrics["memory_quota"].Value)
+		diskQuota := uint64(e.Gauge.Metrics["disk_quota"].Value)
+		v1.ContainerMetric = &events.ContainerMetric{
+			ApplicationId:    stringPtr(e.SourceId),
+			InstanceIndex:    &instanceIndex,
+			CpuPercentage:    &cpu,
+			MemoryBytes:      &memory,
+			DiskBytes:        &disk,
+			MemoryBytesQuota: &memoryQuota,
+			DiskBytesQuota:   &diskQuota,
+		}
+		return []*events.Envelope{v1}
+	}
+
+	var envelopes []*events.Envelope
+	for name, metric := range e.Gauge.Metrics {
+		if metric == nil {
+			continue
+		}
+		v1 := newV1Envelope(e, events.Envelope_ValueMetric)
+		value := metric.Value
+		v1.ValueMetric = &events.ValueMetric{
+			Name:  stringPtr(name),
+			Value: &value,
+			Unit:  stringPtr(metric.Unit),
+		}
+		envelopes = append(envelopes, v1)
+	}
+	return envelopes
+}
+
+func isContainerMetric(g *Gauge) bool {
+	if len(g.Metrics) != len(containerMetricNames) {
+		return false
+	}
+	for _, name := range containerMetricNames {
+		if g.Metrics[name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func convertTimer(e *Envelope) *events.Envelope {
+	v1 := newV1Envelope(e, events.Envelope_HttpStartStop)
+	start := int64(e.Timer.Start)
+	stop := int64(e.Timer.Stop)
+	peerType := events.PeerType_Client
+	if strings.EqualFold(e.Tags["peer_type"], "server") {
+		peerType = events.PeerType_Server
+	}
+	method := events.Method_GET
+	if m, ok := events.Method_value[strings.ToUpper(e.Tags["method"])]; ok {
+		method = events.Method(m)
+	}
+	statusCode := int32(atoi(e.Tags["status_code"]))
+	contentLength := int64(atoi(e.Tags["content_length"]))
+	instanceIndex := int32(atoi(e.InstanceId))
+	v1.HttpStartStop = &events.HttpStartStop{
+		StartTimestamp: &start,
+		StopTimestamp:  &stop,
+		RequestId:      StringToUUID(e.Tags["request_id"]),
+		PeerType:       &peerType,
+		Method:         &method,
+		Uri:            stringPtr(e.Tags["uri"]),
+		RemoteAddress:  stringPtr(e.Tags["remote_address"]),
+		UserAgent:      stringPtr(e.Tags["user_agent"]),
+		StatusCode:     &statusCode,
+		ContentLength:  &contentLength,
+		ApplicationId:  StringToUUID(e.SourceId),
+		InstanceIndex:  &instanceIndex,
+		InstanceId:     stringPtr(e.Tags["instance_id"]),
+	}
+	if forwarded := e.Tags["forwarded"]; forwarded != "" {
+		v1.HttpStartStop.Forwarded = strings.Split(forwarded, "\n")
+	}
+	return v1
+}
+
+// StringToUUID parses a GUID string into the V1 UUID representation, the
+// inverse of the formatting used for V1 UUIDs in the messages package.
+// It returns nil if s is not a GUID.
+func StringToUUID(s string) *events.UUID {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil
+	}
+	low := binary.LittleEndian.Uint64(b[0:8])
+	high := binary.LittleEndian.Uint64(b[8:16])
+	return &events.UUID{Low: &low, High: &high}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func atoi(s string) int64 {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return i
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package loggregator_test
+
+import (
+	"encoding/json"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+)
+
+var _ = Describe("Conversion", func() {
+	decode := func(s string) *loggregator.Envelope {
+		GinkgoHelper()
+		var e loggregator.Envelope
+		Expect(json.Unmarshal([]byte(s), &e)).To(Succeed())
+		return &e
+	}
+
+	It("converts an app Gauge into a ContainerMetric", func() {
+		e := decode(`{"timestamp":"5","sourceId":"app-guid","instanceId":"2","gauge":{"metrics":{` +
+			`"cpu":{"unit":"percentage","value":1.5},"memory":{"unit":"bytes","value":1024},"disk":{"unit":"bytes","value":2048},` +
+			`"memory_quota":{"unit":"bytes","value":4096},"disk_quota":{"unit":"bytes","value":8192}}}}`)
+
+		v1 := loggregator.ToV1(e)
+
+		Expect(v1).To(HaveLen(1))
+		Expect(v1[0].GetEventType()).To(Equal(events.Envelope_ContainerMetric))
+		m := v1[0].GetContainerMetric()
+		Expect(m.GetApplicationId()).To(Equal("app-guid"))
+		Expect(m.GetInstanceIndex()).To(Equal(int32(2)))
+		Expect(m.GetCpuPercentage()).To(Equal(1.5))
+		Expect(m.GetMemoryBytes()).To(Equal(uint64(1024)))
+		Expect(m.GetDiskBytes()).To(Equal(uint64(2048)))
+		Expect(m.GetMemoryBytesQuota()).To(Equal(uint64(4096)))
+		Expect(m.GetDiskBytesQuota()).To(Equal(uint64(8192)))
+	})
+
+	It("converts other Gauges into one ValueMetric per metric", func() {
+		e := decode(`{"timestamp":"5","sourceId":"gorouter","tags":{"origin":"gorouter","deployment":"cf"},"gauge":{"metrics":{` +
+			`"latency":{"unit":"ms","value":12},"uptime":{"unit":"seconds","value":300}}}}`)
+
+		v1 := loggregator.ToV1(e)
+
+		Expect(v1).To(HaveLen(2))
+		values := map[string]float64{}
+		for _, envelope := range v1 {
+			Expect(envelope.GetEventType()).To(Equal(events.Envelope_ValueMetric))
+			Expect(envelope.GetOrigin()).To(Equal("gorouter"))
+			Expect(envelope.GetDeployment()).To(Equal("cf"))
+			values[envelope.GetValueMetric().GetName()] = envelope.GetValueMetric().GetValue()
+		}
+		Expect(values).To(Equal(map[string]float64{"latency": 12, "uptime": 300}))
+	})
+
+	It("converts a Timer into an HttpStartStop", func() {
+		e := decode(`{"timestamp":"5","sourceId":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","instanceId":"1","tags":{` +
+			`"peer_type":"Server","method":"POST","uri":"https://app.example.com/","status_code":"201","content_length":"42",` +
+			`"request_id":"6ba7b811-9dad-11d1-80b4-00c04fd430c8","instance_id":"instance-guid","forwarded":"10.0.0.1\n10.0.0.2"},` +
+			`"timer":{"name":"http","start":"100","stop":"200"}}`)
+
+		v1 := loggregator.ToV1(e)
+
+		Expect(v1).To(HaveLen(1))
+		Expect(v1[0].GetEventType()).To(Equal(events.Envelope_HttpStartStop))
+		h := v1[0].GetHttpStartStop()
+		Expect(h.GetStartTimestamp()).To(Equal(int64(100)))
+		Expect(h.GetStopTimestamp()).To(Equal(int64(200)))
+		Expect(h.GetPeerType()).To(Equal(events.PeerType_Server))
+		Expect(h.GetMethod()).To(Equal(events.Method_POST))
+		Expect(h.GetUri()).To(Equal("https://app.example.com/"))
+		Expect(h.GetStatusCode()).To(Equal(int32(201)))
+		Expect(h.GetContentLength()).To(Equal(int64(42)))
+		Expect(h.GetApplicationId()).To(Equal(loggregator.StringToUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")))
+		Expect(h.GetRequestId()).NotTo(BeNil())
+		Expect(h.GetInstanceIndex()).To(Equal(int32(1)))
+		Expect(h.GetInstanceId()).To(Equal("instance-guid"))
+		Expect(h.GetForwarded()).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+	})
+
+	It("drops Events which have no V1 equivalent", func() {
+		e := decode(`{"timestamp":"5","sourceId":"bosh","event":{"title":"deployed","body":"cf"}}`)
+
+		Expect(loggregator.ToV1(e)).To(BeEmpty())
+	})
+
+	It("finds the app of envelopes by app_id tag or GUID source id", func() {
+		Expect(decode(`{"sourceId":"rep","tags":{"app_id":"app-guid"},"gauge":{}}`).AppID()).To(Equal("app-guid"))
+		Expect(decode(`{"sourceId":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","timer":{}}`).AppID()).To(Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+		Expect(decode(`{"sourceId":"gorouter","log":{}}`).AppID()).To(BeEmpty())
+	})
+
+	It("returns nil for malformed GUIDs", func() {
+		Expect(loggregator.StringToUUID("not-a-guid")).To(BeNil())
+	})
+})
@@ -0,0 +1,111 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package loggregator
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Envelope is a Loggregator V2 envelope as served by the RLP Gateway in its
+// JSON (protojson) representation. Exactly one of Log, Counter, Gauge, Timer
+// or Event is set.
+type Envelope struct {
+	Timestamp  Int64             `json:"timestamp"`
+	SourceId   string            `json:"sourceId"`
+	InstanceId string            `json:"instanceId"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Log        *Log              `json:"log,omitempty"`
+	Counter    *Counter          `json:"counter,omitempty"`
+	Gauge      *Gauge            `json:"gauge,omitempty"`
+	Timer      *Timer            `json:"timer,omitempty"`
+	Event      *Event            `json:"event,omitempty"`
+}
+
+// AppID returns the app of the envelope. The app_id tag is missing if the envelope did not pass
+// through the agent of a Diego cell, in which case the source ID is the app GUID. Source IDs of
+// platform components, such as gorouter or rep, are not GUIDs and are not apps.
+func (e *Envelope) AppID() string {
+	if appID := e.Tags["app_id"]; appID != "" {
+		return appID
+	}
+	if StringToUUID(e.SourceId) != nil {
+		return e.SourceId
+	}
+	return ""
+}
+
+// EnvelopeBatch is the payload of a single server-sent event from the RLP Gateway
+type EnvelopeBatch struct {
+	Batch []*Envelope `json:"batch"`
+}
+
+// Log is a single log line. Payload is base64 encoded on the wire.
+type Log struct {
+	Payload []byte `json:"payload"`
+	Type    string `json:"type,omitempty"` // OUT or ERR
+}
+
+// Counter is the increment of a monotonically increasing counter
+type Counter struct {
+	Name  string `json:"name"`
+	Delta Uint64 `json:"delta"`
+	Total Uint64 `json:"total"`
+}
+
+// Gauge carries one or more named values measured at the same instant
+type Gauge struct {
+	Metrics map[string]*GaugeValue `json:"metrics"`
+}
+
+// GaugeValue is a single metric of a Gauge
+type GaugeValue struct {
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+// Timer is the duration of an operation, typically an HTTP request
+type Timer struct {
+	Name  string `json:"name"`
+	Start Int64  `json:"start"`
+	Stop  Int64  `json:"stop"`
+}
+
+// Event is a free-form occurrence with a title and a body
+type Event struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Int64 decodes a 64-bit integer that protojson encodes as a JSON string
+type Int64 int64
+
+func (i *Int64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(unquote(b), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = Int64(v)
+	return nil
+}
+
+// Uint64 decodes an unsigned 64-bit integer that protojson encodes as a JSON string
+type Uint64 uint64
+
+func (u *Uint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(unquote(b), 10, 64)
+	if err != nil {
+		return err
+	}
+	*u = Uint64(v)
+	return nil
+}
+
+func unquote(b []byte) string {
+	s := strings.Trim(string(b), "\"")
+	if s == "" || s == "null" {
+		return "0"
+	}
+	return s
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package loggregator_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLoggregator(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Loggregator Suite")
+}
@@ -4,10 +4,11 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime/pprof"
 	"strings"
 	"syscall"
@@ -18,176 +19,272 @@ import (
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/config"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/firehose"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/multiline"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/omsnozzle"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/platform"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/redact"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/spool"
 )
 
 const (
 	firehoseSubscriptionID = "oms-nozzle"
-	// lower limit for override
-	minOMSPostTimeoutSeconds = 1
-	// upper limit for override
-	maxOMSPostTimeoutSeconds = 60
-	// upper limit of max message number per batch
-	ceilingMaxMsgNumPerBatch = 10000
-	// filter metrics
-	metricEventType = "METRIC"
-	// filter stdout/stderr events
-	logEventType = "LOG"
-	// filter http start/stop events
-	httpEventType = "HTTP"
 	// the prefix of message type in OMS Log Analytics
 	omsTypePrefix = "CF_"
 )
 
-// Required parameters
 var (
-	apiAddress           = kingpin.Flag("api-addr", "Api URL").OverrideDefaultFromEnvar("API_ADDR").String()
-	dopplerAddress       = kingpin.Flag("doppler-addr", "Traffic controller URL").OverrideDefaultFromEnvar("DOPPLER_ADDR").String()
-	cfUser               = kingpin.Flag("firehose-user", "CF user with admin and firehose access").OverrideDefaultFromEnvar("FIREHOSE_USER").Required().String()
-	cfPassword           = kingpin.Flag("firehose-user-password", "Password of the CF user").OverrideDefaultFromEnvar("FIREHOSE_USER_PASSWORD").Required().String()
-	environment          = kingpin.Flag("cf-environment", "CF environment name").OverrideDefaultFromEnvar("CF_ENVIRONMENT").Default("cf").String()
-	omsWorkspace         = kingpin.Flag("oms-workspace", "OMS workspace ID").OverrideDefaultFromEnvar("OMS_WORKSPACE").Required().String()
-	omsKey               = kingpin.Flag("oms-key", "OMS workspace key").OverrideDefaultFromEnvar("OMS_KEY").Required().String()
-	omsPostTimeout       = kingpin.Flag("oms-post-timeout", "HTTP timeout for posting events to OMS Log Analytics").Default("5s").OverrideDefaultFromEnvar("OMS_POST_TIMEOUT").Duration()
-	azureResourceId      = kingpin.Flag("azure-resource-id", "Resource Id to include as an HTTP header when posting events").OverrideDefaultFromEnvar("AZURE_RESOURCE_ID").String()
-	omsBatchTime         = kingpin.Flag("oms-batch-time", "Interval to post an OMS batch").Default("5s").OverrideDefaultFromEnvar("OMS_BATCH_TIME").Duration()
-	omsMaxMsgNumPerBatch = kingpin.Flag("oms-max-msg-num-per-batch", "Max number of messages per OMS batch").Default("1000").OverrideDefaultFromEnvar("OMS_MAX_MSG_NUM_PER_BATCH").Int()
-
-	// comma separated list of types to exclude.  For now use metric,log,http and revisit later
-	spaceFilter           = kingpin.Flag("appFilter", "Comma separated white list of orgs/spaces/apps").Default("").OverrideDefaultFromEnvar("SPACE_WHITELIST").String()
-	envelopeFilter        = kingpin.Flag("envelopeFilter", "Comma separated list of types to exclude").Default("").OverrideDefaultFromEnvar("ENVELOPE_FILTER").String()
-	skipSslValidation     = kingpin.Flag("skip-ssl-validation", "Skip SSL validation").Default("false").OverrideDefaultFromEnvar("SKIP_SSL_VALIDATION").Bool()
-	idleTimeout           = kingpin.Flag("idle-timeout", "Keep Alive duration for the firehose consumer").Default("25s").OverrideDefaultFromEnvar("IDLE_TIMEOUT").Duration()
-	logLevel              = kingpin.Flag("log-level", "Log level: DEBUG, INFO, ERROR").Default("INFO").OverrideDefaultFromEnvar("LOG_LEVEL").String()
-	logEventCount         = kingpin.Flag("log-event-count", "Whether to log the total count of received and sent events to OMS").Default("false").OverrideDefaultFromEnvar("LOG_EVENT_COUNT").Bool()
-	logEventCountInterval = kingpin.Flag("log-event-count-interval", "The interval to log the total count of received and sent events to OMS").Default("60s").OverrideDefaultFromEnvar("LOG_EVENT_COUNT_INTERVAL").Duration()
-	cachingInterval       = kingpin.Flag("caching-interval", "The interval to keep app name cached for").Default("60s").OverrideDefaultFromEnvar("CACHING_INTERVAL").Duration()
-
-	excludeMetricEvents = false
-	excludeLogEvents    = false
-	excludeHttpEvents   = false
+	flags           = config.RegisterFlags(kingpin.CommandLine)
+	runCommand      = kingpin.Command("run", "Run the nozzle").Default()
+	validateCommand = kingpin.Command("validate", "Validate the config and print it with secrets masked")
 )
 
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
 
+	cfg, err := flags.Load()
+	if err != nil {
+		kingpin.Fatalf("error loading config: %s", err)
+	}
+	env, err := platform.Detect(os.Getenv)
+	if err != nil {
+		kingpin.Fatalf("error detecting the platform: %s", err)
+	}
+	env.Configure(cfg)
+	if err := cfg.Validate(); err != nil {
+		kingpin.Fatalf("invalid config:\n%s", err)
+	}
+
+	switch command {
+	case validateCommand.FullCommand():
+		fmt.Print(cfg.Masked().YAML())
+	case runCommand.FullCommand():
+		run(cfg, env)
+	}
+}
+
+func run(cfg *config.Config, env *platform.Platform) {
 	logger := lager.NewLogger("oms-nozzle")
 	level := lager.INFO
-	switch strings.ToUpper(*logLevel) {
+	switch strings.ToUpper(cfg.LogLevel) {
 	case "DEBUG":
 		level = lager.DEBUG
 	case "ERROR":
 		level = lager.ERROR
 	}
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, level))
+	logger.Info("platform", lager.Data{"kind": env.Kind, "instance": env.InstanceName})
+	logger.Info("config", lager.Data{"config": cfg.Masked()})
 
 	// enable thread dump
 	threadDumpChan := registerGoRoutineDumpSignalChannel()
 	defer close(threadDumpChan)
 	go dumpGoRoutine(threadDumpChan)
 
-	var VCAP_APPLICATION map[string]*json.RawMessage
-	err := json.Unmarshal([]byte(os.Getenv("VCAP_APPLICATION")), &VCAP_APPLICATION)
-	if err != nil {
-		logger.Error("environment variable unmarshal failed", errors.New(err.Error()))
+	// the config is valid, so the errors below are not expected
+	var err error
+	var envelopeFilterConfig *filter.Filter
+	if rules := cfg.FilterRules(); len(rules) > 0 {
+		envelopeFilterConfig, err = filter.Parse(rules)
+		if err != nil {
+			logger.Fatal("error parsing envelope filter rules", err)
+		}
+		logger.Info("config", lager.Data{"rules": envelopeFilterConfig.String()})
+	} else {
+		logger.Info("config ENVELOPE_FILTER and ENVELOPE_FILTER_RULES are nil. all events will be published")
+	}
+	var multilineConfig *multiline.Config
+	if len(cfg.Multiline.StartPattern) > 0 {
+		multilineConfig = &multiline.Config{
+			StartPattern: regexp.MustCompile(cfg.Multiline.StartPattern),
+			MaxLines:     cfg.Multiline.MaxLines,
+			MaxBytes:     int(cfg.Multiline.MaxSize),
+			MaxWait:      cfg.Multiline.MaxWait.Duration(),
+		}
+	}
+	var jsonLogParser *messages.JSONLogParser
+	if len(cfg.JSONLogs.Scope) > 0 {
+		jsonLogParser, err = messages.NewJSONLogParser(strings.Join(cfg.JSONLogs.Scope, ","), int(cfg.JSONLogs.MaxSize), cfg.JSONLogs.MaxFields)
+		if err != nil {
+			logger.Fatal("error creating JSON log parser", err)
+		}
 	}
 
-	var ENVIRONMENT_API_ADDR string
-	err = json.Unmarshal(*VCAP_APPLICATION["cf_api"], &ENVIRONMENT_API_ADDR)
-	if err != nil {
-		logger.Error("environment variable unmarshal failed", errors.New(err.Error()))
+	var registry *metrics.Registry
+	if len(cfg.Metrics.Address) > 0 {
+		registry = metrics.NewRegistry()
+	} else {
+		logger.Info("config METRICS_ADDR is nil, metrics and health checks are not served")
 	}
 
-	if len(*apiAddress) <= 0 {
-		apiAddress = &ENVIRONMENT_API_ADDR
+	var redactor *redact.Redactor
+	if cfg.Redaction.Enabled() {
+		redactor, err = redact.New(cfg.RedactionDetectors(), cfg.Redaction.Patterns, registry)
+		if err != nil {
+			logger.Fatal("error creating redactor", err)
+		}
 	}
-	logger.Info("config", lager.Data{"API_ADDR": *apiAddress})
 
-	if len(*dopplerAddress) <= 0 {
-		temp := strings.Replace(*apiAddress, "https://api.", "wss://doppler.", 1) + ":443"
-		dopplerAddress = &temp
+	cfClientConfig := &cfclient.Config{
+		ApiAddress:        cfg.CF.APIAddress,
+		Username:          cfg.CF.User,
+		Password:          cfg.CF.Password,
+		SkipSslValidation: cfg.CF.SkipSSLValidation,
 	}
-	logger.Info("config", lager.Data{"DOPPLER_ADDR": *dopplerAddress})
 
-	if maxOMSPostTimeoutSeconds >= omsPostTimeout.Seconds() && minOMSPostTimeoutSeconds <= omsPostTimeout.Seconds() {
-		logger.Info("config", lager.Data{"OMS_POST_TIMEOUT": (*omsPostTimeout).String()})
-	} else {
-		logger.Info("invalid OMS_POST_TIMEOUT value, set to default",
-			lager.Data{"invalid value": (*omsPostTimeout).String()},
-			lager.Data{"min seconds": minOMSPostTimeoutSeconds},
-			lager.Data{"max seconds": maxOMSPostTimeoutSeconds},
-			lager.Data{"default seconds": 5})
-		*omsPostTimeout = time.Duration(5) * time.Second
-	}
-	logger.Info("config", lager.Data{"SKIP_SSL_VALIDATION": *skipSslValidation})
-	logger.Info("config", lager.Data{"IDLE_TIMEOUT": (*idleTimeout).String()})
-	logger.Info("config", lager.Data{"OMS_BATCH_TIME": (*omsBatchTime).String()})
-	logger.Info("config", lager.Data{"CF_ENVIRONMENT": *environment})
-	if ceilingMaxMsgNumPerBatch >= *omsMaxMsgNumPerBatch && *omsMaxMsgNumPerBatch > 0 {
-		logger.Info("config", lager.Data{"OMS_MAX_MSG_NUM_PER_BATCH": *omsMaxMsgNumPerBatch})
-	} else {
-		logger.Info("invalid OMS_MAX_MSG_NUM_PER_BATCH value, set to default",
-			lager.Data{"invalid value": *omsMaxMsgNumPerBatch},
-			lager.Data{"max value": ceilingMaxMsgNumPerBatch},
-			lager.Data{"default value": 1000})
-		*omsMaxMsgNumPerBatch = 1000
-	}
-	logger.Info("config", lager.Data{"LOG_EVENT_COUNT": *logEventCount})
-	logger.Info("config", lager.Data{"LOG_EVENT_COUNT_INTERVAL": (*logEventCountInterval).String()})
-	logger.Info("config", lager.Data{"CACHING_INTERVAL": (*cachingInterval).String()})
-	if len(*envelopeFilter) > 0 {
-		*envelopeFilter = strings.ToUpper(*envelopeFilter)
-		// by default we don't filter any events
-		if strings.Contains(*envelopeFilter, metricEventType) {
-			excludeMetricEvents = true
+	var firehoseClient firehose.Client
+	if cfg.Firehose.UseRLPGateway {
+		tokenRefresher, err := firehose.NewCfClientTokenRefresh(cfClientConfig)
+		if err != nil {
+			logger.Fatal("error creating cfclient", err)
 		}
-		if strings.Contains(*envelopeFilter, logEventType) {
-			excludeLogEvents = true
+		rlpGatewayConfig := &firehose.RlpGatewayConfig{
+			ShardId:           firehoseSubscriptionID,
+			GatewayUrl:        cfg.Firehose.RLPGatewayAddress,
+			IdleTimeout:       cfg.Firehose.IdleTimeout.Duration(),
+			SkipSslValidation: cfg.CF.SkipSSLValidation,
 		}
-		if strings.Contains(*envelopeFilter, httpEventType) {
-			excludeHttpEvents = true
-		}
-		logger.Info("config", lager.Data{"ENVELOPE_FILTER": *envelopeFilter},
-			lager.Data{"excludeMetricEvents": excludeMetricEvents},
-			lager.Data{"excludeLogEvents": excludeLogEvents},
-			lager.Data{"excludeHTTPEvents": excludeHttpEvents})
+		firehoseClient = firehose.NewRlpGatewayClient(tokenRefresher, rlpGatewayConfig, logger)
 	} else {
-		logger.Info("config ENVELOPE_FILTER is nil. all events will be published")
+		firehoseConfig := &firehose.FirehoseConfig{
+			SubscriptionId:       firehoseSubscriptionID,
+			TrafficControllerUrl: cfg.Firehose.DopplerAddress,
+			IdleTimeout:          cfg.Firehose.IdleTimeout.Duration(),
+		}
+		firehoseClient = firehose.NewClient(cfClientConfig, firehoseConfig, logger)
 	}
 
-	cfClientConfig := &cfclient.Config{
-		ApiAddress:        *apiAddress,
-		Username:          *cfUser,
-		Password:          *cfPassword,
-		SkipSslValidation: *skipSslValidation,
+	omsClient := newOutputClient(&cfg.Output, logger)
+	router, err := cfg.Router()
+	if err != nil {
+		logger.Fatal("error parsing routes", err)
 	}
-
-	firehoseConfig := &firehose.FirehoseConfig{
-		SubscriptionId:       firehoseSubscriptionID,
-		TrafficControllerUrl: *dopplerAddress,
-		IdleTimeout:          *idleTimeout,
+	if router.Len() > 0 {
+		logger.Info("config", lager.Data{"routes": router.String()})
 	}
 
-	firehoseClient := firehose.NewClient(cfClientConfig, firehoseConfig, logger)
-
-	omsClient := client.NewOmsClient(*omsWorkspace, *omsKey, *omsPostTimeout, *azureResourceId, logger)
-
 	nozzleConfig := &omsnozzle.NozzleConfig{
 		OmsTypePrefix:         omsTypePrefix,
-		OmsBatchTime:          *omsBatchTime,
-		OmsMaxMsgNumPerBatch:  *omsMaxMsgNumPerBatch,
-		ExcludeMetricEvents:   excludeMetricEvents,
-		ExcludeLogEvents:      excludeLogEvents,
-		ExcludeHttpEvents:     excludeHttpEvents,
-		LogEventCount:         *logEventCount,
-		LogEventCountInterval: *logEventCountInterval,
+		OmsBatchTime:          cfg.Batch.Time.Duration(),
+		OmsMaxMsgNumPerBatch:  cfg.Batch.MaxMessages,
+		OmsMaxBatchBytes:      int(cfg.MaxBatchSize()),
+		LogEventCount:         cfg.LogEventCount,
+		LogEventCountInterval: cfg.LogEventCountInterval.Duration(),
+		NativeV2Envelopes:     cfg.Firehose.UseRLPGateway && cfg.Firehose.RLPGatewayNativeV2,
+		ShutdownTimeout:       cfg.ShutdownTimeout.Duration(),
+		Metrics:               registry,
+		Filter:                envelopeFilterConfig,
+		Tags:                  cfg.TagsConfig(),
+		Multiline:             multilineConfig,
+		Redactor:              redactor,
+		JSONLogs:              jsonLogParser,
+		RetryPolicy: omsnozzle.RetryPolicy{
+			MaxAttempts: cfg.Retry.MaxAttempts,
+			BaseDelay:   cfg.Retry.BaseDelay.Duration(),
+			MaxDelay:    cfg.Retry.MaxDelay.Duration(),
+			Jitter:      cfg.Retry.Jitter,
+		},
+		Health: omsnozzle.HealthConfig{
+			MaxEnvelopeAge:    cfg.Metrics.MaxEnvelopeAge.Duration(),
+			MaxPostFailureAge: cfg.Metrics.MaxPostFailureAge.Duration(),
+		},
 	}
 
-	cachingClient := caching.NewCaching(cfClientConfig, logger, *environment, *spaceFilter, *cachingInterval)
+	if len(cfg.Spool.Dir) > 0 {
+		s := cfg.OutputSpool(omsnozzle.DefaultOutput)
+		batchSpool, err := spool.NewSpool(s.Dir, int64(s.MaxSize), s.MaxAge.Duration(), logger)
+		if err != nil {
+			logger.Fatal("error opening spool", err)
+		}
+		nozzleConfig.Spool = batchSpool
+	} else {
+		logger.Info("config SPOOL_DIR is nil, batches that fail to post will be lost")
+	}
+	nozzleConfig.Router = router
+	for i := range cfg.Outputs {
+		o := &cfg.Outputs[i]
+		output := omsnozzle.Output{
+			Name:          o.Name,
+			Client:        newOutputClient(&o.Output, logger),
+			MaxBatchBytes: int(o.MaxBatchSize(cfg.Batch)),
+			DropWhenFull:  o.DropWhenFull,
+		}
+		if len(cfg.Spool.Dir) > 0 {
+			s := cfg.OutputSpool(o.Name)
+			output.Spool, err = spool.NewSpool(s.Dir, int64(s.MaxSize), s.MaxAge.Duration(), logger)
+			if err != nil {
+				logger.Fatal("error opening spool", err, lager.Data{"output": o.Name})
+			}
+		}
+		nozzleConfig.Outputs = append(nozzleConfig.Outputs, output)
+	}
+
+	cachingConfig := &caching.CachingConfig{
+		Environment:         cfg.CF.Environment,
+		SpaceFilter:         strings.Join(cfg.Filter.SpaceWhitelist, ","),
+		Interval:            cfg.Caching.Interval.Duration(),
+		FullRefreshInterval: cfg.Caching.FullRefreshInterval.Duration(),
+		NegativeTTL:         cfg.Caching.NegativeTTL.Duration(),
+		LookupRate:          cfg.Caching.LookupRate,
+		LookupBurst:         cfg.Caching.LookupBurst,
+		MetadataKeys:        cfg.Events.AppMetadataKeys,
+		InstanceName:        env.InstanceName,
+	}
+	if len(cfg.Caching.SnapshotFile) > 0 {
+		cachingConfig.SnapshotStore = &caching.FileSnapshotStore{Path: cfg.Caching.SnapshotFile}
+	}
+	cachingClient := caching.NewCaching(cfClientConfig, logger, cachingConfig, registry)
 	nozzle := omsnozzle.NewOmsNozzle(logger, firehoseClient, omsClient, nozzleConfig, cachingClient)
 
-	logger.Error("nozzle exited", nozzle.Start())
+	if len(cfg.Metrics.Address) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		mux.Handle("/healthz", nozzle.HealthHandler())
+		mux.Handle("/readyz", nozzle.ReadyHandler())
+		go serveHTTP(cfg.Metrics.Address, mux, logger)
+	}
+
+	if err := nozzle.Start(); err != nil {
+		logger.Error("nozzle exited", err)
+		os.Exit(1)
+	}
+	logger.Info("nozzle exited")
+}
+
+// newOutputClient returns the client posting to o
+func newOutputClient(o *config.Output, logger lager.Logger) client.Client {
+	if o.API == config.LogsIngestionAPI {
+		tokenProvider, err := client.NewTokenProvider(o.EntraIDConfig(), logger)
+		if err != nil {
+			logger.Fatal("error creating Entra ID token provider", err)
+		}
+		return client.NewLogsIngestionClient(&client.LogsIngestionConfig{
+			Endpoint:    o.LogsIngestion.DCEEndpoint,
+			RuleID:      o.LogsIngestion.DCRImmutableID,
+			Streams:     o.LogsIngestion.Streams,
+			PostTimeout: o.PostTimeout.Duration(),
+			Gzip:        o.Gzip,
+		}, tokenProvider, logger)
+	}
+	if o.Gzip {
+		logger.Info("GZIP_POSTS is not supported by the data-collector API, posts are not compressed")
+	}
+	return client.NewOmsClient(o.DataCollector.Workspace, o.DataCollector.Key, o.PostTimeout.Duration(), o.AzureResourceID, logger)
+}
+
+func serveHTTP(address string, handler http.Handler, logger lager.Logger) {
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error("error serving HTTP", err, lager.Data{"address": address})
+	}
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
@@ -0,0 +1,138 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// results of JSONLogParser.Parse
+const (
+	JSONLogParsed   = "parsed"
+	JSONLogSkipped  = "skipped"   // not in scope or not a JSON object
+	JSONLogInvalid  = "invalid"   // looks like a JSON object but does not parse
+	JSONLogTooLarge = "too_large" // longer than the max line size or with too many fields
+)
+
+// keys of the fields promoted to LogMessage columns, in order of precedence. Dotted keys are
+// those of the Elastic Common Schema, camel case ones those of Spring Cloud Sleuth.
+var (
+	messageKeys = []string{"message", "msg"}
+	levelKeys   = []string{"level", "log.level", "severity", "lvl"}
+	loggerKeys  = []string{"logger", "logger_name", "log.logger", "loggerName"}
+	traceIDKeys = []string{"trace_id", "traceId", "trace.id", "traceid"}
+	spanIDKeys  = []string{"span_id", "spanId", "span.id", "spanid"}
+)
+
+// numeric levels of pino and bunyan
+var numericLevels = map[string]string{
+	"10": "trace", "20": "debug", "30": "info", "40": "warn", "50": "error", "60": "fatal",
+}
+
+// JSONLogParser parses the JSON log lines of apps into LogMessage columns. A nil JSONLogParser
+// parses nothing.
+type JSONLogParser struct {
+	scope        map[string]bool // orgs, org.space and org.space.app; nil for all apps
+	maxLineBytes int
+	maxFields    int
+}
+
+// NewJSONLogParser creates a parser for the apps in scope, a comma separated list of ORG,
+// ORG.SPACE and ORG.SPACE.APP, or * for all apps. Lines longer than maxLineBytes or with more
+// than maxFields fields are posted as they are.
+func NewJSONLogParser(scope string, maxLineBytes int, maxFields int) (*JSONLogParser, error) {
+	if maxLineBytes <= 0 || maxFields <= 0 {
+		return nil, fmt.Errorf("the max line size and number of fields must be positive")
+	}
+	p := &JSONLogParser{maxLineBytes: maxLineBytes, maxFields: maxFields}
+	for _, s := range strings.Split(scope, ",") {
+		s = strings.TrimSuffix(strings.TrimSpace(s), ".*")
+		switch {
+		case s == "":
+			continue
+		case s == "*":
+			p.scope = nil
+			return p, nil
+		case strings.Count(s, ".") > 2 || strings.Contains(s, ".."):
+			return nil, fmt.Errorf("invalid scope %q, must be ORG, ORG.SPACE or ORG.SPACE.APP", s)
+		}
+		if p.scope == nil {
+			p.scope = make(map[string]bool)
+		}
+		p.scope[s] = true
+	}
+	if p.scope == nil {
+		return nil, fmt.Errorf("empty scope")
+	}
+	return p, nil
+}
+
+func (p *JSONLogParser) inScope(m *LogMessage) bool {
+	if p.scope == nil {
+		return true
+	}
+	return p.scope[m.ApplicationOrg] || p.scope[m.ApplicationOrg+"."+m.ApplicationSpace] ||
+		p.scope[m.ApplicationOrg+"."+m.ApplicationSpace+"."+m.ApplicationName]
+}
+
+// Parse sets the Level, Logger, TraceID, SpanID and LogFields columns of m from its message if
+// it is a JSON object logged by an app in scope, and replaces the message with its message
+// field if there is one. Messages that are not parsed are left as they are. It returns one of
+// the JSONLog results.
+func (p *JSONLogParser) Parse(m *LogMessage) string {
+	if p == nil || m.ApplicationName == "" || !strings.HasPrefix(m.SourceType, "APP") || !p.inScope(m) {
+		return JSONLogSkipped
+	}
+	line := strings.TrimSpace(m.Message)
+	if !strings.HasPrefix(line, "{") || !strings.HasSuffix(line, "}") {
+		return JSONLogSkipped
+	}
+	if len(line) > p.maxLineBytes {
+		return JSONLogTooLarge
+	}
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	if err := decoder.Decode(&fields); err != nil || decoder.More() {
+		return JSONLogInvalid
+	}
+	if len(fields) > p.maxFields {
+		return JSONLogTooLarge
+	}
+
+	if message, ok := take(fields, messageKeys); ok {
+		m.Message = message
+	}
+	if level, ok := take(fields, levelKeys); ok {
+		m.Level = strings.ToLower(level)
+		if l, ok := numericLevels[level]; ok {
+			m.Level = l
+		}
+	}
+	m.Logger, _ = take(fields, loggerKeys)
+	m.TraceID, _ = take(fields, traceIDKeys)
+	m.SpanID, _ = take(fields, spanIDKeys)
+	if len(fields) > 0 {
+		m.LogFields = fields
+	}
+	return JSONLogParsed
+}
+
+// take removes the first of keys from fields and returns its value as a string. Objects and
+// arrays are left in fields.
+func take(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case string:
+			delete(fields, key)
+			return v, true
+		case json.Number, bool:
+			delete(fields, key)
+			return fmt.Sprint(v), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages_test
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+)
+
+var _ = Describe("JSONLogParser", func() {
+	var parser *messages.JSONLogParser
+
+	logMessage := func(message string) *messages.LogMessage {
+		return &messages.LogMessage{
+			Message:          message,
+			SourceType:       "APP/PROC/WEB",
+			ApplicationName:  "orders",
+			ApplicationSpace: "prod",
+			ApplicationOrg:   "payments",
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		parser, err = messages.NewJSONLogParser("*", 1024, 10)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("parses the fields of JSON log lines into columns", func() {
+		m := logMessage(`{"@timestamp":"2020-01-01T00:00:00Z","level":"WARN","logger_name":"com.example.Orders",` +
+			`"message":"slow query","traceId":"4bf92f3577b34da6","spanId":"00f067aa0ba902b7","durationMs":1200,"tags":["db"]}`)
+
+		Expect(parser.Parse(m)).To(Equal(messages.JSONLogParsed))
+
+		Expect(m.Message).To(Equal("slow query"))
+		Expect(m.Level).To(Equal("warn"))
+		Expect(m.Logger).To(Equal("com.example.Orders"))
+		Expect(m.TraceID).To(Equal("4bf92f3577b34da6"))
+		Expect(m.SpanID).To(Equal("00f067aa0ba902b7"))
+		Expect(m.LogFields).To(Equal(map[string]interface{}{
+			"@timestamp": "2020-01-01T00:00:00Z",
+			"durationMs": json.Number("1200"),
+			"tags":       []interface{}{"db"},
+		}))
+		record, err := json.Marshal(m)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"LogFields":{"@timestamp":"2020-01-01T00:00:00Z","durationMs":1200,"tags":["db"]}`))
+	})
+
+	DescribeTable("recognizes the fields of common loggers",
+		func(line string, level string, logger string, traceID string) {
+			m := logMessage(line)
+
+			Expect(parser.Parse(m)).To(Equal(messages.JSONLogParsed))
+			Expect(m.Message).To(Equal("hello"))
+			Expect(m.Level).To(Equal(level))
+			Expect(m.Logger).To(Equal(logger))
+			Expect(m.TraceID).To(Equal(traceID))
+			Expect(m.LogFields).To(BeNil())
+		},
+		Entry("pino", `{"level":30,"msg":"hello"}`, "info", "", ""),
+		Entry("Elastic Common Schema", `{"log.level":"ERROR","log.logger":"main","message":"hello","trace.id":"abc"}`, "error", "main", "abc"),
+		Entry("OpenTelemetry", `{"severity":"debug","logger":"http","msg":"hello","trace_id":"abc","span_id":"def"}`, "debug", "http", "abc"),
+	)
+
+	It("keeps the message of lines without a message field", func() {
+		m := logMessage(`{"level":"info","event":"started"}`)
+
+		Expect(parser.Parse(m)).To(Equal(messages.JSONLogParsed))
+
+		Expect(m.Message).To(Equal(`{"level":"info","event":"started"}`))
+		Expect(m.LogFields).To(Equal(map[string]interface{}{"event": "started"}))
+	})
+
+	DescribeTable("posts the lines it does not parse as they are",
+		func(line string, result string) {
+			m := logMessage(line)
+
+			Expect(parser.Parse(m)).To(Equal(result))
+
+			Expect(m.Message).To(Equal(line))
+			Expect(m.Level).To(BeEmpty())
+			Expect(m.LogFields).To(BeNil())
+		},
+		Entry("plain text", "GET /orders 200", messages.JSONLogSkipped),
+		Entry("JSON array", `["a","b"]`, messages.JSONLogSkipped),
+		Entry("invalid JSON", `{"level":"info",}`, messages.JSONLogInvalid),
+		Entry("several objects", `{"a":1} {"b":2}`, messages.JSONLogInvalid),
+		Entry("line over the max size", `{"message":"`+strings.Repeat("x", 1024)+`"}`, messages.JSONLogTooLarge),
+		Entry("too many fields", `{"a":1,"b":2,"c":3,"d":4,"e":5,"f":6,"g":7,"h":8,"i":9,"j":10,"k":11}`, messages.JSONLogTooLarge),
+	)
+
+	It("parses only the logs of apps", func() {
+		m := logMessage(`{"message":"hello"}`)
+		m.SourceType = "RTR"
+		Expect(parser.Parse(m)).To(Equal(messages.JSONLogSkipped))
+
+		m = logMessage(`{"message":"hello"}`)
+		m.ApplicationName = ""
+		Expect(parser.Parse(m)).To(Equal(messages.JSONLogSkipped))
+	})
+
+	It("parses only the logs of the orgs, spaces and apps in scope", func() {
+		inScope := func(scope string) bool {
+			p, err := messages.NewJSONLogParser(scope, 1024, 10)
+			Expect(err).NotTo(HaveOccurred())
+			return p.Parse(logMessage(`{"message":"hello"}`)) == messages.JSONLogParsed
+		}
+
+		Expect(inScope("payments")).To(BeTrue())
+		Expect(inScope("payments.*")).To(BeTrue())
+		Expect(inScope("other, payments.prod")).To(BeTrue())
+		Expect(inScope("payments.prod.orders")).To(BeTrue())
+		Expect(inScope("payments.dev")).To(BeFalse())
+		Expect(inScope("payments.prod.billing")).To(BeFalse())
+	})
+
+	It("rejects invalid configs", func() {
+		_, err := messages.NewJSONLogParser("a.b.c.d", 1024, 10)
+		Expect(err).To(MatchError(ContainSubstring(`"a.b.c.d"`)))
+		_, err = messages.NewJSONLogParser(" , ", 1024, 10)
+		Expect(err).To(HaveOccurred())
+		_, err = messages.NewJSONLogParser("*", 0, 10)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("parses nothing if nil", func() {
+		var nilParser *messages.JSONLogParser
+		Expect(nilParser.Parse(logMessage(`{"message":"hello"}`))).To(Equal(messages.JSONLogSkipped))
+	})
+})
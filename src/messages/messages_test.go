@@ -68,7 +68,7 @@ var _ = Describe("Messages", func() {
 		Expect(m.Index).To(Equal(index))
 		Expect(m.Deployment).To(Equal(deployment))
 		Expect(m.IP).To(Equal(ip))
-		Expect(m.Tags).To(Equal("map[tag1:value1]"))
+		Expect(m.Tags.Values).To(Equal(tags))
 		Expect(m.Job).To(Equal(job))
 		hash := md5.Sum([]byte(envelope.String())) //nolint: gosec
 		Expect(m.MessageHash).To(Equal(hex.EncodeToString(hash[:])))
@@ -149,6 +149,14 @@ var _ = Describe("Messages", func() {
 		m2 := messages.NewLogMessage(envelope, cache)
 
 		Expect(m2).To(BeNil())
+
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{Monitored: true, LogTypes: []string{caching.LogTypeHTTP}}
+		}
+
+		m3 := messages.NewLogMessage(envelope, cache)
+
+		Expect(m3).To(BeNil())
 	})
 
 	It("creates HttpStartStop from Envelope", func() {
@@ -359,6 +367,45 @@ var _ = Describe("Messages", func() {
 		Expect(m2).To(BeNil())
 	})
 
+	It("adds the app metadata to the events of apps", func() {
+		appId := "98B26B8D-6642-4070-A3B1-0EB3B43FF9AD"
+		low, high := uint64(16592826980310057976), uint64(791876040070101076)
+		tags := map[string]string{"process_type": "web"}
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{
+				Monitored:   true,
+				Stack:       "cflinuxfs4",
+				Annotations: map[string]string{"example.com/owner": "team-a"},
+			}
+		}
+		expected := &messages.AppMetadata{
+			ProcessType: "web",
+			Stack:       "cflinuxfs4",
+			Annotations: map[string]string{"example.com/owner": "team-a"},
+		}
+
+		logMessage := messages.NewLogMessage(&events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			Tags:       tags,
+			LogMessage: &events.LogMessage{AppId: &appId},
+		}, cache)
+		Expect(logMessage.AppMetadata).To(Equal(expected))
+
+		containerMetric := messages.NewContainerMetric(&events.Envelope{
+			EventType:       events.Envelope_ContainerMetric.Enum(),
+			Tags:            tags,
+			ContainerMetric: &events.ContainerMetric{ApplicationId: &appId},
+		}, cache)
+		Expect(containerMetric.AppMetadata).To(Equal(expected))
+
+		httpStartStop := messages.NewHTTPStartStop(&events.Envelope{
+			EventType:     events.Envelope_HttpStartStop.Enum(),
+			Tags:          tags,
+			HttpStartStop: &events.HttpStartStop{ApplicationId: &events.UUID{Low: &low, High: &high}},
+		}, cache)
+		Expect(httpStartStop.AppMetadata).To(Equal(expected))
+	})
+
 	It("creates CounterEvent from Envelope", func() {
 		eventType := events.Envelope_CounterEvent
 		name := "dropsondeUnmarshaller.receivedEnvelopes"
@@ -0,0 +1,278 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages_test
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+)
+
+var _ = Describe("V2 Messages", func() {
+	var (
+		cache *mocks.MockCaching
+		tags  map[string]string
+	)
+
+	BeforeEach(func() {
+		cache = &mocks.MockCaching{
+			InstanceName:    "nozzleinstace",
+			EnvironmentName: "dev",
+			MockGetAppInfo: func(appGuid string) caching.AppInfo {
+				return caching.AppInfo{
+					Name:      "appName",
+					Org:       "appOrg",
+					OrgID:     "appOrgID",
+					Space:     "appSpace",
+					SpaceID:   "appSpaceID",
+					Monitored: true,
+				}
+			},
+		}
+		tags = map[string]string{
+			"origin":     "rep",
+			"deployment": "cf",
+			"job":        "diego-cell",
+			"index":      "0",
+			"ip":         "10.0.0.1",
+			"product":    "TAS",
+		}
+	})
+
+	It("creates BaseMessage from a V2 Envelope", func() {
+		envelope := &loggregator.Envelope{
+			Timestamp: 2,
+			SourceId:  "rep",
+			Tags:      tags,
+			Counter:   &loggregator.Counter{Name: "requests"},
+		}
+
+		m := *messages.NewBaseMessageV2(envelope, "CounterEvent", cache)
+
+		Expect(m.EventType).To(Equal("CounterEvent"))
+		Expect(m.EventTime).To(Equal(time.Unix(0, 2)))
+		Expect(m.Origin).To(Equal("rep"))
+		Expect(m.Deployment).To(Equal("cf"))
+		Expect(m.Job).To(Equal("diego-cell"))
+		Expect(m.Index).To(Equal("0"))
+		Expect(m.IP).To(Equal("10.0.0.1"))
+		Expect(m.SourceInstance).To(Equal("cf.diego-cell.0"))
+		Expect(m.Tags.Values).To(Equal(map[string]string{"product": "TAS"}))
+		Expect(m.NozzleInstance).To(Equal("nozzleinstace"))
+		Expect(m.Environment).To(Equal("dev"))
+		Expect(m.MessageHash).To(HaveLen(32))
+	})
+
+	It("creates LogMessage from a V2 Envelope", func() {
+		tags["source_type"] = "APP/PROC/WEB"
+		envelope := &loggregator.Envelope{
+			Timestamp:  3,
+			SourceId:   "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			InstanceId: "1",
+			Tags:       tags,
+			Log:        &loggregator.Log{Payload: []byte("hello"), Type: "ERR"},
+		}
+
+		m := messages.NewLogMessageV2(envelope, cache)
+
+		Expect(m).NotTo(BeNil())
+		Expect(m.EventType).To(Equal("LogMessage"))
+		Expect(m.Message).To(Equal("hello"))
+		Expect(m.MessageType).To(Equal("ERR"))
+		Expect(m.Timestamp).To(Equal(int64(3)))
+		Expect(m.AppID).To(Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+		Expect(m.ApplicationName).To(Equal("appName"))
+		Expect(m.SourceType).To(Equal("APP/PROC/WEB"))
+		Expect(m.SourceInstance).To(Equal("1"))
+		Expect(m.SourceTypeKey).To(Equal("APP/PROC/WEB-ERR"))
+
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{Monitored: false}
+		}
+		Expect(messages.NewLogMessageV2(envelope, cache)).To(BeNil())
+	})
+
+	It("does not look up the source ids of platform logs", func() {
+		var lookedUp []string
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			lookedUp = append(lookedUp, appGuid)
+			return caching.AppInfo{}
+		}
+		tags["source_type"] = "RTR"
+		envelope := &loggregator.Envelope{
+			SourceId: "gorouter",
+			Tags:     tags,
+			Log:      &loggregator.Log{Payload: []byte("GET /")},
+		}
+
+		m := messages.NewLogMessageV2(envelope, cache)
+
+		Expect(m).NotTo(BeNil())
+		Expect(m.ApplicationName).To(BeEmpty())
+		Expect(lookedUp).To(BeEmpty())
+	})
+
+	It("creates CounterEvent from a V2 Envelope", func() {
+		envelope := &loggregator.Envelope{
+			Tags:    tags,
+			Counter: &loggregator.Counter{Name: "requests", Delta: 2, Total: 10},
+		}
+
+		m := messages.NewCounterEventV2(envelope, cache)
+
+		Expect(m.EventType).To(Equal("CounterEvent"))
+		Expect(m.Name).To(Equal("requests"))
+		Expect(m.Delta).To(Equal(uint64(2)))
+		Expect(m.Total).To(Equal(uint64(10)))
+		Expect(m.CounterKey).To(Equal("diego-cell.rep.requests"))
+	})
+
+	It("creates a single Gauge holding all metrics", func() {
+		envelope := &loggregator.Envelope{
+			SourceId:   "rep",
+			InstanceId: "0",
+			Tags:       tags,
+			Gauge: &loggregator.Gauge{Metrics: map[string]*loggregator.GaugeValue{
+				"cpu":    {Unit: "percentage", Value: 1.5},
+				"memory": {Unit: "bytes", Value: 1024},
+				"broken": {Unit: "count", Value: math.NaN()},
+			}},
+		}
+
+		m := messages.NewGauge(envelope, cache)
+
+		Expect(m).NotTo(BeNil())
+		Expect(m.EventType).To(Equal("Gauge"))
+		Expect(m.SourceID).To(Equal("rep"))
+		Expect(m.InstanceID).To(Equal("0"))
+		Expect(m.Metrics).To(Equal(map[string]interface{}{"cpu": 1.5, "memory": float64(1024), "broken": "NaN"}))
+		Expect(m.Units).To(Equal(map[string]string{"cpu": "percentage", "memory": "bytes", "broken": "count"}))
+		Expect(m.ApplicationID).To(BeEmpty())
+		_, err := json.Marshal(m)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("enriches and filters Gauges of apps", func() {
+		tags["app_id"] = "app-guid"
+		envelope := &loggregator.Envelope{
+			SourceId: "app-guid",
+			Tags:     tags,
+			Gauge:    &loggregator.Gauge{Metrics: map[string]*loggregator.GaugeValue{"cpu": {Value: 1}}},
+		}
+
+		m := messages.NewGauge(envelope, cache)
+
+		Expect(m.ApplicationID).To(Equal("app-guid"))
+		Expect(m.ApplicationName).To(Equal("appName"))
+		Expect(m.ApplicationOrg).To(Equal("appOrg"))
+		Expect(m.ApplicationSpace).To(Equal("appSpace"))
+
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{Monitored: false}
+		}
+		Expect(messages.NewGauge(envelope, cache)).To(BeNil())
+	})
+
+	It("enriches Gauges and Timers by source id without an app_id tag", func() {
+		delete(tags, "app_id")
+		gauge := messages.NewGauge(&loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     tags,
+			Gauge:    &loggregator.Gauge{Metrics: map[string]*loggregator.GaugeValue{"cpu": {Value: 1}}},
+		}, cache)
+		timer := messages.NewTimer(&loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     tags,
+			Timer:    &loggregator.Timer{Name: "http", Start: 100, Stop: 350},
+		}, cache)
+
+		Expect(gauge.ApplicationID).To(Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+		Expect(gauge.ApplicationName).To(Equal("appName"))
+		Expect(timer.ApplicationID).To(Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))
+		Expect(timer.ApplicationName).To(Equal("appName"))
+	})
+
+	It("adds the app metadata and process type as a dynamic column", func() {
+		cache.MockGetAppInfo = func(appGuid string) caching.AppInfo {
+			return caching.AppInfo{
+				Name:       "appName",
+				Monitored:  true,
+				Stack:      "cflinuxfs4",
+				Buildpacks: []string{"go_buildpack"},
+				Labels:     map[string]string{"team": "payments"},
+			}
+		}
+		tags["process_type"] = "worker"
+		envelope := &loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     tags,
+			Log:      &loggregator.Log{Payload: []byte("log")},
+		}
+
+		m := messages.NewLogMessageV2(envelope, cache)
+
+		Expect(m.AppMetadata).To(Equal(&messages.AppMetadata{
+			ProcessType: "worker",
+			Stack:       "cflinuxfs4",
+			Buildpacks:  []string{"go_buildpack"},
+			Labels:      map[string]string{"team": "payments"},
+		}))
+		record, err := json.Marshal(m)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"AppMetadata":{"processType":"worker","stack":"cflinuxfs4","buildpacks":["go_buildpack"],"labels":{"team":"payments"}}`))
+	})
+
+	It("omits the app metadata column if there is no metadata", func() {
+		envelope := &loggregator.Envelope{
+			SourceId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+			Tags:     tags,
+			Log:      &loggregator.Log{Payload: []byte("log")},
+		}
+
+		m := messages.NewLogMessageV2(envelope, cache)
+
+		Expect(m.AppMetadata).To(BeNil())
+		record, err := json.Marshal(m)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).NotTo(ContainSubstring("AppMetadata"))
+	})
+
+	It("creates Timer from a V2 Envelope", func() {
+		envelope := &loggregator.Envelope{
+			SourceId: "gorouter",
+			Tags:     tags,
+			Timer:    &loggregator.Timer{Name: "http", Start: 100, Stop: 350},
+		}
+
+		m := messages.NewTimer(envelope, cache)
+
+		Expect(m.EventType).To(Equal("Timer"))
+		Expect(m.Name).To(Equal("http"))
+		Expect(m.StartTimestamp).To(Equal(int64(100)))
+		Expect(m.StopTimestamp).To(Equal(int64(350)))
+		Expect(m.Duration).To(Equal(int64(250)))
+	})
+
+	It("creates Event from a V2 Envelope", func() {
+		envelope := &loggregator.Envelope{
+			SourceId: "bosh",
+			Tags:     tags,
+			Event:    &loggregator.Event{Title: "deployed", Body: "cf was deployed"},
+		}
+
+		m := messages.NewEvent(envelope, cache)
+
+		Expect(m.EventType).To(Equal("Event"))
+		Expect(m.SourceID).To(Equal("bosh"))
+		Expect(m.Title).To(Equal("deployed"))
+		Expect(m.Body).To(Equal("cf was deployed"))
+	})
+})
@@ -26,7 +26,7 @@ type BaseMessage struct {
 	Job            string
 	Index          string
 	IP             string
-	Tags           string
+	Tags           Tags
 	NozzleInstance string
 	MessageHash    string
 	// for grouping in OMS until multi-field grouping is supported
@@ -55,9 +55,7 @@ func NewBaseMessage(e *events.Envelope, c caching.CachingClient) *BaseMessage {
 		b.SourceInstance = fmt.Sprintf("%s.%s.%s", e.GetDeployment(), e.GetJob(), e.GetIndex())
 	}
 
-	if e.GetTags() != nil {
-		b.Tags = fmt.Sprintf("%v", e.GetTags())
-	}
+	b.Tags.Values = e.GetTags()
 	// String() returns string from underlying protobuf message
 	var hash = md5.Sum([]byte(e.String())) //nolint: gosec
 	b.MessageHash = hex.EncodeToString(hash[:])
@@ -65,6 +63,31 @@ func NewBaseMessage(e *events.Envelope, c caching.CachingClient) *BaseMessage {
 	return &b
 }
 
+// AppMetadata holds the metadata of the app of an event, posted as a dynamic column
+type AppMetadata struct {
+	ProcessType string            `json:"processType,omitempty"`
+	Stack       string            `json:"stack,omitempty"`
+	Buildpacks  []string          `json:"buildpacks,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// newAppMetadata creates the AppMetadata of an event of an app instance of processType, nil if
+// there is no metadata
+func newAppMetadata(appInfo caching.AppInfo, processType string) *AppMetadata {
+	m := AppMetadata{
+		ProcessType: processType,
+		Stack:       appInfo.Stack,
+		Buildpacks:  appInfo.Buildpacks,
+		Labels:      appInfo.Labels,
+		Annotations: appInfo.Annotations,
+	}
+	if m.ProcessType == "" && m.Stack == "" && len(m.Buildpacks) == 0 && len(m.Labels) == 0 && len(m.Annotations) == 0 {
+		return nil
+	}
+	return &m
+}
+
 // An HTTPStartStop event represents the whole lifecycle of an HTTP request.
 type HTTPStartStop struct {
 	BaseMessage
@@ -87,6 +110,7 @@ type HTTPStartStop struct {
 	InstanceIndex      int32
 	InstanceID         string
 	Forwarded          string
+	AppMetadata        *AppMetadata `json:",omitempty"`
 }
 
 // NewHTTPStartStop creates a new NewHTTPStartStop
@@ -107,13 +131,13 @@ func NewHTTPStartStop(e *events.Envelope, c caching.CachingClient) *HTTPStartSto
 		InstanceID:     m.GetInstanceId(),
 	}
 	if m.RequestId != nil {
-		r.RequestID = cfUUIDToString(m.RequestId)
+		r.RequestID = CfUUIDToString(m.RequestId)
 	}
 	if m.ApplicationId != nil {
-		id := cfUUIDToString(m.ApplicationId)
+		id := CfUUIDToString(m.ApplicationId)
 		r.ApplicationID = id
 		var appInfo = c.GetAppInfo(id)
-		if !appInfo.Monitored {
+		if !appInfo.Forwards(caching.LogTypeHTTP) {
 			return nil
 		}
 		r.ApplicationName = appInfo.Name
@@ -121,6 +145,7 @@ func NewHTTPStartStop(e *events.Envelope, c caching.CachingClient) *HTTPStartSto
 		r.ApplicationOrgID = appInfo.OrgID
 		r.ApplicationSpace = appInfo.Space
 		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.GetTags()["process_type"])
 	}
 	if e.HttpStartStop.GetForwarded() != nil {
 		r.Forwarded = strings.Join(e.GetHttpStartStop().GetForwarded(), ",")
@@ -142,7 +167,14 @@ type LogMessage struct {
 	ApplicationSpaceID string
 	SourceType         string // APP,RTR,DEA,STG,etc
 	SourceInstance     string
-	SourceTypeKey      string // Key for aggregation until multiple levels of grouping supported
+	SourceTypeKey      string       // Key for aggregation until multiple levels of grouping supported
+	AppMetadata        *AppMetadata `json:",omitempty"`
+	// fields of JSON log lines, set by JSONLogParser
+	Level     string                 `json:",omitempty"`
+	Logger    string                 `json:",omitempty"`
+	TraceID   string                 `json:",omitempty"`
+	SpanID    string                 `json:",omitempty"`
+	LogFields map[string]interface{} `json:",omitempty"`
 }
 
 // NewLogMessage creates a new NewLogMessage
@@ -164,7 +196,7 @@ func NewLogMessage(e *events.Envelope, c caching.CachingClient) *LogMessage {
 	}
 	if m.AppId != nil {
 		var appInfo = c.GetAppInfo(*m.AppId)
-		if !appInfo.Monitored {
+		if !appInfo.Forwards(caching.LogTypeLog) {
 			return nil
 		}
 		r.ApplicationName = appInfo.Name
@@ -172,6 +204,7 @@ func NewLogMessage(e *events.Envelope, c caching.CachingClient) *LogMessage {
 		r.ApplicationOrgID = appInfo.OrgID
 		r.ApplicationSpace = appInfo.Space
 		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.GetTags()["process_type"])
 	}
 	return &r
 }
@@ -204,11 +237,12 @@ type ContainerMetric struct {
 	ApplicationSpace   string
 	ApplicationSpaceID string
 	InstanceIndex      int32
-	CPUPercentage      float64 `json:",omitempty"`
-	MemoryBytes        uint64  `json:",omitempty"`
-	DiskBytes          uint64  `json:",omitempty"`
-	MemoryBytesQuota   uint64  `json:",omitempty"`
-	DiskBytesQuota     uint64  `json:",omitempty"`
+	CPUPercentage      float64      `json:",omitempty"`
+	MemoryBytes        uint64       `json:",omitempty"`
+	DiskBytes          uint64       `json:",omitempty"`
+	MemoryBytesQuota   uint64       `json:",omitempty"`
+	DiskBytesQuota     uint64       `json:",omitempty"`
+	AppMetadata        *AppMetadata `json:",omitempty"`
 }
 
 // NewContainerMetric creates a new Container Metric
@@ -226,7 +260,7 @@ func NewContainerMetric(e *events.Envelope, c caching.CachingClient) *ContainerM
 	}
 	if m.ApplicationId != nil {
 		var appInfo = c.GetAppInfo(*m.ApplicationId)
-		if !appInfo.Monitored {
+		if !appInfo.Forwards(caching.LogTypeMetric) {
 			return nil
 		}
 		r.ApplicationName = appInfo.Name
@@ -234,6 +268,7 @@ func NewContainerMetric(e *events.Envelope, c caching.CachingClient) *ContainerM
 		r.ApplicationOrgID = appInfo.OrgID
 		r.ApplicationSpace = appInfo.Space
 		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.GetTags()["process_type"])
 	}
 	return &r
 }
@@ -273,22 +308,27 @@ func NewValueMetric(e *events.Envelope, c caching.CachingClient) *ValueMetric {
 	var r = ValueMetric{
 		BaseMessage: *NewBaseMessage(e, c),
 		Name:        e.ValueMetric.GetName(),
-		Value:       e.ValueMetric.GetValue(),
+		Value:       jsonSafeFloat(e.ValueMetric.GetValue()),
 		Unit:        e.ValueMetric.GetUnit(),
 	}
-
-	if math.IsNaN(e.ValueMetric.GetValue()) {
-		r.Value = "NaN"
-	} else if math.IsInf(e.ValueMetric.GetValue(), 1) {
-		r.Value = "Infinity"
-	} else if math.IsInf(e.ValueMetric.GetValue(), -1) {
-		r.Value = "-Infinity"
-	}
 	r.MetricKey = fmt.Sprintf("%s.%s.%s", r.Job, e.GetOrigin(), r.Name)
 	return &r
 }
 
-func cfUUIDToString(uuid *events.UUID) string {
+// jsonSafeFloat replaces the float values JSON cannot represent with strings
+func jsonSafeFloat(v float64) interface{} {
+	if math.IsNaN(v) {
+		return "NaN"
+	} else if math.IsInf(v, 1) {
+		return "Infinity"
+	} else if math.IsInf(v, -1) {
+		return "-Infinity"
+	}
+	return v
+}
+
+// CfUUIDToString formats a UUID of an envelope in the canonical form used by the CC API
+func CfUUIDToString(uuid *events.UUID) string {
 	lowBytes := new(bytes.Buffer)
 	binary.Write(lowBytes, binary.LittleEndian, uuid.Low) //nolint:errcheck
 	highBytes := new(bytes.Buffer)
@@ -0,0 +1,214 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"crypto/md5" //nolint: gosec
+	hex "encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
+)
+
+// tags of a V2 envelope that are promoted to BaseMessage fields
+var baseMessageTags = map[string]bool{
+	"origin":     true,
+	"deployment": true,
+	"job":        true,
+	"index":      true,
+	"ip":         true,
+}
+
+// NewBaseMessageV2 Creates the common attributes of messages from a Loggregator V2 envelope
+func NewBaseMessageV2(e *loggregator.Envelope, eventType string, c caching.CachingClient) *BaseMessage {
+	var b = BaseMessage{
+		EventType:      eventType,
+		Deployment:     e.Tags["deployment"],
+		Environment:    c.GetEnvironmentName(),
+		Job:            e.Tags["job"],
+		Index:          e.Tags["index"],
+		IP:             e.Tags["ip"],
+		Origin:         e.Tags["origin"],
+		NozzleInstance: c.GetInstanceName(),
+	}
+	if e.Timestamp != 0 {
+		b.EventTime = time.Unix(0, int64(e.Timestamp))
+	}
+	if b.Deployment != "" && b.Job != "" && b.Index != "" {
+		b.SourceInstance = fmt.Sprintf("%s.%s.%s", b.Deployment, b.Job, b.Index)
+	}
+
+	tags := make(map[string]string)
+	for k, v := range e.Tags {
+		if !baseMessageTags[k] {
+			tags[k] = v
+		}
+	}
+	if len(tags) > 0 {
+		b.Tags.Values = tags
+	}
+	envelopeJson, _ := json.Marshal(e)
+	var hash = md5.Sum(envelopeJson) //nolint: gosec
+	b.MessageHash = hex.EncodeToString(hash[:])
+
+	return &b
+}
+
+// NewLogMessageV2 creates a new LogMessage from a V2 envelope
+func NewLogMessageV2(e *loggregator.Envelope, c caching.CachingClient) *LogMessage {
+	var r = LogMessage{
+		BaseMessage:    *NewBaseMessageV2(e, "LogMessage", c),
+		Message:        string(e.Log.Payload),
+		MessageType:    "OUT",
+		Timestamp:      int64(e.Timestamp),
+		AppID:          e.SourceId,
+		SourceType:     e.Tags["source_type"],
+		SourceInstance: e.InstanceId,
+	}
+	if e.Log.Type != "" {
+		r.MessageType = e.Log.Type
+	}
+	r.SourceTypeKey = r.SourceType + "-" + r.MessageType
+	if appID := e.AppID(); appID != "" {
+		var appInfo = c.GetAppInfo(appID)
+		if !appInfo.Forwards(caching.LogTypeLog) {
+			return nil
+		}
+		r.ApplicationName = appInfo.Name
+		r.ApplicationOrg = appInfo.Org
+		r.ApplicationOrgID = appInfo.OrgID
+		r.ApplicationSpace = appInfo.Space
+		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.Tags["process_type"])
+	}
+	return &r
+}
+
+// NewCounterEventV2 creates a new CounterEvent from a V2 envelope
+func NewCounterEventV2(e *loggregator.Envelope, c caching.CachingClient) *CounterEvent {
+	var r = CounterEvent{
+		BaseMessage: *NewBaseMessageV2(e, "CounterEvent", c),
+		Name:        e.Counter.Name,
+		Delta:       uint64(e.Counter.Delta),
+		Total:       uint64(e.Counter.Total),
+	}
+	r.CounterKey = fmt.Sprintf("%s.%s.%s", r.Job, r.Origin, r.Name)
+	return &r
+}
+
+// A Gauge holds all the metrics of a V2 gauge envelope in a single record
+type Gauge struct {
+	BaseMessage
+	SourceID           string
+	InstanceID         string
+	ApplicationID      string
+	ApplicationName    string
+	ApplicationOrg     string
+	ApplicationOrgID   string
+	ApplicationSpace   string
+	ApplicationSpaceID string
+	Metrics            map[string]interface{}
+	Units              map[string]string
+	AppMetadata        *AppMetadata `json:",omitempty"`
+}
+
+// NewGauge creates a new Gauge
+func NewGauge(e *loggregator.Envelope, c caching.CachingClient) *Gauge {
+	var r = Gauge{
+		BaseMessage: *NewBaseMessageV2(e, "Gauge", c),
+		SourceID:    e.SourceId,
+		InstanceID:  e.InstanceId,
+		Metrics:     make(map[string]interface{}),
+		Units:       make(map[string]string),
+	}
+	for name, metric := range e.Gauge.Metrics {
+		if metric == nil {
+			continue
+		}
+		r.Metrics[name] = jsonSafeFloat(metric.Value)
+		r.Units[name] = metric.Unit
+	}
+	if appID := e.AppID(); appID != "" {
+		var appInfo = c.GetAppInfo(appID)
+		if !appInfo.Forwards(caching.LogTypeMetric) {
+			return nil
+		}
+		r.ApplicationID = appID
+		r.ApplicationName = appInfo.Name
+		r.ApplicationOrg = appInfo.Org
+		r.ApplicationOrgID = appInfo.OrgID
+		r.ApplicationSpace = appInfo.Space
+		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.Tags["process_type"])
+	}
+	return &r
+}
+
+// A Timer records the start, stop and duration of an operation
+type Timer struct {
+	BaseMessage
+	SourceID           string
+	InstanceID         string
+	Name               string
+	StartTimestamp     int64
+	StopTimestamp      int64
+	Duration           int64 // nanoseconds
+	ApplicationID      string
+	ApplicationName    string
+	ApplicationOrg     string
+	ApplicationOrgID   string
+	ApplicationSpace   string
+	ApplicationSpaceID string
+	AppMetadata        *AppMetadata `json:",omitempty"`
+}
+
+// NewTimer creates a new Timer
+func NewTimer(e *loggregator.Envelope, c caching.CachingClient) *Timer {
+	var r = Timer{
+		BaseMessage:    *NewBaseMessageV2(e, "Timer", c),
+		SourceID:       e.SourceId,
+		InstanceID:     e.InstanceId,
+		Name:           e.Timer.Name,
+		StartTimestamp: int64(e.Timer.Start),
+		StopTimestamp:  int64(e.Timer.Stop),
+		Duration:       int64(e.Timer.Stop - e.Timer.Start),
+	}
+	if appID := e.AppID(); appID != "" {
+		var appInfo = c.GetAppInfo(appID)
+		if !appInfo.Forwards(caching.LogTypeHTTP) {
+			return nil
+		}
+		r.ApplicationID = appID
+		r.ApplicationName = appInfo.Name
+		r.ApplicationOrg = appInfo.Org
+		r.ApplicationOrgID = appInfo.OrgID
+		r.ApplicationSpace = appInfo.Space
+		r.ApplicationSpaceID = appInfo.SpaceID
+		r.AppMetadata = newAppMetadata(appInfo, e.Tags["process_type"])
+	}
+	return &r
+}
+
+// An Event is a free-form occurrence, such as a BOSH deployment or an app crash
+type Event struct {
+	BaseMessage
+	SourceID   string
+	InstanceID string
+	Title      string
+	Body       string
+}
+
+// NewEvent creates a new Event
+func NewEvent(e *loggregator.Envelope, c caching.CachingClient) *Event {
+	return &Event{
+		BaseMessage: *NewBaseMessageV2(e, "Event", c),
+		SourceID:    e.SourceId,
+		InstanceID:  e.InstanceId,
+		Title:       e.Event.Title,
+		Body:        e.Event.Body,
+	}
+}
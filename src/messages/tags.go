@@ -0,0 +1,134 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Tags holds the tags of an envelope, posted as a JSON object, or as a string in the former
+// Go map format, e.g. map[a:b c:d], if Legacy is set
+type Tags struct {
+	Values map[string]string
+	Legacy bool
+}
+
+func (t Tags) MarshalJSON() ([]byte, error) {
+	if t.Legacy {
+		if len(t.Values) == 0 {
+			return []byte(`""`), nil
+		}
+		return json.Marshal(fmt.Sprintf("%v", t.Values))
+	}
+	if t.Values == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(t.Values)
+}
+
+// TagsConfig configures how the tags of envelopes are posted
+type TagsConfig struct {
+	// post the tags in the former Go map format for existing queries and workbooks
+	Legacy bool
+	// keys of the tags also posted as columns of their own, named after the key
+	Promoted []string
+}
+
+var columnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// recordFields are the columns of the records of all event types, by lower case name, as Log
+// Analytics does not tell columns apart by case
+var recordFields = jsonFields(BaseMessage{}, HTTPStartStop{}, LogMessage{}, Error{}, ContainerMetric{},
+	CounterEvent{}, ValueMetric{}, Gauge{}, Timer{}, Event{})
+
+// Validate checks that the promoted tags make valid column names that are not taken by the
+// fields of records
+func (c *TagsConfig) Validate() error {
+	for _, key := range c.Promoted {
+		if !columnName.MatchString(key) {
+			return fmt.Errorf("tag %q cannot be promoted to a column, column names consist of letters, digits and underscores", key)
+		}
+		if field, ok := recordFields[strings.ToLower(key)]; ok {
+			return fmt.Errorf("tag %q cannot be promoted to a column, records already have a %s column", key, field)
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the names of the JSON fields of messages, including those of embedded
+// structs, by lower case name
+func jsonFields(messages ...interface{}) map[string]string {
+	fields := make(map[string]string)
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				add(f.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" || !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[strings.ToLower(name)] = name
+		}
+	}
+	for _, m := range messages {
+		add(reflect.TypeOf(m))
+	}
+	return fields
+}
+
+// tagged is implemented by the messages embedding BaseMessage
+type tagged interface {
+	baseMessage() *BaseMessage
+}
+
+func (b *BaseMessage) baseMessage() *BaseMessage {
+	return b
+}
+
+// Marshal serializes msg, a pointer to a message struct, with the tags of its envelope posted
+// as configured
+func (c *TagsConfig) Marshal(msg interface{}) ([]byte, error) {
+	m, ok := msg.(tagged)
+	if !ok {
+		return json.Marshal(msg)
+	}
+	b := m.baseMessage()
+	b.Tags.Legacy = c.Legacy
+	record, err := json.Marshal(msg)
+	if err != nil || len(c.Promoted) == 0 {
+		return record, err
+	}
+	// append the promoted tags to the JSON object, as struct fields cannot be added at runtime
+	var columns bytes.Buffer
+	for _, key := range c.Promoted {
+		value, ok := b.Tags.Values[key]
+		if !ok {
+			continue
+		}
+		v, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&columns, `,"%s":%s`, key, v)
+	}
+	if columns.Len() == 0 {
+		return record, nil
+	}
+	promoted := make([]byte, 0, len(record)+columns.Len())
+	promoted = append(promoted, record[:len(record)-1]...)
+	promoted = append(promoted, columns.Bytes()...)
+	return append(promoted, '}'), nil
+}
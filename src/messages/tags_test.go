@@ -0,0 +1,87 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+)
+
+var _ = Describe("Tags", func() {
+	var (
+		config *messages.TagsConfig
+		msg    *messages.Error
+	)
+
+	BeforeEach(func() {
+		config = &messages.TagsConfig{}
+		msg = &messages.Error{
+			BaseMessage: messages.BaseMessage{
+				EventType: "Error",
+				Tags: messages.Tags{Values: map[string]string{
+					"source_id":     "app-guid",
+					"placement_tag": "isolated",
+					"product":       `VMware "Tanzu"`,
+				}},
+			},
+			Message: "failed",
+		}
+	})
+
+	It("posts the tags as a JSON object", func() {
+		record, err := config.Marshal(msg)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"Tags":{"placement_tag":"isolated","product":"VMware \"Tanzu\"","source_id":"app-guid"}`))
+	})
+
+	It("posts no tags as an empty JSON object", func() {
+		msg.Tags.Values = nil
+
+		record, err := config.Marshal(msg)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"Tags":{}`))
+	})
+
+	It("posts the tags in the legacy format", func() {
+		config.Legacy = true
+
+		record, err := config.Marshal(msg)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"Tags":"map[placement_tag:isolated product:VMware \"Tanzu\" source_id:app-guid]"`))
+
+		msg.Tags.Values = nil
+		record, err = config.Marshal(msg)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(ContainSubstring(`"Tags":""`))
+	})
+
+	It("promotes tags to columns of their own", func() {
+		config.Promoted = []string{"source_id", "product", "missing"}
+
+		record, err := config.Marshal(msg)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(record)).To(HaveSuffix(`"Message":"failed","source_id":"app-guid","product":"VMware \"Tanzu\""}`))
+		Expect(string(record)).NotTo(ContainSubstring(`"missing"`))
+	})
+
+	It("rejects promoted tags that are not valid column names", func() {
+		Expect((&messages.TagsConfig{Promoted: []string{"source_id", "_Tag1"}}).Validate()).To(Succeed())
+		Expect((&messages.TagsConfig{Promoted: []string{"source-id"}}).Validate()).To(MatchError(ContainSubstring(`"source-id"`)))
+		Expect((&messages.TagsConfig{Promoted: []string{"1st"}}).Validate()).To(HaveOccurred())
+	})
+
+	It("rejects promoted tags that collide with the columns of records", func() {
+		Expect((&messages.TagsConfig{Promoted: []string{"job"}}).Validate()).To(MatchError(ContainSubstring(`records already have a Job column`)))
+		Expect((&messages.TagsConfig{Promoted: []string{"Message"}}).Validate()).To(HaveOccurred())
+		Expect((&messages.TagsConfig{Promoted: []string{"origin"}}).Validate()).To(HaveOccurred())
+		Expect((&messages.TagsConfig{Promoted: []string{"tags"}}).Validate()).To(HaveOccurred())
+		Expect((&messages.TagsConfig{Promoted: []string{"source_id", "placement_tag"}}).Validate()).To(Succeed())
+	})
+})
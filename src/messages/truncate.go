@@ -0,0 +1,114 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages
+
+import (
+	"reflect"
+	"unicode/utf8"
+)
+
+// TruncateFields shortens every string field of msg, a pointer to a message struct, to at most
+// maxBytes bytes without splitting UTF-8 characters. Fields of embedded structs such as
+// BaseMessage are truncated as well, and so are the strings in the maps, slices and structs
+// posted as dynamic columns, such as Tags, LogFields and AppMetadata. It returns whether any
+// field was truncated.
+func TruncateFields(msg interface{}, maxBytes int) bool {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false
+	}
+	return truncateStruct(v.Elem(), maxBytes)
+}
+
+func truncateStruct(v reflect.Value, maxBytes int) bool {
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	truncated := false
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		if field.Kind() == reflect.Struct {
+			if truncateStruct(field, maxBytes) {
+				truncated = true
+			}
+			continue
+		}
+		if value, ok := truncateValue(field, maxBytes); ok {
+			field.Set(value)
+			truncated = true
+		}
+	}
+	return truncated
+}
+
+// truncateValue returns v with its strings truncated, and whether any was. Maps, slices and
+// pointed structs are copied rather than changed, as messages share them with the app cache.
+func truncateValue(v reflect.Value, maxBytes int) (reflect.Value, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		if s := v.String(); len(s) > maxBytes {
+			return reflect.ValueOf(truncateString(s, maxBytes)).Convert(v.Type()), true
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			return truncateValue(v.Elem(), maxBytes)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+			copied := reflect.New(v.Elem().Type())
+			copied.Elem().Set(v.Elem())
+			if truncateStruct(copied.Elem(), maxBytes) {
+				return copied, true
+			}
+		}
+	case reflect.Map:
+		var copied reflect.Value
+		iter := v.MapRange()
+		for iter.Next() {
+			value, ok := truncateValue(iter.Value(), maxBytes)
+			if !ok {
+				continue
+			}
+			if !copied.IsValid() {
+				copied = reflect.MakeMapWithSize(v.Type(), v.Len())
+				for _, key := range v.MapKeys() {
+					copied.SetMapIndex(key, v.MapIndex(key))
+				}
+			}
+			copied.SetMapIndex(iter.Key(), value)
+		}
+		if copied.IsValid() {
+			return copied, true
+		}
+	case reflect.Slice:
+		var copied reflect.Value
+		for i := 0; i < v.Len(); i++ {
+			value, ok := truncateValue(v.Index(i), maxBytes)
+			if !ok {
+				continue
+			}
+			if !copied.IsValid() {
+				copied = reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+				reflect.Copy(copied, v)
+			}
+			copied.Index(i).Set(value)
+		}
+		if copied.IsValid() {
+			return copied, true
+		}
+	}
+	return v, false
+}
+
+// truncateString cuts s, which is longer than maxBytes, at the last UTF-8 character boundary within maxBytes
+func truncateString(s string, maxBytes int) string {
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package messages_test
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+)
+
+var _ = Describe("TruncateFields", func() {
+	It("truncates long string fields, including those of the BaseMessage", func() {
+		m := &messages.LogMessage{
+			BaseMessage: messages.BaseMessage{Job: strings.Repeat("t", 20)},
+			Message:     strings.Repeat("m", 20),
+			AppID:       "app-guid",
+		}
+
+		Expect(messages.TruncateFields(m, 10)).To(BeTrue())
+
+		Expect(m.Message).To(Equal(strings.Repeat("m", 10)))
+		Expect(m.Job).To(Equal(strings.Repeat("t", 10)))
+		Expect(m.AppID).To(Equal("app-guid"))
+	})
+
+	It("truncates the strings of tags, log fields and app metadata without changing shared maps", func() {
+		labels := map[string]string{"team": strings.Repeat("l", 20), "env": "prod"}
+		m := &messages.LogMessage{
+			BaseMessage: messages.BaseMessage{Tags: messages.Tags{Values: map[string]string{"deployment": strings.Repeat("d", 20)}}},
+			LogFields: map[string]interface{}{
+				"stack": strings.Repeat("s", 20),
+				"http":  map[string]interface{}{"path": strings.Repeat("p", 20), "status": 200.0},
+				"ids":   []interface{}{strings.Repeat("i", 20)},
+			},
+			AppMetadata: &messages.AppMetadata{Labels: labels},
+		}
+		metadata := m.AppMetadata
+
+		Expect(messages.TruncateFields(m, 10)).To(BeTrue())
+
+		Expect(m.Tags.Values).To(Equal(map[string]string{"deployment": strings.Repeat("d", 10)}))
+		Expect(m.LogFields).To(Equal(map[string]interface{}{
+			"stack": strings.Repeat("s", 10),
+			"http":  map[string]interface{}{"path": strings.Repeat("p", 10), "status": 200.0},
+			"ids":   []interface{}{strings.Repeat("i", 10)},
+		}))
+		Expect(m.AppMetadata.Labels).To(Equal(map[string]string{"team": strings.Repeat("l", 10), "env": "prod"}))
+		// the labels of the app cache are left as they are
+		Expect(labels["team"]).To(Equal(strings.Repeat("l", 20)))
+		Expect(metadata.Labels["team"]).To(Equal(strings.Repeat("l", 20)))
+	})
+
+	It("leaves short fields alone", func() {
+		m := &messages.Error{Message: "short"}
+
+		Expect(messages.TruncateFields(m, 10)).To(BeFalse())
+		Expect(m.Message).To(Equal("short"))
+	})
+
+	It("does not split UTF-8 characters", func() {
+		m := &messages.Error{Message: "aaaaaaaaa€"}
+
+		Expect(messages.TruncateFields(m, 10)).To(BeTrue())
+
+		Expect(m.Message).To(Equal("aaaaaaaaa"))
+		Expect(utf8.ValidString(m.Message)).To(BeTrue())
+	})
+})
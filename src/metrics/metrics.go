@@ -0,0 +1,280 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics exposes the self-telemetry of the nozzle in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram buckets for durations in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds metrics and serves them over HTTP. All methods may be called on a nil
+// Registry, in which case the metrics work but are not exposed.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+func (r *Registry) register(name string, help string, typ string, m metric) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = &described{help: help, typ: typ, metric: m}
+}
+
+// Counter registers a counter with the given label names
+func (r *Registry) Counter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{series: newSeries(labelNames)}
+	r.register(name, help, "counter", c)
+	return c
+}
+
+// CounterFunc registers a counter whose value is read from f
+func (r *Registry) CounterFunc(name string, help string, f func() float64) {
+	r.register(name, help, "counter", valueFunc(f))
+}
+
+// GaugeFunc registers a gauge whose value is read from f
+func (r *Registry) GaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, "gauge", valueFunc(f))
+}
+
+// Histogram registers a histogram with the given upper bounds of buckets and label names
+func (r *Registry) Histogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{buckets: append([]float64(nil), buckets...), series: newSeries(labelNames)}
+	sort.Float64s(h.buckets)
+	r.register(name, help, "histogram", h)
+	return h
+}
+
+// ServeHTTP writes all metrics, sorted by name
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mutex.Unlock()
+
+	for i, m := range metrics {
+		m.write(buf, names[i])
+	}
+}
+
+type described struct {
+	help   string
+	typ    string
+	metric metric
+}
+
+func (d *described) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, d.typ)
+	d.metric.write(w, name)
+}
+
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+// series holds the values of a metric by label values
+type series struct {
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]interface{} // by joined label values
+	labels     map[string]string      // formatted labels by joined label values
+}
+
+func newSeries(labelNames []string) *series {
+	return &series{
+		labelNames: labelNames,
+		values:     make(map[string]interface{}),
+		labels:     make(map[string]string),
+	}
+}
+
+// get returns the value for labelValues, creating it with create if missing. Callers hold the mutex.
+func (s *series) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(s.labelNames) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(s.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v, ok := s.values[key]
+	if !ok {
+		v = create()
+		s.values[key] = v
+		pairs := make([]string, len(labelValues))
+		for i, value := range labelValues {
+			pairs[i] = s.labelNames[i] + `="` + escapeLabelValue(value) + `"`
+		}
+		s.labels[key] = strings.Join(pairs, ",")
+	}
+	return v
+}
+
+// sortedKeys returns the keys of values sorted by their formatted labels. Callers hold the mutex.
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return s.labels[keys[i]] < s.labels[keys[j]] })
+	return keys
+}
+
+// Counter is a monotonically increasing value per label values
+type Counter struct {
+	*series
+}
+
+// Inc increments the counter for labelValues by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for labelValues by v
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	value := c.get(labelValues, func() interface{} { return new(float64) }).(*float64)
+	*value += v
+}
+
+// Value returns the counter for labelValues
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if value, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return *value.(*float64)
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", name, braced(c.labels[key]), formatFloat(*c.values[key].(*float64)))
+	}
+}
+
+// Histogram counts observations in buckets per label values
+type Histogram struct {
+	buckets []float64
+	*series
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Observe adds v to the histogram for labelValues
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	value := h.get(labelValues, func() interface{} {
+		return &histogramValue{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramValue)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		value.counts[i]++
+	}
+	value.count++
+	value.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, key := range h.sortedKeys() {
+		labels := h.labels[key]
+		value := h.values[key].(*histogramValue)
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braced(joinLabels(labels, `le="`+formatFloat(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braced(joinLabels(labels, `le="+Inf"`)), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braced(labels), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braced(labels), value.count)
+	}
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels string, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
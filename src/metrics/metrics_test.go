@@ -0,0 +1,87 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
+)
+
+func scrape(registry *metrics.Registry) string {
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	Expect(recorder.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4; charset=utf-8"))
+	return recorder.Body.String()
+}
+
+var _ = Describe("Registry", func() {
+	var registry *metrics.Registry
+
+	BeforeEach(func() {
+		registry = metrics.NewRegistry()
+	})
+
+	It("writes counters with labels sorted", func() {
+		c := registry.Counter("lookups_total", "Lookups\nof apps", "result")
+		c.Inc("miss")
+		c.Add(2, "hit")
+		c.Inc(`quote"d`)
+
+		Expect(scrape(registry)).To(Equal(`# HELP lookups_total Lookups\nof apps
+# TYPE lookups_total counter
+lookups_total{result="hit"} 2
+lookups_total{result="miss"} 1
+lookups_total{result="quote\"d"} 1
+`))
+		Expect(c.Value("hit")).To(Equal(float64(2)))
+		Expect(c.Value("unknown")).To(BeZero())
+	})
+
+	It("writes functions and sorts metrics by name", func() {
+		registry.GaugeFunc("b_length", "Length", func() float64 { return 3 })
+		registry.CounterFunc("a_total", "Total", func() float64 { return 1.5 })
+
+		Expect(scrape(registry)).To(Equal(`# HELP a_total Total
+# TYPE a_total counter
+a_total 1.5
+# HELP b_length Length
+# TYPE b_length gauge
+b_length 3
+`))
+	})
+
+	It("writes cumulative histogram buckets", func() {
+		h := registry.Histogram("duration_seconds", "Duration", []float64{1, 0.1}, "type")
+		h.Observe(0.05, "log")
+		h.Observe(0.5, "log")
+		h.Observe(5, "log")
+
+		Expect(scrape(registry)).To(Equal(`# HELP duration_seconds Duration
+# TYPE duration_seconds histogram
+duration_seconds_bucket{type="log",le="0.1"} 1
+duration_seconds_bucket{type="log",le="1"} 2
+duration_seconds_bucket{type="log",le="+Inf"} 3
+duration_seconds_sum{type="log"} 5.55
+duration_seconds_count{type="log"} 3
+`))
+	})
+
+	It("rejects metrics registered twice", func() {
+		registry.Counter("total", "Total")
+
+		Expect(func() { registry.Counter("total", "Total") }).To(Panic())
+	})
+
+	It("works without a registry", func() {
+		var nilRegistry *metrics.Registry
+		c := nilRegistry.Counter("total", "Total")
+		c.Inc()
+
+		Expect(c.Value()).To(Equal(float64(1)))
+		Expect(scrape(nilRegistry)).To(BeEmpty())
+	})
+})
@@ -3,12 +3,19 @@
 
 package mocks
 
-import "github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+import (
+	"sync/atomic"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
+)
 
 type MockCaching struct {
-	MockGetAppInfo  func(string) caching.AppInfo
+	MockGetAppInfo func(string) caching.AppInfo
+	// MockInitialized, if set, overrides whether Initialize has been called
+	MockInitialized func() bool
 	InstanceName    string
 	EnvironmentName string
+	initialized     atomic.Bool
 }
 
 func (c *MockCaching) GetAppInfo(appGuid string) caching.AppInfo {
@@ -24,4 +31,12 @@ func (c *MockCaching) GetEnvironmentName() string {
 }
 
 func (c *MockCaching) Initialize() {
+	c.initialized.Store(true)
+}
+
+func (c *MockCaching) Initialized() bool {
+	if c.MockInitialized != nil {
+		return c.MockInitialized()
+	}
+	return c.initialized.Load()
 }
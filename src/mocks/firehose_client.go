@@ -5,17 +5,20 @@ package mocks
 
 import (
 	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
 )
 
 type MockFirehoseClient struct {
-	MessageChan chan *events.Envelope
-	ErrChan     chan error
+	MessageChan   chan *events.Envelope
+	V2MessageChan chan *loggregator.Envelope
+	ErrChan       chan error
 }
 
 func NewMockFirehoseClient() *MockFirehoseClient {
 	return &MockFirehoseClient{
-		MessageChan: make(chan *events.Envelope),
-		ErrChan:     make(chan error),
+		MessageChan:   make(chan *events.Envelope),
+		V2MessageChan: make(chan *loggregator.Envelope),
+		ErrChan:       make(chan error),
 	}
 }
 
@@ -23,6 +26,10 @@ func (c *MockFirehoseClient) Connect() (<-chan *events.Envelope, <-chan error) {
 	return c.MessageChan, c.ErrChan
 }
 
+func (c *MockFirehoseClient) ConnectV2() (<-chan *loggregator.Envelope, <-chan error) {
+	return c.V2MessageChan, c.ErrChan
+}
+
 func (c *MockFirehoseClient) CloseConsumer() error {
 	return nil
 }
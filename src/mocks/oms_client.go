@@ -3,24 +3,37 @@
 
 package mocks
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
 type MockOmsClient struct {
+	// MockPostData, if set, is called before a message is recorded; a returned error fails the post
+	MockPostData   func(msg *[]byte, logType string) error
 	postedMessages map[string]string
+	allPosts       map[string][]string
 	mutex          sync.Mutex
 }
 
 func NewMockOmsClient() *MockOmsClient {
 	return &MockOmsClient{
 		postedMessages: make(map[string]string),
+		allPosts:       make(map[string][]string),
 	}
 }
 
 func (c *MockOmsClient) PostData(msg *[]byte, logType string) error {
+	if c.MockPostData != nil {
+		if err := c.MockPostData(msg, logType); err != nil {
+			return err
+		}
+	}
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	c.postedMessages[logType] = string(*msg)
+	c.allPosts[logType] = append(c.allPosts[logType], string(*msg))
 	return nil
 }
 
@@ -30,3 +43,12 @@ func (c *MockOmsClient) GetPostedMessages(key string) string {
 
 	return c.postedMessages[key]
 }
+
+// GetAllPostedMessages returns every post of a log type, one per line, for events that may be
+// posted in several batches
+func (c *MockOmsClient) GetAllPostedMessages(key string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return strings.Join(c.allPosts[key], "\n")
+}
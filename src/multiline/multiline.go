@@ -0,0 +1,218 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package multiline joins the lines of multiline app logs, such as stack traces, into single
+// records. Loggregator sends each line of a log as a LogMessage of its own, so an Assembler keeps
+// the lines of each app instance and source together until a line matching the start pattern
+// begins the next record:
+//
+//	2024-01-01 12:00:00 ERROR Request failed         <- start
+//	java.lang.IllegalStateException: boom            <- continuation
+//	    at com.example.Orders.place(Orders.java:42)  <- continuation
+//	2024-01-01 12:00:01 INFO Request served          <- start
+//
+// Records are also emitted once they reach the max number of lines or bytes, or once no line
+// was added to them for the max wait.
+package multiline
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+)
+
+// Config configures an Assembler
+type Config struct {
+	// lines matching it start a record, the others continue the record of the line before
+	StartPattern *regexp.Regexp
+	// records are emitted once they have this many lines
+	MaxLines int
+	// records are emitted before they exceed this size, counting the new lines joining their lines
+	MaxBytes int
+	// records are emitted once no line was added to them for this long
+	MaxWait time.Duration
+}
+
+// Validate returns an error if the config is incomplete
+func (c Config) Validate() error {
+	switch {
+	case c.StartPattern == nil:
+		return fmt.Errorf("a start pattern is required")
+	case c.MaxLines <= 0 || c.MaxBytes <= 0:
+		return fmt.Errorf("the max number of lines and bytes must be positive")
+	case c.MaxWait <= 0:
+		return fmt.Errorf("the max wait must be positive")
+	}
+	return nil
+}
+
+// EmitFunc receives the records of an Assembler, the number of lines joined into them and the
+// output added with their earliest line
+type EmitFunc func(m *messages.LogMessage, lines int, output string)
+
+// Assembler joins the lines of app logs into records and passes them to its EmitFunc. Logs that
+// are not from apps are passed on as they are. It is safe for concurrent use.
+type Assembler struct {
+	config   Config
+	emit     EmitFunc
+	mutex    sync.Mutex
+	pending  map[source]*record
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+}
+
+// source identifies the stream of lines of an app instance
+type source struct {
+	appID          string
+	sourceType     string
+	sourceInstance string
+	messageType    string
+}
+
+type record struct {
+	first     *messages.LogMessage // of the first line
+	output    string               // of the first line
+	start     bool                 // whether the first line matches the start pattern
+	lines     []line               // the start line, then the other lines in order of timestamp
+	bytes     int
+	lastAdded time.Time
+}
+
+type line struct {
+	text      string
+	timestamp int64
+}
+
+// NewAssembler creates an Assembler, which must be closed to emit the records it holds. config
+// must be valid.
+func NewAssembler(config Config, emit EmitFunc) *Assembler {
+	a := &Assembler{
+		config:   config,
+		emit:     emit,
+		pending:  make(map[source]*record),
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	go a.emitIdleRecords()
+	return a
+}
+
+// Add adds a log line and the output it is routed to, emitting the records it completes. Records
+// are emitted with the output of their first line.
+func (a *Assembler) Add(m *messages.LogMessage, output string) {
+	if m.AppID == "" || !strings.HasPrefix(m.SourceType, "APP") {
+		a.emit(m, 1, output)
+		return
+	}
+	key := source{appID: m.AppID, sourceType: m.SourceType, sourceInstance: m.SourceInstance, messageType: m.MessageType}
+	l := line{text: m.Message, timestamp: m.Timestamp}
+	starts := a.config.StartPattern.MatchString(l.text)
+	var completed []*record
+
+	a.mutex.Lock()
+	r := a.pending[key]
+	if r != nil && (starts || r.bytes+1+len(l.text) > a.config.MaxBytes) {
+		completed = append(completed, r)
+		r = nil
+	}
+	if r == nil {
+		r = &record{start: starts}
+		a.pending[key] = r
+	}
+	r.add(m, l, output)
+	if len(r.lines) >= a.config.MaxLines || r.bytes >= a.config.MaxBytes {
+		completed = append(completed, r)
+		delete(a.pending, key)
+	}
+	a.mutex.Unlock()
+
+	for _, r := range completed {
+		a.emitRecord(r)
+	}
+}
+
+// add adds l, the line of m. The nozzle processes envelopes concurrently, so the lines after the
+// start line are put in order of timestamp. The record keeps the fields and output of its first
+// line.
+func (r *record) add(m *messages.LogMessage, l line, output string) {
+	offset := 0
+	if r.start && len(r.lines) > 0 {
+		offset = 1
+	}
+	i := offset + sort.Search(len(r.lines)-offset, func(i int) bool { return r.lines[offset+i].timestamp > l.timestamp })
+	if i == 0 {
+		r.first = m
+		r.output = output
+	}
+	r.lines = append(r.lines, line{})
+	copy(r.lines[i+1:], r.lines[i:])
+	r.lines[i] = l
+	if len(r.lines) > 1 {
+		r.bytes++
+	}
+	r.bytes += len(l.text)
+	r.lastAdded = time.Now()
+}
+
+func (a *Assembler) emitRecord(r *record) {
+	texts := make([]string, len(r.lines))
+	for i, l := range r.lines {
+		texts[i] = l.text
+	}
+	m := r.first
+	m.Message = strings.Join(texts, "\n")
+	a.emit(m, len(r.lines), r.output)
+}
+
+// emitIdleRecords emits the records that waited for a line for the max wait, until the
+// Assembler is closed
+func (a *Assembler) emitIdleRecords() {
+	defer close(a.doneChan)
+	ticker := time.NewTicker(a.config.MaxWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.emitPending(false)
+		case <-a.stopChan:
+			return
+		}
+	}
+}
+
+// emitPending emits the records that waited for a line for the max wait, or all records
+func (a *Assembler) emitPending(all bool) {
+	idleSince := time.Now().Add(-a.config.MaxWait)
+	var idle []*record
+	a.mutex.Lock()
+	for key, r := range a.pending {
+		if all || r.lastAdded.Before(idleSince) {
+			idle = append(idle, r)
+			delete(a.pending, key)
+		}
+	}
+	a.mutex.Unlock()
+
+	for _, r := range idle {
+		a.emitRecord(r)
+	}
+}
+
+// Close emits all records and stops the Assembler. Lines must not be added afterwards. It does
+// nothing if a is nil or already closed.
+func (a *Assembler) Close() {
+	if a == nil {
+		return
+	}
+	a.stopOnce.Do(func() {
+		close(a.stopChan)
+		<-a.doneChan
+		a.emitPending(true)
+	})
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package multiline_test
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/multiline"
+)
+
+var _ = Describe("Assembler", func() {
+	var (
+		config    multiline.Config
+		assembler *multiline.Assembler
+		mutex     sync.Mutex
+		emitted   []*messages.LogMessage
+		outputs   []string
+		timestamp int64
+	)
+
+	records := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		texts := make([]string, len(emitted))
+		for i, m := range emitted {
+			texts[i] = m.SourceInstance + ": " + m.Message
+		}
+		return texts
+	}
+
+	logLine := func(instance string, message string) *messages.LogMessage {
+		timestamp++
+		return &messages.LogMessage{
+			Message:        message,
+			MessageType:    "OUT",
+			Timestamp:      timestamp,
+			AppID:          "app-guid",
+			SourceType:     "APP/PROC/WEB",
+			SourceInstance: instance,
+		}
+	}
+
+	start := func() {
+		assembler = multiline.NewAssembler(config, func(m *messages.LogMessage, lines int, output string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			emitted = append(emitted, m)
+			outputs = append(outputs, output)
+		})
+	}
+
+	BeforeEach(func() {
+		config = multiline.Config{
+			StartPattern: regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `),
+			MaxLines:     100,
+			MaxBytes:     1024,
+			MaxWait:      time.Hour,
+		}
+		emitted = nil
+		outputs = nil
+		timestamp = 0
+	})
+
+	AfterEach(func() {
+		assembler.Close()
+	})
+
+	It("joins continuation lines into the record of their start line", func() {
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR Request failed"), "default")
+		assembler.Add(logLine("0", "java.lang.IllegalStateException: boom"), "default")
+		assembler.Add(logLine("0", "\tat com.example.Orders.place(Orders.java:42)"), "default")
+		assembler.Add(logLine("0", "Caused by: java.io.IOException: closed"), "default")
+		assembler.Add(logLine("0", "\t... 12 more"), "default")
+		Expect(records()).To(BeEmpty())
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:01 INFO Request served"), "default")
+		Expect(records()).To(Equal([]string{
+			"0: 2024-01-01 12:00:00 ERROR Request failed\njava.lang.IllegalStateException: boom\n" +
+				"\tat com.example.Orders.place(Orders.java:42)\nCaused by: java.io.IOException: closed\n\t... 12 more",
+		}))
+	})
+
+	It("keeps the lines of interleaved app instances apart", func() {
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR instance 0 failed"), "default")
+		assembler.Add(logLine("1", "2024-01-01 12:00:00 ERROR instance 1 failed"), "default")
+		assembler.Add(logLine("0", "\tat instance0.main"), "default")
+		assembler.Add(logLine("1", "\tat instance1.main"), "default")
+		other := logLine("0", "2024-01-01 12:00:00 ERROR other app failed")
+		other.AppID = "other-app-guid"
+		assembler.Add(other, "default")
+		assembler.Add(logLine("1", "2024-01-01 12:00:01 INFO instance 1 served"), "default")
+		stderr := logLine("0", "\tat instance0.stderr")
+		stderr.MessageType = "ERR"
+		assembler.Add(stderr, "default")
+		assembler.Add(logLine("0", "\tat instance0.run"), "default")
+		assembler.Add(logLine("0", "2024-01-01 12:00:01 INFO instance 0 served"), "default")
+		assembler.Close()
+
+		Expect(records()).To(ConsistOf(
+			"0: 2024-01-01 12:00:00 ERROR instance 0 failed\n\tat instance0.main\n\tat instance0.run",
+			"1: 2024-01-01 12:00:00 ERROR instance 1 failed\n\tat instance1.main",
+			"0: 2024-01-01 12:00:00 ERROR other app failed",
+			"0: \tat instance0.stderr",
+			"1: 2024-01-01 12:00:01 INFO instance 1 served",
+			"0: 2024-01-01 12:00:01 INFO instance 0 served",
+		))
+	})
+
+	It("emits records once they reach the max number of lines", func() {
+		config.MaxLines = 2
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR Request failed"), "default")
+		assembler.Add(logLine("0", "\tat first"), "default")
+		assembler.Add(logLine("0", "\tat second"), "default")
+
+		Expect(records()).To(Equal([]string{"0: 2024-01-01 12:00:00 ERROR Request failed\n\tat first"}))
+	})
+
+	It("emits records before they exceed the max size", func() {
+		config.MaxBytes = 20
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 failed"), "default")
+		assembler.Add(logLine("0", "\tat first"), "default")
+		Expect(records()).To(Equal([]string{"0: 2024-01-01 failed"}))
+
+		assembler.Add(logLine("0", "\tat second"), "default")
+		assembler.Add(logLine("0", "a line over the max size"), "default")
+		Expect(records()).To(Equal([]string{
+			"0: 2024-01-01 failed",
+			"0: \tat first\n\tat second",
+			"0: a line over the max size",
+		}))
+	})
+
+	It("emits records once no line was added to them for the max wait", func() {
+		config.MaxWait = 50 * time.Millisecond
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR Request failed"), "default")
+		assembler.Add(logLine("0", "\tat first"), "default")
+		Consistently(records, 20*time.Millisecond).Should(BeEmpty())
+
+		Eventually(records).Should(Equal([]string{"0: 2024-01-01 12:00:00 ERROR Request failed\n\tat first"}))
+	})
+
+	It("puts the lines processed out of order back in order", func() {
+		start()
+
+		failed := logLine("0", "2024-01-01 12:00:00 ERROR Request failed")
+		first := logLine("0", "\tat first")
+		second := logLine("0", "\tat second")
+		served := logLine("0", "2024-01-01 12:00:01 INFO Request served")
+		assembler.Add(failed, "default")
+		assembler.Add(second, "default")
+		assembler.Add(first, "default")
+		assembler.Add(served, "default")
+
+		Expect(records()).To(Equal([]string{"0: 2024-01-01 12:00:00 ERROR Request failed\n\tat first\n\tat second"}))
+	})
+
+	It("keeps the fields and output of the earliest line of records without a start line", func() {
+		start()
+
+		first := logLine("0", "\tat first")
+		second := logLine("0", "\tat second")
+		assembler.Add(second, "default")
+		assembler.Add(first, "payments")
+		assembler.Close()
+
+		Expect(records()).To(Equal([]string{"0: \tat first\n\tat second"}))
+		Expect(emitted[0].Timestamp).To(Equal(first.Timestamp))
+		Expect(outputs).To(Equal([]string{"payments"}))
+	})
+
+	It("starts a record with every start line, even one processed late", func() {
+		start()
+
+		failed := logLine("0", "2024-01-01 12:00:00 ERROR Request failed")
+		retried := logLine("0", "2024-01-01 12:00:00 WARN Request retried")
+		stack := logLine("0", "\tat first")
+		served := logLine("0", "2024-01-01 12:00:01 INFO Request served")
+		assembler.Add(failed, "default")
+		assembler.Add(stack, "default")
+		assembler.Add(retried, "payments")
+		assembler.Add(served, "default")
+
+		Expect(records()).To(Equal([]string{
+			"0: 2024-01-01 12:00:00 ERROR Request failed\n\tat first",
+			"0: 2024-01-01 12:00:00 WARN Request retried",
+		}))
+		Expect(outputs).To(Equal([]string{"default", "payments"}))
+	})
+
+	It("passes the logs that are not from apps on as they are", func() {
+		start()
+
+		router := logLine("0", "\tnot a continuation")
+		router.SourceType = "RTR"
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR Request failed"), "default")
+		assembler.Add(router, "default")
+
+		Expect(records()).To(Equal([]string{"0: \tnot a continuation"}))
+	})
+
+	It("emits all records when closed", func() {
+		start()
+
+		assembler.Add(logLine("0", "2024-01-01 12:00:00 ERROR Request failed"), "default")
+		assembler.Add(logLine("1", "\tat orphan"), "default")
+		assembler.Close()
+
+		Expect(records()).To(ConsistOf("0: 2024-01-01 12:00:00 ERROR Request failed", "1: \tat orphan"))
+	})
+
+	It("validates configs", func() {
+		assembler = nil
+		Expect(config.Validate()).To(Succeed())
+		config.StartPattern = nil
+		Expect(config.Validate()).To(HaveOccurred())
+		Expect(multiline.Config{StartPattern: regexp.MustCompile("^"), MaxLines: 1, MaxBytes: 1}.Validate()).To(HaveOccurred())
+	})
+})
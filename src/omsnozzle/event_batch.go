@@ -0,0 +1,54 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package omsnozzle
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// eventBatch holds the serialized records of one log type that are pending to be posted
+type eventBatch struct {
+	records []json.RawMessage
+	size    int // size of the records as a JSON array
+}
+
+// sizeWith returns the size the batch would have with record added
+func (b *eventBatch) sizeWith(record json.RawMessage) int {
+	if len(b.records) == 0 {
+		return len(record) + 2 // brackets
+	}
+	return b.size + len(record) + 1 // comma
+}
+
+func (b *eventBatch) add(record json.RawMessage) {
+	b.size = b.sizeWith(record)
+	b.records = append(b.records, record)
+}
+
+// marshal returns the records as a JSON array
+func (b *eventBatch) marshal() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, b.size))
+	buf.WriteByte('[')
+	for i, record := range b.records {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(record)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// eventBatches holds the pending batches by log type
+type eventBatches map[string]*eventBatch
+
+func (b eventBatches) add(msgType string, record json.RawMessage) {
+	batch, ok := b[msgType]
+	if !ok {
+		batch = &eventBatch{}
+		b[msgType] = batch
+	}
+	batch.add(record)
+}
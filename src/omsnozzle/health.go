@@ -0,0 +1,140 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package omsnozzle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// names of the checks in a HealthStatus
+const (
+	firehoseCheck = "firehose"
+	omsCheck      = "oms"
+	cacheCheck    = "cache"
+)
+
+// HealthConfig configures when the nozzle reports itself unhealthy
+type HealthConfig struct {
+	// max time without receiving an envelope from the firehose; zero disables the check
+	MaxEnvelopeAge time.Duration
+	// max time posts keep failing since the last successful post; zero disables the check
+	MaxPostFailureAge time.Duration
+}
+
+// HealthCheck is the result of a single check
+type HealthCheck struct {
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message"`
+}
+
+// HealthStatus is the result of all checks, healthy if all of them are
+type HealthStatus struct {
+	Healthy bool                   `json:"healthy"`
+	Checks  map[string]HealthCheck `json:"checks"`
+}
+
+func (s *HealthStatus) add(name string, check HealthCheck) {
+	s.Checks[name] = check
+	s.Healthy = s.Healthy && check.Healthy
+}
+
+// Health reports whether the nozzle is receiving envelopes and posting them. A nozzle that is
+// still loading the app cache is healthy, as it has not started reading from the firehose yet.
+func (o *OmsNozzle) Health() HealthStatus {
+	status := HealthStatus{Healthy: true, Checks: make(map[string]HealthCheck)}
+	now := time.Now()
+	readingSince := o.readingSince.Load()
+	if readingSince == 0 {
+		status.add(firehoseCheck, HealthCheck{Healthy: true, Message: "not reading from the firehose yet"})
+		for _, out := range o.outputs {
+			status.add(out.healthCheckName(), HealthCheck{Healthy: true, Message: "not posting yet"})
+		}
+		return status
+	}
+
+	lastEnvelope := o.lastEnvelopeAt.Load()
+	check := HealthCheck{Healthy: true, Message: "no envelope received yet"}
+	if lastEnvelope != 0 {
+		check.Message = fmt.Sprintf("last envelope received %s ago", age(now, lastEnvelope))
+	}
+	if maxAge := o.nozzleConfig.Health.MaxEnvelopeAge; maxAge > 0 && now.Sub(time.Unix(0, max(lastEnvelope, readingSince))) > maxAge {
+		check.Healthy = false
+		check.Message = fmt.Sprintf("no envelope received for more than %s", maxAge)
+	}
+	status.add(firehoseCheck, check)
+
+	for _, out := range o.outputs {
+		status.add(out.healthCheckName(), o.postCheck(out, now, readingSince))
+	}
+	return status
+}
+
+// postCheck checks whether the posts to out succeed
+func (o *OmsNozzle) postCheck(out *output, now time.Time, readingSince int64) HealthCheck {
+	lastSuccess, lastFailure := out.lastPostSuccessAt.Load(), out.lastPostFailureAt.Load()
+	check := HealthCheck{Healthy: true, Message: "no post yet"}
+	switch {
+	case lastFailure > lastSuccess:
+		check.Message = fmt.Sprintf("last post failed %s ago", age(now, lastFailure))
+		if maxAge := o.nozzleConfig.Health.MaxPostFailureAge; maxAge > 0 && now.Sub(time.Unix(0, max(lastSuccess, readingSince))) > maxAge {
+			check.Healthy = false
+			check.Message = fmt.Sprintf("posts failing for more than %s", maxAge)
+		}
+	case lastSuccess != 0:
+		check.Message = fmt.Sprintf("last post succeeded %s ago", age(now, lastSuccess))
+	}
+	return check
+}
+
+// healthCheckName returns the name of the check of the posts to out, oms for the default output
+// and oms/<name> for the others
+func (out *output) healthCheckName() string {
+	if out.Name == DefaultOutput {
+		return omsCheck
+	}
+	return omsCheck + "/" + out.Name
+}
+
+// Readiness reports whether the nozzle is healthy, has loaded the app cache and has received
+// envelopes from the firehose
+func (o *OmsNozzle) Readiness() HealthStatus {
+	status := o.Health()
+	if o.cachingClient.Initialized() {
+		status.add(cacheCheck, HealthCheck{Healthy: true, Message: "app cache loaded"})
+	} else {
+		status.add(cacheCheck, HealthCheck{Healthy: false, Message: "app cache not loaded yet"})
+	}
+	if o.lastEnvelopeAt.Load() == 0 {
+		status.add(firehoseCheck, HealthCheck{Healthy: false, Message: "no envelope received yet"})
+	}
+	return status
+}
+
+// HealthHandler serves Health, with status 503 if the nozzle is unhealthy
+func (o *OmsNozzle) HealthHandler() http.Handler {
+	return healthHandler(o.Health)
+}
+
+// ReadyHandler serves Readiness, with status 503 if the nozzle is not ready
+func (o *OmsNozzle) ReadyHandler() http.Handler {
+	return healthHandler(o.Readiness)
+}
+
+func healthHandler(check func() HealthStatus) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		status := check()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status) //nolint:errcheck
+	})
+}
+
+func age(now time.Time, unixNano int64) time.Duration {
+	return now.Sub(time.Unix(0, unixNano)).Truncate(time.Millisecond)
+}
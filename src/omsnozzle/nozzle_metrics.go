@@ -0,0 +1,59 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package omsnozzle
+
+import (
+	"sync/atomic"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
+)
+
+// nozzleMetrics are the metrics the nozzle records beyond its event totals
+type nozzleMetrics struct {
+	postDuration   *metrics.Histogram // by log type, output and result
+	batchEvents    *metrics.Histogram // by log type and output
+	batchBytes     *metrics.Histogram // by log type and output
+	postRetries    *metrics.Counter   // by log type and output
+	recordsDropped *metrics.Counter   // by output
+	jsonLogs       *metrics.Counter   // by result
+	joinedLines    *metrics.Counter   // log lines joined into the record of a previous line
+}
+
+var (
+	batchEventsBuckets = []float64{1, 10, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	batchBytesBuckets  = []float64{1 << 10, 10 << 10, 100 << 10, 512 << 10, 1 << 20, 5 << 20, 10 << 20, 20 << 20, 30 << 20}
+)
+
+// registerMetrics registers the metrics of the nozzle with registry, which may be nil
+func (o *OmsNozzle) registerMetrics(registry *metrics.Registry) {
+	counter := func(total *uint64) func() float64 {
+		return func() float64 { return float64(atomic.LoadUint64(total)) }
+	}
+	registry.CounterFunc("nozzle_events_received_total", "Events received from the firehose", counter(&o.totalEventsReceived))
+	registry.CounterFunc("nozzle_events_sent_total", "Events posted to Log Analytics", counter(&o.totalEventsSent))
+	registry.CounterFunc("nozzle_events_lost_total", "Events that failed to post and were not spooled", counter(&o.totalEventsLost))
+	registry.CounterFunc("nozzle_events_dropped_total", "Events dropped because the nozzle or one of its outputs could not keep up with the firehose", counter(&o.totalEventsDropped))
+	registry.CounterFunc("nozzle_events_truncated_total", "Events with fields truncated to the field size limit", counter(&o.totalEventsTruncated))
+	registry.CounterFunc("nozzle_events_filtered_total", "Events excluded by the envelope filter", counter(&o.totalEventsFiltered))
+	registry.CounterFunc("nozzle_data_sent_total", "Events posted to Log Analytics, including replayed ones", counter(&o.totalDataSent))
+	registry.GaugeFunc("nozzle_envelope_channel_length", "Envelopes read from the firehose and waiting to be processed", func() float64 {
+		return float64(len(o.msgChan) + len(o.v2MsgChan))
+	})
+	registry.GaugeFunc("nozzle_processed_channel_length", "Processed messages waiting to be batched", func() float64 {
+		length := 0
+		for _, out := range o.outputs {
+			length += len(out.records)
+		}
+		return float64(length)
+	})
+	o.metrics = &nozzleMetrics{
+		postDuration:   registry.Histogram("nozzle_post_duration_seconds", "Duration of posts to Log Analytics", metrics.DefBuckets, "log_type", "output", "result"),
+		batchEvents:    registry.Histogram("nozzle_batch_events", "Number of events per batch", batchEventsBuckets, "log_type", "output"),
+		batchBytes:     registry.Histogram("nozzle_batch_bytes", "Size of batches in bytes", batchBytesBuckets, "log_type", "output"),
+		postRetries:    registry.Counter("nozzle_post_retries_total", "Retries of failed posts", "log_type", "output"),
+		recordsDropped: registry.Counter("nozzle_output_events_dropped_total", "Events dropped because their output could not keep up", "output"),
+		jsonLogs:       registry.Counter("nozzle_json_logs_total", "JSON log lines of apps by parse result", "result"),
+		joinedLines:    registry.Counter("nozzle_multiline_lines_joined_total", "Log lines joined into the record of a previous line"),
+	}
+}
@@ -5,6 +5,7 @@ package omsnozzle
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
@@ -17,65 +18,134 @@ import (
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/caching"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/firehose"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/loggregator"
 	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/messages"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/multiline"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/redact"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/spool"
+)
+
+// message types of records created from V2 envelopes
+const (
+	v2LogMessageType   = "LogMessage"
+	v2CounterEventType = "CounterEvent"
+	v2GaugeType        = "Gauge"
+	v2TimerType        = "Timer"
+	v2EventType        = "Event"
 )
 
 type ProcessedMessage struct {
 	msgType string
-	data    interface{}
+	data    json.RawMessage
 }
 
 type OmsNozzle struct {
-	logger              lager.Logger
-	maxCCGoroutines     int
-	msgChan             chan *events.Envelope
-	processedMessages   chan ProcessedMessage
-	signalChan          chan os.Signal
-	omsClient           client.Client
-	firehoseClient      firehose.Client
-	nozzleConfig        *NozzleConfig
-	goroutineSem        chan int // to control the number of active post goroutines
-	cachingClient       caching.CachingClient
-	totalEventsReceived uint64
-	totalEventsSent     uint64
-	totalEventsLost     uint64
-	totalDataSent       uint64
-	totalEventsDropped  uint64
-	mutex               *sync.Mutex
+	logger               lager.Logger
+	maxCCGoroutines      int
+	msgChan              chan *events.Envelope
+	v2MsgChan            chan *loggregator.Envelope
+	signalChan           chan os.Signal
+	stopChan             chan struct{} // closed by Stop
+	stopReadingChan      chan struct{} // closed to stop reading from the firehose on shutdown
+	stopOnce             *sync.Once
+	processors           *sync.WaitGroup // running processEnvelopes goroutines
+	outputs              []*output       // the default output first
+	outputsByName        map[string]*output
+	firehoseClient       firehose.Client
+	nozzleConfig         *NozzleConfig
+	cachingClient        caching.CachingClient
+	totalEventsReceived  uint64
+	totalEventsSent      uint64
+	totalEventsLost      uint64
+	totalDataSent        uint64
+	totalEventsDropped   uint64
+	totalEventsTruncated uint64
+	totalEventsFiltered  uint64
+	metrics              *nozzleMetrics
+	multiline            *multiline.Assembler // nil unless NozzleConfig.Multiline is set
+	// unix nano times for the health checks, zero if not happened yet
+	readingSince   atomic.Int64
+	lastEnvelopeAt atomic.Int64
+	mutex          *sync.Mutex
 }
 
 type NozzleConfig struct {
 	OmsTypePrefix         string
 	OmsBatchTime          time.Duration
 	OmsMaxMsgNumPerBatch  int
-	ExcludeMetricEvents   bool
-	ExcludeLogEvents      bool
-	ExcludeHttpEvents     bool
 	LogEventCount         bool
 	LogEventCountInterval time.Duration
+	NativeV2Envelopes     bool
+	ShutdownTimeout       time.Duration
+	// max size of a post, unless set per Output; batches are split to stay below it
+	OmsMaxBatchBytes int
+	RetryPolicy      RetryPolicy
+	Health           HealthConfig
+	// how the tags of envelopes are posted
+	Tags messages.TagsConfig
+	// optional; joins the lines of multiline app logs into single records, before JSON parsing
+	Multiline *multiline.Config
+	// optional; redacts secrets and personal data from log messages, URIs and errors
+	Redactor *redact.Redactor
+	// optional; parses the JSON log lines of apps into columns
+	JSONLogs *messages.JSONLogParser
+	// optional; events it excludes are not posted
+	Filter *filter.Filter
+	// optional; the nozzle registers its metrics here
+	Metrics *metrics.Registry
+	// optional; batches that fail all retries are spooled here instead of being lost
+	Spool *spool.Spool
+	// optional; outputs besides the default one, to which Router routes events by name
+	Outputs []Output
+	// optional; picks the output of events, the default one if it picks none
+	Router *filter.Router
 }
 
+const (
+	// used when NozzleConfig.ShutdownTimeout is not set
+	defaultShutdownTimeout = 10 * time.Second
+	// used when NozzleConfig.OmsMaxBatchBytes is not set, just under the 30 MB limit of a post
+	defaultMaxBatchBytes = 29 * 1024 * 1024
+	// fields longer than this are truncated, as Log Analytics does not store more
+	maxFieldBytes = 32 * 1024
+)
+
 func NewOmsNozzle(logger lager.Logger, firehoseClient firehose.Client, omsClient client.Client, nozzleConfig *NozzleConfig, caching caching.CachingClient) *OmsNozzle {
 	maxPostGoroutines := int(100000 / nozzleConfig.OmsMaxMsgNumPerBatch)
-	return &OmsNozzle{
-		logger:              logger,
-		msgChan:             make(chan *events.Envelope, 1000),
-		processedMessages:   make(chan ProcessedMessage, 1000),
-		signalChan:          make(chan os.Signal, 2),
-		omsClient:           omsClient,
-		firehoseClient:      firehoseClient,
-		nozzleConfig:        nozzleConfig,
-		goroutineSem:        make(chan int, maxPostGoroutines),
-		maxCCGoroutines:     maxPostGoroutines / 10,
-		cachingClient:       caching,
-		totalEventsReceived: uint64(0),
-		totalEventsSent:     uint64(0),
-		totalEventsLost:     uint64(0),
-		totalDataSent:       uint64(0),
-		totalEventsDropped:  uint64(0),
-		mutex:               &sync.Mutex{},
+	o := &OmsNozzle{
+		logger:               logger,
+		msgChan:              make(chan *events.Envelope, 1000),
+		v2MsgChan:            make(chan *loggregator.Envelope, 1000),
+		signalChan:           make(chan os.Signal, 2),
+		stopChan:             make(chan struct{}),
+		stopReadingChan:      make(chan struct{}),
+		stopOnce:             &sync.Once{},
+		processors:           &sync.WaitGroup{},
+		outputsByName:        make(map[string]*output),
+		firehoseClient:       firehoseClient,
+		nozzleConfig:         nozzleConfig,
+		maxCCGoroutines:      maxPostGoroutines / 10,
+		cachingClient:        caching,
+		totalEventsReceived:  uint64(0),
+		totalEventsSent:      uint64(0),
+		totalEventsLost:      uint64(0),
+		totalDataSent:        uint64(0),
+		totalEventsDropped:   uint64(0),
+		totalEventsTruncated: uint64(0),
+		totalEventsFiltered:  uint64(0),
+		mutex:                &sync.Mutex{},
+	}
+	outputs := append([]Output{{Name: DefaultOutput, Client: omsClient, Spool: nozzleConfig.Spool}}, nozzleConfig.Outputs...)
+	for _, config := range outputs {
+		out := newOutput(config, maxPostGoroutines)
+		o.outputs = append(o.outputs, out)
+		o.outputsByName[out.Name] = out
 	}
+	o.registerMetrics(nozzleConfig.Metrics)
+	return o
 }
 
 func (o *OmsNozzle) Start() error {
@@ -83,110 +153,315 @@ func (o *OmsNozzle) Start() error {
 
 	// setup for termination signal from CF
 	signal.Notify(o.signalChan, syscall.SIGTERM, syscall.SIGINT)
+	if o.nozzleConfig.Multiline != nil {
+		o.multiline = multiline.NewAssembler(*o.nozzleConfig.Multiline, func(m *messages.LogMessage, lines int, output string) {
+			o.emitLogMessage(o.outputsByName[output], m, lines)
+		})
+	}
+	for _, out := range o.outputs {
+		go o.batchEvents(out)
+		if out.Spool != nil {
+			go o.replaySpool(out)
+		}
+	}
 	go o.readEnvelopes()
 	for i := 0; i <= o.maxCCGoroutines; i++ {
 		//this should also be refactored
+		o.processors.Add(1)
 		go o.processEnvelopes()
 	}
+	go func() {
+		// processEnvelopes returns once readEnvelopes has closed the envelope channels on shutdown
+		o.processors.Wait()
+		// emit the log records still being assembled
+		o.multiline.Close()
+		for _, out := range o.outputs {
+			close(out.records)
+		}
+	}()
 	if o.nozzleConfig.LogEventCount {
 		o.logTotalEvents(o.nozzleConfig.LogEventCountInterval)
 	}
-	err := o.routeEvents()
-	return err
+	return o.awaitStop()
+}
+
+// Stop shuts the nozzle down the same way as a termination signal does
+func (o *OmsNozzle) Stop() {
+	o.stopOnce.Do(func() {
+		close(o.stopChan)
+	})
 }
 
 func (o *OmsNozzle) readEnvelopes() {
+	defer close(o.msgChan)
+	defer close(o.v2MsgChan)
+	if v2Client, ok := o.firehoseClient.(firehose.V2Client); ok && o.nozzleConfig.NativeV2Envelopes {
+		o.readV2Envelopes(v2Client)
+		return
+	}
+	o.readingSince.Store(time.Now().UnixNano())
 	msgChan, errChan := o.firehoseClient.Connect()
 	for {
 		select {
 		case msg := <-msgChan:
+			o.lastEnvelopeAt.Store(time.Now().UnixNano())
 			select {
 			case o.msgChan <- msg:
 			default:
-				o.totalEventsDropped = o.totalEventsDropped + 1
-				if o.totalEventsDropped%1000 == 0 {
-					o.logger.Error("dropping messages", nil, lager.Data{"total dropped": o.totalEventsDropped})
-				}
+				o.dropEnvelope()
 			}
 		case err := <-errChan:
-			o.logger.Error("Error while reading from the firehose", err)
-
-			if strings.Contains(err.Error(), "close 1008 (policy violation)") {
-				o.logger.Error("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.", nil)
-				o.logSlowConsumerAlert()
-			}
-
-			o.logger.Error("Closing connection with traffic controller", nil)
-			o.firehoseClient.CloseConsumer() //nolint:errcheck
+			o.handleFirehoseError(err)
 			msgChan, errChan = o.firehoseClient.Connect()
+		case <-o.stopReadingChan:
+			return
 		}
 	}
 }
 
-func (o *OmsNozzle) processEnvelopes() {
+func (o *OmsNozzle) readV2Envelopes(v2Client firehose.V2Client) {
+	o.readingSince.Store(time.Now().UnixNano())
+	msgChan, errChan := v2Client.ConnectV2()
 	for {
-		msg := <-o.msgChan
-		atomic.AddUint64(&o.totalEventsReceived, 1)
-		// process message
-		var omsMessageType = msg.GetEventType().String()
-		switch msg.GetEventType() {
-		// Metrics
-		case events.Envelope_ValueMetric:
-			if !o.nozzleConfig.ExcludeMetricEvents {
-				omsMessage := messages.NewValueMetric(msg, o.cachingClient)
-				o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
-			}
-		case events.Envelope_CounterEvent:
-			m := messages.NewCounterEvent(msg, o.cachingClient)
-			if strings.Contains(m.Name, "TruncatingBuffer.DroppedMessage") {
-				o.logger.Error("received TruncatingBuffer alert", nil)
-				o.logSlowConsumerAlert()
+		select {
+		case msg := <-msgChan:
+			o.lastEnvelopeAt.Store(time.Now().UnixNano())
+			select {
+			case o.v2MsgChan <- msg:
+			default:
+				o.dropEnvelope()
 			}
-			if strings.Contains(m.Name, "doppler_proxy.slow_consumer") && m.Delta > 0 {
-				o.logger.Error("received slow_consumer alert", nil)
-				o.logSlowConsumerAlert()
+		case err := <-errChan:
+			o.handleFirehoseError(err)
+			msgChan, errChan = v2Client.ConnectV2()
+		case <-o.stopReadingChan:
+			return
+		}
+	}
+}
+
+func (o *OmsNozzle) dropEnvelope() {
+	totalDropped := atomic.AddUint64(&o.totalEventsDropped, 1)
+	if totalDropped%1000 == 0 {
+		o.logger.Error("dropping messages", nil, lager.Data{"total dropped": totalDropped})
+	}
+}
+
+func (o *OmsNozzle) handleFirehoseError(err error) {
+	o.logger.Error("Error while reading from the firehose", err)
+
+	if strings.Contains(err.Error(), "close 1008 (policy violation)") {
+		o.logger.Error("Disconnected because nozzle couldn't keep up. Please try scaling up the nozzle.", nil)
+		o.logSlowConsumerAlert()
+	}
+
+	o.logger.Error("Closing connection with traffic controller", nil)
+	o.firehoseClient.CloseConsumer() //nolint:errcheck
+}
+
+func (o *OmsNozzle) processEnvelopes() {
+	defer o.processors.Done()
+	msgChan, v2MsgChan := o.msgChan, o.v2MsgChan
+	for msgChan != nil || v2MsgChan != nil {
+		select {
+		case msg, ok := <-msgChan:
+			if !ok {
+				msgChan = nil
+				continue
 			}
-			if !o.nozzleConfig.ExcludeMetricEvents {
-				omsMessage := m
-				o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
+			o.processEnvelope(msg)
+		case msg, ok := <-v2MsgChan:
+			if !ok {
+				v2MsgChan = nil
+				continue
 			}
+			o.processV2Envelope(msg)
+		}
+	}
+}
 
-		case events.Envelope_ContainerMetric:
-			if !o.nozzleConfig.ExcludeMetricEvents {
-				omsMessage := messages.NewContainerMetric(msg, o.cachingClient)
-				if omsMessage != nil { //nolint:staticcheck
-					o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
-				}
-			}
+func (o *OmsNozzle) processEnvelope(msg *events.Envelope) {
+	atomic.AddUint64(&o.totalEventsReceived, 1)
+	if msg.GetEventType() == events.Envelope_CounterEvent {
+		o.checkSlowConsumerCounter(msg.GetCounterEvent().GetName(), msg.GetCounterEvent().GetDelta())
+	}
+	event := filter.NewEvent(msg, o.cachingClient)
+	if !o.nozzleConfig.Filter.Include(event) {
+		atomic.AddUint64(&o.totalEventsFiltered, 1)
+		return
+	}
+	out := o.route(event)
+	// process message
+	var omsMessageType = msg.GetEventType().String()
+	switch msg.GetEventType() {
+	// Metrics
+	case events.Envelope_ValueMetric:
+		omsMessage := messages.NewValueMetric(msg, o.cachingClient)
+		o.emit(out, omsMessageType, omsMessage)
+	case events.Envelope_CounterEvent:
+		omsMessage := messages.NewCounterEvent(msg, o.cachingClient)
+		o.emit(out, omsMessageType, omsMessage)
+
+	case events.Envelope_ContainerMetric:
+		omsMessage := messages.NewContainerMetric(msg, o.cachingClient)
+		if omsMessage != nil { //nolint:staticcheck
+			o.emit(out, omsMessageType, omsMessage)
+		}
 
-		// Logs Errors
-		case events.Envelope_LogMessage:
-			if !o.nozzleConfig.ExcludeLogEvents {
-				omsMessage := messages.NewLogMessage(msg, o.cachingClient)
-				if omsMessage != nil {
-					o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
-				}
-			}
+	// Logs Errors
+	case events.Envelope_LogMessage:
+		omsMessage := messages.NewLogMessage(msg, o.cachingClient)
+		if omsMessage != nil {
+			o.addLogMessage(out, omsMessage)
+		}
 
-		case events.Envelope_Error:
-			if !o.nozzleConfig.ExcludeLogEvents {
-				omsMessage := messages.NewError(msg, o.cachingClient)
-				o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
-			}
+	case events.Envelope_Error:
+		omsMessage := messages.NewError(msg, o.cachingClient)
+		omsMessage.Message = o.nozzleConfig.Redactor.Redact("Error.Message", omsMessage.Message)
+		o.emit(out, omsMessageType, omsMessage)
+
+	// HTTP Start/Stop
+	case events.Envelope_HttpStartStop:
+		omsMessage := messages.NewHTTPStartStop(msg, o.cachingClient)
+		if omsMessage != nil {
+			omsMessage.URI = o.nozzleConfig.Redactor.Redact("HttpStartStop.URI", omsMessage.URI)
+			o.emit(out, omsMessageType, omsMessage)
+		}
+	default:
+		o.logger.Info("uncategorized message", lager.Data{"message": msg.String()})
+	}
+}
 
-		// HTTP Start/Stop
-		case events.Envelope_HttpStartStop:
-			if !o.nozzleConfig.ExcludeHttpEvents {
-				omsMessage := messages.NewHTTPStartStop(msg, o.cachingClient)
-				if omsMessage != nil {
-					o.processedMessages <- ProcessedMessage{msgType: omsMessageType, data: omsMessage}
-				}
-			}
-		default:
-			o.logger.Info("uncategorized message", lager.Data{"message": msg.String()})
+func (o *OmsNozzle) processV2Envelope(msg *loggregator.Envelope) {
+	atomic.AddUint64(&o.totalEventsReceived, 1)
+	var omsMessageType string
+	switch {
+	case msg.Log != nil:
+		omsMessageType = v2LogMessageType
+	case msg.Event != nil:
+		omsMessageType = v2EventType
+	case msg.Counter != nil:
+		omsMessageType = v2CounterEventType
+		o.checkSlowConsumerCounter(msg.Counter.Name, uint64(msg.Counter.Delta))
+	case msg.Gauge != nil:
+		omsMessageType = v2GaugeType
+	case msg.Timer != nil:
+		omsMessageType = v2TimerType
+	default:
+		o.logger.Info("uncategorized message", lager.Data{"sourceId": msg.SourceId})
+		return
+	}
+	event := filter.NewEventV2(msg, omsMessageType, o.cachingClient)
+	if !o.nozzleConfig.Filter.Include(event) {
+		atomic.AddUint64(&o.totalEventsFiltered, 1)
+		return
+	}
+	out := o.route(event)
+	switch omsMessageType {
+	// Logs Events
+	case v2LogMessageType:
+		omsMessage := messages.NewLogMessageV2(msg, o.cachingClient)
+		if omsMessage != nil {
+			o.addLogMessage(out, omsMessage)
+		}
+	case v2EventType:
+		omsMessage := messages.NewEvent(msg, o.cachingClient)
+		o.emit(out, omsMessageType, omsMessage)
+
+	// Metrics
+	case v2CounterEventType:
+		omsMessage := messages.NewCounterEventV2(msg, o.cachingClient)
+		o.emit(out, omsMessageType, omsMessage)
+	case v2GaugeType:
+		omsMessage := messages.NewGauge(msg, o.cachingClient)
+		if omsMessage != nil {
+			o.emit(out, omsMessageType, omsMessage)
+		}
+
+	// HTTP Timers
+	case v2TimerType:
+		omsMessage := messages.NewTimer(msg, o.cachingClient)
+		if omsMessage != nil {
+			o.emit(out, omsMessageType, omsMessage)
 		}
 	}
+}
+
+// addLogMessage passes m, routed to out, to the multiline assembler if there is one, or emits it
+func (o *OmsNozzle) addLogMessage(out *output, m *messages.LogMessage) {
+	if o.multiline != nil {
+		o.multiline.Add(m, out.Name)
+		return
+	}
+	o.emitLogMessage(out, m, 1)
+}
 
+// emitLogMessage emits a log record made of the given number of lines to out
+func (o *OmsNozzle) emitLogMessage(out *output, m *messages.LogMessage, lines int) {
+	if lines > 1 {
+		o.metrics.joinedLines.Add(float64(lines - 1))
+	}
+	// redacted before parsing, so that the fields of JSON log lines are redacted too
+	m.Message = o.nozzleConfig.Redactor.Redact("LogMessage.Message", m.Message)
+	o.parseJSONLog(m)
+	o.emit(out, v2LogMessageType, m)
+}
+
+// parseJSONLog parses the message of m into columns if it is a JSON log line to parse
+func (o *OmsNozzle) parseJSONLog(m *messages.LogMessage) {
+	if result := o.nozzleConfig.JSONLogs.Parse(m); result != messages.JSONLogSkipped {
+		o.metrics.jsonLogs.Inc(result)
+	}
+}
+
+// emit serializes msg for the batches of out. Fields over the size limit of Log Analytics are
+// truncated, and records that do not fit into a batch even so are refused. If out drops records
+// when full, records that it cannot keep up with are dropped rather than holding up the other
+// outputs, except on shutdown.
+func (o *OmsNozzle) emit(out *output, msgType string, msg interface{}) {
+	if messages.TruncateFields(msg, maxFieldBytes) {
+		atomic.AddUint64(&o.totalEventsTruncated, 1)
+	}
+	record, err := o.nozzleConfig.Tags.Marshal(msg)
+	if err != nil {
+		o.logger.Error("error marshalling message to JSON", err, lager.Data{"event type": msgType})
+		atomic.AddUint64(&o.totalEventsLost, 1)
+		return
+	}
+	if len(record)+2 > o.maxBatchBytes(out) {
+		o.logger.Error("refusing message larger than the max batch size", nil,
+			lager.Data{"event type": msgType},
+			lager.Data{"size": len(record)},
+			lager.Data{"max batch size": o.maxBatchBytes(out)})
+		atomic.AddUint64(&o.totalEventsLost, 1)
+		return
+	}
+	processed := ProcessedMessage{msgType: msgType, data: record}
+	if !out.DropWhenFull {
+		out.records <- processed
+		return
+	}
+	select {
+	case out.records <- processed:
+	case <-o.stopReadingChan:
+		// the envelopes read before shutdown are all posted
+		out.records <- processed
+	default:
+		o.dropRecord(out)
+	}
+}
+
+// checkSlowConsumerCounter alerts on counters of the firehose that report a slow nozzle, whether
+// counter events are filtered or not
+func (o *OmsNozzle) checkSlowConsumerCounter(name string, delta uint64) {
+	if strings.Contains(name, "TruncatingBuffer.DroppedMessage") {
+		o.logger.Error("received TruncatingBuffer alert", nil)
+		o.logSlowConsumerAlert()
+	}
+	if strings.Contains(name, "doppler_proxy.slow_consumer") && delta > 0 {
+		o.logger.Error("received slow_consumer alert", nil)
+		o.logSlowConsumerAlert()
+	}
 }
 
 func (o *OmsNozzle) logTotalEvents(interval time.Duration) {
@@ -195,6 +470,9 @@ func (o *OmsNozzle) logTotalEvents(interval time.Duration) {
 	lastSentCount := uint64(0)
 	lastLostCount := uint64(0)
 	lastDroppedCount := uint64(0)
+	lastTruncatedCount := uint64(0)
+	lastFilteredCount := uint64(0)
+	lastSpoolStats := spool.Stats{}
 
 	go func() {
 		for range logEventCountTicker.C {
@@ -203,26 +481,37 @@ func (o *OmsNozzle) logTotalEvents(interval time.Duration) {
 			totalSentCount := atomic.LoadUint64(&o.totalEventsSent)
 			totalLostCount := atomic.LoadUint64(&o.totalEventsLost)
 			totalDroppedCount := atomic.LoadUint64(&o.totalEventsDropped)
-			currentEvents := make(map[string][]interface{})
+			totalTruncatedCount := atomic.LoadUint64(&o.totalEventsTruncated)
+			totalFilteredCount := atomic.LoadUint64(&o.totalEventsFiltered)
+			currentEvents := make(eventBatches)
 
 			// Generate CounterEvent
-			o.addEventCountEvent("eventsReceived", totalReceivedCount-lastReceivedCount, totalReceivedCount, &timeStamp, &currentEvents)
-			o.addEventCountEvent("eventsSent", totalSentCount-lastSentCount, totalSentCount, &timeStamp, &currentEvents)
-			o.addEventCountEvent("eventsLost", totalLostCount-lastLostCount, totalLostCount, &timeStamp, &currentEvents)
-			o.addEventCountEvent("eventsDropped", totalDroppedCount-lastDroppedCount, totalDroppedCount, &timeStamp, &currentEvents)
+			o.addEventCountEvent("eventsReceived", totalReceivedCount-lastReceivedCount, totalReceivedCount, &timeStamp, currentEvents)
+			o.addEventCountEvent("eventsSent", totalSentCount-lastSentCount, totalSentCount, &timeStamp, currentEvents)
+			o.addEventCountEvent("eventsLost", totalLostCount-lastLostCount, totalLostCount, &timeStamp, currentEvents)
+			o.addEventCountEvent("eventsDropped", totalDroppedCount-lastDroppedCount, totalDroppedCount, &timeStamp, currentEvents)
+			o.addEventCountEvent("eventsTruncated", totalTruncatedCount-lastTruncatedCount, totalTruncatedCount, &timeStamp, currentEvents)
+			o.addEventCountEvent("eventsFiltered", totalFilteredCount-lastFilteredCount, totalFilteredCount, &timeStamp, currentEvents)
+			if spoolStats, ok := o.spoolStats(); ok {
+				o.addEventCountEvent("eventsSpooled", spoolStats.EventsSpooled-lastSpoolStats.EventsSpooled, spoolStats.EventsSpooled, &timeStamp, currentEvents)
+				o.addEventCountEvent("eventsReplayed", spoolStats.EventsReplayed-lastSpoolStats.EventsReplayed, spoolStats.EventsReplayed, &timeStamp, currentEvents)
+				o.addEventCountEvent("eventsSpoolExpired", spoolStats.EventsExpired-lastSpoolStats.EventsExpired, spoolStats.EventsExpired, &timeStamp, currentEvents)
+				lastSpoolStats = spoolStats
+			}
 
-			o.goroutineSem <- 1
-			o.postData(&currentEvents, false)
+			o.postData(o.outputs[0], currentEvents, false)
 
 			lastReceivedCount = totalReceivedCount
 			lastSentCount = totalSentCount
 			lastLostCount = totalLostCount
 			lastDroppedCount = totalDroppedCount
+			lastTruncatedCount = totalTruncatedCount
+			lastFilteredCount = totalFilteredCount
 		}
 	}()
 }
 
-func (o *OmsNozzle) addEventCountEvent(name string, deltaCount uint64, count uint64, timeStamp *int64, currentEvents *map[string][]interface{}) {
+func (o *OmsNozzle) addEventCountEvent(name string, deltaCount uint64, count uint64, timeStamp *int64, currentEvents eventBatches) {
 	counterEvent := &events.CounterEvent{
 		Name:  &name,
 		Delta: &deltaCount,
@@ -243,95 +532,205 @@ func (o *OmsNozzle) addEventCountEvent(name string, deltaCount uint64, count uin
 	var omsMsg OMSMessage
 	eventTypeString := eventType.String()
 	omsMsg = messages.NewCounterEvent(envelope, o.cachingClient)
-	(*currentEvents)[eventTypeString] = append((*currentEvents)[eventTypeString], omsMsg)
+	if record, err := json.Marshal(omsMsg); err == nil {
+		currentEvents.add(eventTypeString, record)
+	}
 }
 
-func (o *OmsNozzle) postData(events *map[string][]interface{}, addCount bool) {
-	for k, v := range *events {
-		v := v
+func (o *OmsNozzle) postData(out *output, events eventBatches, addCount bool) {
+	for k, batch := range events {
+		v := batch.records
 		if len(v) <= 0 {
 			continue
 		}
-		if msgAsJson, err := json.Marshal(&v); err != nil {
-			o.logger.Error("error marshalling message to JSON", err,
-				lager.Data{"event type": k},
-				lager.Data{"event count": len(v)})
-		} else {
-			o.logger.Debug("Posting to OMS",
-				lager.Data{"event type": k},
-				lager.Data{"event count": len(v)},
-				lager.Data{"total size": len(msgAsJson)})
-			if len(o.nozzleConfig.OmsTypePrefix) > 0 {
-				k = o.nozzleConfig.OmsTypePrefix + k
-			}
-			nRetries := 4
-			for nRetries > 0 {
-				requestStartTime := time.Now()
-				if err = o.omsClient.PostData(&msgAsJson, k); err != nil {
-					nRetries--
-					elapsedTime := time.Since(requestStartTime)
-					o.logger.Error("error posting message to OMS", err,
-						lager.Data{"event type": k},
-						lager.Data{"elapse time": elapsedTime.String()},
-						lager.Data{"event count": len(v)},
-						lager.Data{"total size": len(msgAsJson)},
-						lager.Data{"remaining attempts": nRetries})
-					time.Sleep(time.Second * 1)
-				} else {
-					if addCount {
-						atomic.AddUint64(&o.totalEventsSent, uint64(len(v)))
-						atomic.AddUint64(&o.totalDataSent, uint64(len(v)))
-					}
-					break
-				}
+		msgAsJson := batch.marshal()
+		if len(o.nozzleConfig.OmsTypePrefix) > 0 {
+			k = o.nozzleConfig.OmsTypePrefix + k
+		}
+		o.metrics.batchEvents.Observe(float64(len(v)), k, out.Name)
+		o.metrics.batchBytes.Observe(float64(len(msgAsJson)), k, out.Name)
+		o.logger.Debug("Posting to OMS",
+			lager.Data{"output": out.Name},
+			lager.Data{"event type": k},
+			lager.Data{"event count": len(v)},
+			lager.Data{"total size": len(msgAsJson)})
+		err := o.postWithRetries(out, &msgAsJson, k, len(v))
+		if err == nil {
+			if addCount {
+				atomic.AddUint64(&o.totalEventsSent, uint64(len(v)))
+				atomic.AddUint64(&o.totalDataSent, uint64(len(v)))
 			}
-			if nRetries == 0 && addCount {
-				atomic.AddUint64(&o.totalEventsLost, uint64(len(v)))
+			continue
+		}
+		if !addCount {
+			continue
+		}
+		// permanent failures would fail again on replay
+		if out.Spool != nil && client.IsRetryable(err) {
+			err := out.Spool.Store(k, msgAsJson, len(v))
+			if err == nil {
+				continue
 			}
+			o.logger.Error("error spooling message", err,
+				lager.Data{"output": out.Name},
+				lager.Data{"event type": k},
+				lager.Data{"event count": len(v)})
+		}
+		atomic.AddUint64(&o.totalEventsLost, uint64(len(v)))
+	}
+}
+
+// postWithRetries posts a batch following the retry policy, and returns the error of the last attempt
+func (o *OmsNozzle) postWithRetries(out *output, msg *[]byte, logType string, count int) error {
+	policy := o.nozzleConfig.RetryPolicy
+	maxAttempts := policy.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		requestStartTime := time.Now()
+		err := out.Client.PostData(msg, logType)
+		if err == nil {
+			o.metrics.postDuration.Observe(time.Since(requestStartTime).Seconds(), logType, out.Name, "success")
+			out.lastPostSuccessAt.Store(time.Now().UnixNano())
+			return nil
+		}
+		o.metrics.postDuration.Observe(time.Since(requestStartTime).Seconds(), logType, out.Name, "error")
+		out.lastPostFailureAt.Store(time.Now().UnixNano())
+		retryable := client.IsRetryable(err)
+		remainingAttempts := maxAttempts - attempt
+		if !retryable {
+			remainingAttempts = 0
+		}
+		o.logger.Error("error posting message to OMS", err,
+			lager.Data{"output": out.Name},
+			lager.Data{"event type": logType},
+			lager.Data{"elapse time": time.Since(requestStartTime).String()},
+			lager.Data{"event count": count},
+			lager.Data{"total size": len(*msg)},
+			lager.Data{"retryable": retryable},
+			lager.Data{"remaining attempts": remainingAttempts})
+		if remainingAttempts <= 0 {
+			return err
+		}
+		if !o.waitToRetry(out, policy.delay(attempt, err)) {
+			o.logger.Info("not retrying on shutdown",
+				lager.Data{"output": out.Name},
+				lager.Data{"event type": logType},
+				lager.Data{"event count": count})
+			return err
 		}
+		o.metrics.postRetries.Inc(logType, out.Name)
 	}
-	<-o.goroutineSem
 }
 
-func (o *OmsNozzle) routeEvents() error {
-	pendingEvents := make(map[string][]interface{})
-	// Firehose message processing loop
+// waitToRetry waits for delay before retrying a post to out. If out has a spool, it stops
+// waiting on shutdown and returns false, so that the batch is spooled instead of holding up
+// the shutdown.
+func (o *OmsNozzle) waitToRetry(out *output, delay time.Duration) bool {
+	if out.Spool == nil {
+		time.Sleep(delay)
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-o.stopReadingChan:
+		return false
+	}
+}
+
+// replaySpool periodically posts the spooled batches of out until the nozzle shuts down
+func (o *OmsNozzle) replaySpool(out *output) {
 	ticker := time.NewTicker(o.nozzleConfig.OmsBatchTime)
+	defer ticker.Stop()
 	for {
-		// loop over message and signal channel
 		select {
-		case s := <-o.signalChan:
-			o.logger.Info("exiting", lager.Data{"signal caught": s.String()})
-			err := o.firehoseClient.CloseConsumer()
-			if err != nil {
-				o.logger.Error("error closing consumer", err)
-			}
-			os.Exit(1)
 		case <-ticker.C:
-			// get the pending as current
-			currentEvents := pendingEvents
-			// reset the pending events
-			pendingEvents = make(map[string][]interface{})
-			o.goroutineSem <- 1
-			go o.postData(&currentEvents, true)
-		case msg := <-o.processedMessages:
-			pendingEvents[msg.msgType] = append(pendingEvents[msg.msgType], msg.data)
-			// When the number of one type of events reaches the max per batch, trigger the post immediately
-			doPost := false
-			for _, v := range pendingEvents {
-				if len(v) >= o.nozzleConfig.OmsMaxMsgNumPerBatch {
-					doPost = true
-					break
-				}
-			}
-			if doPost {
-				currentEvents := pendingEvents
-				pendingEvents = make(map[string][]interface{})
-				o.goroutineSem <- 1
-				go o.postData(&currentEvents, true)
-			}
+			// hold a post slot so shutdown waits for the replay to finish
+			out.goroutineSem <- 1
+			replayed := out.Spool.Replay(out.Client.PostData)
+			<-out.goroutineSem
+			atomic.AddUint64(&o.totalEventsSent, replayed)
+			atomic.AddUint64(&o.totalDataSent, replayed)
+		case <-o.stopReadingChan:
+			return
+		}
+	}
+}
+
+// awaitStop waits for a termination signal or Stop, then shuts the nozzle down
+func (o *OmsNozzle) awaitStop() error {
+	select {
+	case s := <-o.signalChan:
+		o.logger.Info("exiting", lager.Data{"signal caught": s.String()})
+	case <-o.stopChan:
+		o.logger.Info("exiting", lager.Data{"stop requested": true})
+	}
+	return o.shutdown()
+}
+
+// addPendingEvent adds msg to the pending events of out and posts them if a batch is full,
+// either by number of messages or by size. It returns the events that are still pending.
+func (o *OmsNozzle) addPendingEvent(out *output, pendingEvents eventBatches, msg ProcessedMessage) eventBatches {
+	// When a batch would exceed the max size with msg, post the pending events first
+	if batch, ok := pendingEvents[msg.msgType]; ok && batch.sizeWith(msg.data) > o.maxBatchBytes(out) {
+		pendingEvents = o.postPendingEvents(out, pendingEvents)
+	}
+	pendingEvents.add(msg.msgType, msg.data)
+	// When the number of one type of events reaches the max per batch, trigger the post immediately
+	for _, v := range pendingEvents {
+		if len(v.records) >= o.nozzleConfig.OmsMaxMsgNumPerBatch {
+			return o.postPendingEvents(out, pendingEvents)
+		}
+	}
+	return pendingEvents
+}
+
+// postPendingEvents posts the pending events of out asynchronously and returns new, empty
+// pending events
+func (o *OmsNozzle) postPendingEvents(out *output, pendingEvents eventBatches) eventBatches {
+	out.goroutineSem <- 1
+	go func() {
+		defer func() { <-out.goroutineSem }()
+		o.postData(out, pendingEvents, true)
+	}()
+	return make(eventBatches)
+}
+
+// shutdown stops reading from the firehose, posts every envelope that was already read
+// and waits for all posts in flight. It gives up once the shutdown timeout has passed.
+func (o *OmsNozzle) shutdown() error {
+	timeout := o.nozzleConfig.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	close(o.stopReadingChan)
+	if err := o.firehoseClient.CloseConsumer(); err != nil {
+		o.logger.Error("error closing consumer", err)
+	}
+
+	// the records of outputs are closed once all envelopes in the channels are processed
+	for _, out := range o.outputs {
+		select {
+		case <-out.done:
+		case <-deadline.C:
+			return o.shutdownTimedOut(timeout)
 		}
 	}
+	o.logger.Info("shutdown completed",
+		lager.Data{"total received": atomic.LoadUint64(&o.totalEventsReceived)},
+		lager.Data{"total sent": atomic.LoadUint64(&o.totalEventsSent)},
+		lager.Data{"total lost": atomic.LoadUint64(&o.totalEventsLost)})
+	return nil
+}
+
+func (o *OmsNozzle) shutdownTimedOut(timeout time.Duration) error {
+	err := fmt.Errorf("pending events were not posted within the shutdown timeout of %s", timeout)
+	o.logger.Error("shutdown timed out", err)
+	return err
 }
 
 // Log slowConsumerAlert as a ValueMetric event to OMS
@@ -358,11 +757,15 @@ func (o *OmsNozzle) logSlowConsumerAlert() {
 	}
 
 	omsMsg := messages.NewValueMetric(envelope, o.cachingClient)
-	currentEvents := make(map[string][]interface{})
-	currentEvents[eventType.String()] = append(currentEvents[eventType.String()], omsMsg)
+	record, err := json.Marshal(omsMsg)
+	if err != nil {
+		o.logger.Error("error marshalling message to JSON", err)
+		return
+	}
+	currentEvents := make(eventBatches)
+	currentEvents.add(eventType.String(), record)
 
-	o.goroutineSem <- 1
-	o.postData(&currentEvents, false)
+	o.postData(o.outputs[0], currentEvents, false)
 }
 
 // OMSMessage is a marker inteface for JSON formatted messages published to OMS
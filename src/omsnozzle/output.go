@@ -0,0 +1,127 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package omsnozzle
+
+import (
+	"sync/atomic"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/filter"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/spool"
+)
+
+// DefaultOutput is the name of the output of the client passed to NewOmsNozzle, which gets the
+// events that NozzleConfig.Router routes to no other output
+const DefaultOutput = "default"
+
+// Output is a destination of events besides the default one, e.g. another Log Analytics
+// workspace or Data Collection Rule
+type Output struct {
+	Name   string
+	Client client.Client
+	// optional; batches that fail all retries are spooled here instead of being lost
+	Spool *spool.Spool
+	// optional; NozzleConfig.OmsMaxBatchBytes if not set
+	MaxBatchBytes int
+	// drop the records routed to the output when it cannot keep up, rather than holding up the
+	// other outputs; records are never dropped on shutdown
+	DropWhenFull bool
+}
+
+// output batches and posts the events routed to an Output. Outputs have their own batches, post
+// goroutines and retries, so that a slow destination only holds up the others once its records
+// are full, unless it drops them.
+type output struct {
+	Output
+	records      chan ProcessedMessage
+	goroutineSem chan int      // to control the number of active post goroutines
+	done         chan struct{} // closed once the records are posted on shutdown
+	// unix nano times for the health checks, zero if not happened yet
+	lastPostSuccessAt atomic.Int64
+	lastPostFailureAt atomic.Int64
+}
+
+func newOutput(o Output, maxPostGoroutines int) *output {
+	return &output{
+		Output:       o,
+		records:      make(chan ProcessedMessage, 1000),
+		goroutineSem: make(chan int, maxPostGoroutines),
+		done:         make(chan struct{}),
+	}
+}
+
+// route returns the output e is routed to
+func (o *OmsNozzle) route(e *filter.Event) *output {
+	if out, ok := o.outputsByName[o.nozzleConfig.Router.Route(e)]; ok {
+		return out
+	}
+	return o.outputs[0]
+}
+
+// maxBatchBytes returns the max size of the batches posted to out
+func (o *OmsNozzle) maxBatchBytes(out *output) int {
+	if out.MaxBatchBytes > 0 {
+		return out.MaxBatchBytes
+	}
+	if o.nozzleConfig.OmsMaxBatchBytes > 0 {
+		return o.nozzleConfig.OmsMaxBatchBytes
+	}
+	return defaultMaxBatchBytes
+}
+
+// dropRecord counts a record dropped because its output could not keep up
+func (o *OmsNozzle) dropRecord(out *output) {
+	o.metrics.recordsDropped.Inc(out.Name)
+	totalDropped := atomic.AddUint64(&o.totalEventsDropped, 1)
+	if totalDropped%1000 == 0 {
+		o.logger.Error("dropping messages", nil, lager.Data{"output": out.Name}, lager.Data{"total dropped": totalDropped})
+	}
+}
+
+// batchEvents batches the records of out and posts them until the records are closed on
+// shutdown. It then posts the pending records and waits for the posts in flight.
+func (o *OmsNozzle) batchEvents(out *output) {
+	defer close(out.done)
+	pendingEvents := make(eventBatches)
+	ticker := time.NewTicker(o.nozzleConfig.OmsBatchTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pendingEvents = o.postPendingEvents(out, pendingEvents)
+		case msg, ok := <-out.records:
+			if !ok {
+				o.postPendingEvents(out, pendingEvents)
+				// all posts are done once every slot of the semaphore could be taken
+				for i := 0; i < cap(out.goroutineSem); i++ {
+					out.goroutineSem <- 1
+				}
+				return
+			}
+			pendingEvents = o.addPendingEvent(out, pendingEvents, msg)
+		}
+	}
+}
+
+// spoolStats returns the sum of the stats of the spools of all outputs, and whether there are any
+func (o *OmsNozzle) spoolStats() (spool.Stats, bool) {
+	var total spool.Stats
+	found := false
+	for _, out := range o.outputs {
+		if out.Spool == nil {
+			continue
+		}
+		stats := out.Spool.Stats()
+		total.Batches += stats.Batches
+		total.Events += stats.Events
+		total.Bytes += stats.Bytes
+		total.EventsSpooled += stats.EventsSpooled
+		total.EventsReplayed += stats.EventsReplayed
+		total.EventsExpired += stats.EventsExpired
+		found = true
+	}
+	return total, found
+}
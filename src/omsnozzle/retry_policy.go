@@ -0,0 +1,68 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package omsnozzle
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+)
+
+// defaults of RetryPolicy fields that are not set
+const (
+	defaultMaxAttempts    = 4
+	defaultBaseRetryDelay = 1 * time.Second
+	defaultMaxRetryDelay  = 30 * time.Second
+)
+
+// RetryPolicy configures how failed posts are retried. The delay before a retry doubles with
+// every attempt, starting at BaseDelay and capped at MaxDelay, unless the server asked for a
+// specific delay with Retry-After, which is capped at MaxDelay as well. Permanent failures are
+// never retried.
+type RetryPolicy struct {
+	// number of attempts to post a batch, including the first one
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// fraction of the delay, between 0 and 1, that is randomized to spread out retries of several nozzles
+	Jitter float64
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// delay returns the time to wait after the failed attempt, counted from 1
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = defaultBaseRetryDelay
+	}
+	if max <= 0 {
+		max = defaultMaxRetryDelay
+	}
+	if retryAfter := client.RetryAfter(err); retryAfter > 0 {
+		// a post waiting longer would hold up its output and the shutdown
+		return min(retryAfter, max)
+	}
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if jitter := p.Jitter; jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		// spread the delay evenly within +/- jitter of itself
+		delay = time.Duration(float64(delay) * (1 - jitter + 2*jitter*rand.Float64())) //nolint:gosec
+	}
+	return delay
+}
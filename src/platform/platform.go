@@ -0,0 +1,97 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package platform detects where the nozzle runs: as a CF app, as a BOSH job, or standalone, e.g.
+// in a container or locally. It takes the API address of the CF environment and the identity of
+// the nozzle instance from whichever the platform provides.
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/config"
+)
+
+// Kinds of platforms
+const (
+	CFApp      = "cf-app"
+	BOSH       = "bosh"
+	Standalone = "standalone"
+)
+
+// Environment variables of the BOSH job, set by its bpm config
+const (
+	boshDeploymentEnv    = "BOSH_DEPLOYMENT"
+	boshInstanceGroupEnv = "BOSH_INSTANCE_GROUP"
+	boshInstanceIDEnv    = "BOSH_INSTANCE_ID"
+)
+
+// Platform is what the platform the nozzle runs on tells about it
+type Platform struct {
+	Kind string
+	// API address of the CF environment, empty if the platform does not provide it
+	APIAddress string
+	// name of the nozzle instance, e.g. oms_nozzle/0 for a CF app or nozzle/<id> for a BOSH job;
+	// empty if the platform does not identify instances
+	InstanceName string
+	// port the platform routes to and health checks, empty if there is none
+	Port string
+}
+
+// vcapApplication holds the fields of VCAP_APPLICATION the nozzle uses
+type vcapApplication struct {
+	CFAPI           string `json:"cf_api"`
+	ApplicationName string `json:"application_name"`
+	InstanceIndex   *int   `json:"instance_index"`
+}
+
+// Detect detects the platform from the environment variables returned by getenv
+func Detect(getenv func(string) string) (*Platform, error) {
+	if vcap := getenv("VCAP_APPLICATION"); vcap != "" {
+		var app vcapApplication
+		if err := json.Unmarshal([]byte(vcap), &app); err != nil {
+			return nil, fmt.Errorf("invalid VCAP_APPLICATION: %s", err)
+		}
+		p := &Platform{Kind: CFApp, APIAddress: app.CFAPI, InstanceName: app.ApplicationName, Port: getenv("PORT")}
+		// CF_INSTANCE_INDEX is missing from tasks and older platforms
+		if index := getenv("CF_INSTANCE_INDEX"); index != "" {
+			p.InstanceName += "/" + index
+		} else if app.InstanceIndex != nil {
+			p.InstanceName += fmt.Sprintf("/%d", *app.InstanceIndex)
+		}
+		return p, nil
+	}
+	if group, id := getenv(boshInstanceGroupEnv), getenv(boshInstanceIDEnv); group != "" && id != "" {
+		name := group + "/" + id
+		if deployment := getenv(boshDeploymentEnv); deployment != "" {
+			name = deployment + "/" + name
+		}
+		return &Platform{Kind: BOSH, InstanceName: name}, nil
+	}
+	return &Platform{Kind: Standalone}, nil
+}
+
+// Configure sets the addresses of c that are not set: the API address to the one of the
+// platform, the address of the firehose to the one derived from the API address, and the
+// address of the metrics and health checks to the port of the platform, which CF health checks
+func (p *Platform) Configure(c *config.Config) {
+	if c.Metrics.Address == "" && p.Port != "" {
+		c.Metrics.Address = ":" + p.Port
+	}
+	if c.CF.APIAddress == "" {
+		c.CF.APIAddress = p.APIAddress
+	}
+	if c.CF.APIAddress == "" {
+		// Validate reports it
+		return
+	}
+	if c.Firehose.UseRLPGateway {
+		if c.Firehose.RLPGatewayAddress == "" {
+			c.Firehose.RLPGatewayAddress = strings.Replace(c.CF.APIAddress, "https://api.", "https://log-stream.", 1)
+		}
+	} else if c.Firehose.DopplerAddress == "" {
+		c.Firehose.DopplerAddress = strings.Replace(c.CF.APIAddress, "https://api.", "wss://doppler.", 1) + ":443"
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package platform_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/config"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/platform"
+)
+
+var _ = Describe("Platform", func() {
+	var env map[string]string
+
+	getenv := func(key string) string {
+		return env[key]
+	}
+
+	BeforeEach(func() {
+		env = map[string]string{}
+	})
+
+	Describe("Detect", func() {
+		It("detects CF apps", func() {
+			env["VCAP_APPLICATION"] = `{"cf_api":"https://api.sys.example.com","application_name":"oms_nozzle","instance_index":3}`
+			env["CF_INSTANCE_INDEX"] = "1"
+			env["PORT"] = "8080"
+
+			p, err := platform.Detect(getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(Equal(&platform.Platform{Kind: platform.CFApp, APIAddress: "https://api.sys.example.com", InstanceName: "oms_nozzle/1", Port: "8080"}))
+
+			delete(env, "CF_INSTANCE_INDEX")
+			p, err = platform.Detect(getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.InstanceName).To(Equal("oms_nozzle/3"))
+		})
+
+		It("rejects an invalid VCAP_APPLICATION", func() {
+			env["VCAP_APPLICATION"] = `{"cf_api":`
+
+			_, err := platform.Detect(getenv)
+			Expect(err).To(MatchError(ContainSubstring("invalid VCAP_APPLICATION")))
+		})
+
+		It("detects BOSH jobs", func() {
+			env["BOSH_DEPLOYMENT"] = "nozzle"
+			env["BOSH_INSTANCE_GROUP"] = "oms"
+			env["BOSH_INSTANCE_ID"] = "5e8f1c2a"
+
+			p, err := platform.Detect(getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(Equal(&platform.Platform{Kind: platform.BOSH, InstanceName: "nozzle/oms/5e8f1c2a"}))
+		})
+
+		It("runs standalone otherwise", func() {
+			p, err := platform.Detect(getenv)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(Equal(&platform.Platform{Kind: platform.Standalone}))
+		})
+	})
+
+	Describe("Configure", func() {
+		var c *config.Config
+
+		BeforeEach(func() {
+			c = config.Default()
+		})
+
+		It("takes the API address from the platform and derives the firehose address", func() {
+			(&platform.Platform{Kind: platform.CFApp, APIAddress: "https://api.sys.example.com"}).Configure(c)
+
+			Expect(c.CF.APIAddress).To(Equal("https://api.sys.example.com"))
+			Expect(c.Firehose.DopplerAddress).To(Equal("wss://doppler.sys.example.com:443"))
+		})
+
+		It("keeps the addresses that are set", func() {
+			c.CF.APIAddress = "https://api.other.example.com"
+			c.Firehose.UseRLPGateway = true
+			(&platform.Platform{Kind: platform.CFApp, APIAddress: "https://api.sys.example.com"}).Configure(c)
+
+			Expect(c.CF.APIAddress).To(Equal("https://api.other.example.com"))
+			Expect(c.Firehose.RLPGatewayAddress).To(Equal("https://log-stream.other.example.com"))
+			Expect(c.Firehose.DopplerAddress).To(BeEmpty())
+		})
+
+		It("serves metrics and health checks on the port of the platform", func() {
+			(&platform.Platform{Kind: platform.CFApp, Port: "8080"}).Configure(c)
+			Expect(c.Metrics.Address).To(Equal(":8080"))
+
+			c.Metrics.Address = "127.0.0.1:9090"
+			(&platform.Platform{Kind: platform.CFApp, Port: "8080"}).Configure(c)
+			Expect(c.Metrics.Address).To(Equal("127.0.0.1:9090"))
+		})
+
+		It("leaves the addresses empty without an API address", func() {
+			(&platform.Platform{Kind: platform.Standalone}).Configure(c)
+
+			Expect(c.Firehose.DopplerAddress).To(BeEmpty())
+			Expect(c.Metrics.Address).To(BeEmpty())
+			Expect(c.Validate()).To(MatchError(ContainSubstring("cf.api_address is required")))
+		})
+	})
+})
@@ -0,0 +1,317 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package redact replaces secrets and personal data in log messages with a placeholder naming
+// what was redacted, e.g. [REDACTED:jwt], before they are posted to Log Analytics. See Detectors
+// for the built-in detectors. Custom patterns are regular expressions; if one has a group named
+// secret, only the text of the group is redacted, e.g. (?i)apikey=(?P<secret>\w+).
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/metrics"
+)
+
+// Detectors are the names of the built-in detectors, in the order they are applied
+var Detectors = []string{"jwt", "azure-storage-key", "url-password", "email", "card-number"}
+
+// CustomDetector is the detector name of custom patterns
+const CustomDetector = "custom"
+
+const secretGroup = "secret"
+
+type detector struct {
+	name string
+	// returns the start and end of the secrets in text
+	find func(text string) [][2]int
+	// optional; a cheap test that text may contain a secret, to skip find
+	mayContain func(text string) bool
+}
+
+var builtInDetectors = map[string]detector{
+	// JSON Web Tokens, such as the bearer tokens of UAA, are three base64url parts with a JSON header
+	"jwt": {
+		find:       findPattern(`eyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*`),
+		mayContain: contains("eyJ"),
+	},
+	// keys and SAS signatures of connection strings, and bare account keys: 64 bytes in base64
+	"azure-storage-key": {
+		find: findPattern(`(?i)(?:AccountKey|SharedAccessKey|SharedAccessSignature|sig)=(?P<secret>[A-Za-z0-9+/%]{16,}={0,2})|` +
+			`\b(?P<secret>[A-Za-z0-9+/]{86}==)`),
+		mayContain: contains("="),
+	},
+	"url-password": {
+		find:       findURLPasswords,
+		mayContain: contains("://"),
+	},
+	"email": {
+		find:       findEmails,
+		mayContain: contains("@"),
+	},
+	"card-number": {
+		find:       findCardNumbers,
+		mayContain: hasDigits(minCardDigits),
+	},
+}
+
+// Redactor redacts text with a set of detectors. A nil Redactor redacts nothing.
+type Redactor struct {
+	detectors  []detector
+	redactions *metrics.Counter // by detector and field
+}
+
+// New creates a Redactor with the named built-in detectors and custom patterns, and registers
+// its metrics with registry, which may be nil
+func New(detectors []string, customPatterns []string, registry *metrics.Registry) (*Redactor, error) {
+	r := &Redactor{}
+	for _, name := range detectors {
+		d, ok := builtInDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown detector %q, must be one of %s", name, strings.Join(Detectors, ", "))
+		}
+		d.name = name
+		r.detectors = append(r.detectors, d)
+	}
+	for _, p := range customPatterns {
+		pattern, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+		if pattern.MatchString("") {
+			return nil, fmt.Errorf("invalid pattern %q: matches empty text", p)
+		}
+		r.detectors = append(r.detectors, detector{name: CustomDetector, find: patternFinder(pattern)})
+	}
+	if len(r.detectors) == 0 {
+		return nil, fmt.Errorf("no detectors")
+	}
+	r.redactions = registry.Counter("nozzle_redactions_total", "Secrets and personal data redacted from events", "detector", "field")
+	return r, nil
+}
+
+// Redact returns text with what the detectors find replaced, counting the redactions of field
+func (r *Redactor) Redact(field string, text string) string {
+	if r == nil || text == "" {
+		return text
+	}
+	for i := range r.detectors {
+		d := &r.detectors[i]
+		if d.mayContain != nil && !d.mayContain(text) {
+			continue
+		}
+		var redacted int
+		text, redacted = d.redact(text)
+		if redacted > 0 {
+			r.redactions.Add(float64(redacted), d.name, field)
+		}
+	}
+	return text
+}
+
+// redact returns text with the secrets d finds replaced, and the number of secrets replaced
+func (d *detector) redact(text string) (string, int) {
+	secrets := d.find(text)
+	if secrets == nil {
+		return text, 0
+	}
+	placeholder := "[REDACTED:" + d.name + "]"
+	var b strings.Builder
+	last := 0
+	for _, secret := range secrets {
+		b.WriteString(text[last:secret[0]])
+		b.WriteString(placeholder)
+		last = secret[1]
+	}
+	b.WriteString(text[last:])
+	return b.String(), len(secrets)
+}
+
+func findPattern(pattern string) func(string) [][2]int {
+	return patternFinder(regexp.MustCompile(pattern))
+}
+
+// patternFinder finds the matches of pattern, or the text of their secret group if it matched
+func patternFinder(pattern *regexp.Regexp) func(string) [][2]int {
+	var groups []int
+	for i, name := range pattern.SubexpNames() {
+		if name == secretGroup {
+			groups = append(groups, i)
+		}
+	}
+	if groups == nil {
+		return func(text string) [][2]int {
+			var secrets [][2]int
+			for _, match := range pattern.FindAllStringIndex(text, -1) {
+				secrets = append(secrets, [2]int{match[0], match[1]})
+			}
+			return secrets
+		}
+	}
+	return func(text string) [][2]int {
+		var secrets [][2]int
+		for _, match := range pattern.FindAllStringSubmatchIndex(text, -1) {
+			secret := [2]int{match[0], match[1]}
+			for _, i := range groups {
+				if match[2*i] >= 0 {
+					secret = [2]int{match[2*i], match[2*i+1]}
+					break
+				}
+			}
+			secrets = append(secrets, secret)
+		}
+		return secrets
+	}
+}
+
+// findURLPasswords finds the passwords of user:password@ in URLs
+func findURLPasswords(text string) [][2]int {
+	var secrets [][2]int
+	for i := 0; ; {
+		scheme := strings.Index(text[i:], "://")
+		if scheme < 0 {
+			return secrets
+		}
+		// user info ends at the first @, and cannot contain the delimiters of URLs or quotes
+		start := i + scheme + len("://")
+		end := start + strings.IndexFunc(text[start:], func(r rune) bool {
+			return r == '@' || r == '/' || r == '?' || r == '#' || r == '"' || r == '\'' || r <= ' '
+		})
+		if end >= start && text[end] == '@' {
+			if colon := strings.IndexByte(text[start:end], ':'); colon > 0 && start+colon+1 < end {
+				secrets = append(secrets, [2]int{start + colon + 1, end})
+			}
+		}
+		i = start
+	}
+}
+
+// findEmails finds email addresses whose domain has a top level domain of letters
+func findEmails(text string) [][2]int {
+	var secrets [][2]int
+	last := 0
+	for i := 0; ; {
+		at := strings.IndexByte(text[i:], '@')
+		if at < 0 {
+			return secrets
+		}
+		at += i
+		start := at
+		for start > last && isEmailLocalByte(text[start-1]) {
+			start--
+		}
+		end, dot := at+1, -1
+		for end < len(text) && (isWordByte(text[end]) || text[end] == '-' || text[end] == '.') {
+			if text[end] == '.' {
+				dot = end
+			}
+			end++
+		}
+		// a final dot ends a sentence rather than the domain
+		if end > at+1 && text[end-1] == '.' {
+			end--
+			dot = strings.LastIndexByte(text[at+1:end], '.')
+			if dot >= 0 {
+				dot += at + 1
+			}
+		}
+		if start < at && dot > at+1 && end-dot > 2 && isLetters(text[dot+1:end]) {
+			secrets = append(secrets, [2]int{start, end})
+			last = end
+		}
+		i = at + 1
+	}
+}
+
+func isEmailLocalByte(c byte) bool {
+	return isWordByte(c) || strings.IndexByte(".%+-", c) >= 0
+}
+
+func isLetters(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= 'a' && s[i] <= 'z') && !(s[i] >= 'A' && s[i] <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	minCardDigits = 13
+	maxCardDigits = 19
+)
+
+// findCardNumbers finds the numbers of 13 to 19 digits, possibly separated by single spaces or
+// dashes, that pass the Luhn check. It is much faster than a regular expression.
+func findCardNumbers(text string) [][2]int {
+	var secrets [][2]int
+	for i := 0; i < len(text); i++ {
+		if !isDigit(text[i]) || (i > 0 && isWordByte(text[i-1])) {
+			continue
+		}
+		// the longest run of digits and separators from i, ending with a digit
+		end, digits := i, 0
+		for j := i; j < len(text); j++ {
+			if isDigit(text[j]) {
+				digits++
+				end = j + 1
+			} else if (text[j] != ' ' && text[j] != '-') || j+1 == len(text) || !isDigit(text[j+1]) {
+				break
+			}
+		}
+		if digits >= minCardDigits && digits <= maxCardDigits &&
+			(end == len(text) || !isWordByte(text[end])) && luhn(text[i:end]) {
+			secrets = append(secrets, [2]int{i, end})
+		}
+		i = end
+	}
+	return secrets
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordByte(c byte) bool {
+	return isDigit(c) || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func contains(s string) func(string) bool {
+	return func(text string) bool { return strings.Contains(text, s) }
+}
+
+// hasDigits returns a test that text has at least n digits
+func hasDigits(n int) func(string) bool {
+	return func(text string) bool {
+		digits := 0
+		for i := 0; i < len(text); i++ {
+			if isDigit(text[i]) {
+				if digits++; digits >= n {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// luhn returns whether the digits of number pass the Luhn check of card numbers
+func luhn(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		if !isDigit(number[i]) {
+			continue
+		}
+		digit := int(number[i] - '0')
+		if double {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
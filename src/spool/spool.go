@@ -0,0 +1,336 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/v3"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+)
+
+const (
+	batchSuffix = ".batch"
+	tmpSuffix   = ".tmp"
+)
+
+// Spool is a write-ahead queue on disk for batches that could not be posted.
+// Batches are kept per log type in one directory each, one file per batch, and
+// are replayed oldest first. The spool is bounded by total size and batch age;
+// batches beyond either bound are discarded and counted as expired.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	logger   lager.Logger
+
+	mutex   sync.Mutex
+	batches map[string][]*batch // by log type, oldest first
+	seq     uint64
+	stats   Stats
+}
+
+// Stats describes the content of the spool and the events that went through it
+type Stats struct {
+	Batches        int
+	Events         uint64
+	Bytes          int64
+	EventsSpooled  uint64
+	EventsReplayed uint64
+	EventsExpired  uint64
+}
+
+type batch struct {
+	logType string
+	path    string
+	created time.Time
+	size    int64
+	events  uint64
+}
+
+// PostFunc posts a spooled batch, as client.Client.PostData does
+type PostFunc func(msg *[]byte, logType string) error
+
+// NewSpool opens the spool in dir, creating it if necessary. Batches left by a
+// previous run are picked up for replay.
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration, logger lager.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		logger:   logger,
+		batches:  make(map[string][]*batch),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	logger.Info("spool loaded", lager.Data{"dir": dir}, lager.Data{"batches": s.stats.Batches}, lager.Data{"events": s.stats.Events})
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	typeDirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, typeDir := range typeDirs {
+		if !typeDir.IsDir() {
+			continue
+		}
+		logType := typeDir.Name()
+		files, err := os.ReadDir(filepath.Join(s.dir, logType))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			path := filepath.Join(s.dir, logType, f.Name())
+			if strings.HasSuffix(f.Name(), tmpSuffix) {
+				// incomplete write from a previous run
+				os.Remove(path) //nolint:errcheck
+				continue
+			}
+			b, err := parseBatchName(logType, path)
+			if err != nil {
+				s.logger.Error("ignoring unknown file in spool", err, lager.Data{"path": path})
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				return err
+			}
+			b.size = info.Size()
+			s.add(b)
+		}
+	}
+	return nil
+}
+
+// Store persists a batch of count events that failed to post
+func (s *Spool) Store(logType string, msg []byte, count int) error {
+	if logType == "" || logType != filepath.Base(logType) || strings.HasPrefix(logType, ".") {
+		return fmt.Errorf("invalid log type %q", logType)
+	}
+	typeDir := filepath.Join(s.dir, logType)
+	if err := os.MkdirAll(typeDir, 0700); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.seq++
+	seq := s.seq
+	s.mutex.Unlock()
+
+	created := time.Now()
+	name := fmt.Sprintf("%020d-%010d-%d%s", created.UnixNano(), seq, count, batchSuffix)
+	path := filepath.Join(typeDir, name)
+	tmp := path + tmpSuffix
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		os.Remove(tmp) //nolint:errcheck
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp) //nolint:errcheck
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.add(&batch{logType: logType, path: path, created: created, size: int64(len(msg)), events: uint64(count)})
+	s.stats.EventsSpooled += uint64(count)
+	s.enforceMaxBytes()
+	return nil
+}
+
+// Replay posts spooled batches oldest first and removes the ones posted successfully.
+// Batches of a log type are replayed in order, so replay of a log type stops at the
+// first failure that may be retried. Batches that fail permanently are discarded and
+// counted as expired. It returns the number of events replayed.
+func (s *Spool) Replay(post PostFunc) uint64 {
+	s.expire()
+
+	replayed := uint64(0)
+	for _, logType := range s.logTypes() {
+		for {
+			b := s.oldest(logType)
+			if b == nil {
+				break
+			}
+			msg, err := os.ReadFile(b.path)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					s.logger.Error("error reading spooled batch", err, lager.Data{"path": b.path})
+				}
+				s.mutex.Lock()
+				s.discardLocked(b)
+				s.mutex.Unlock()
+				continue
+			}
+			if err := post(&msg, logType); err != nil {
+				retryable := client.IsRetryable(err)
+				s.logger.Error("error replaying spooled batch", err,
+					lager.Data{"event type": logType},
+					lager.Data{"event count": b.events},
+					lager.Data{"retryable": retryable})
+				if retryable {
+					break
+				}
+				// the batch would fail again on every replay and hold up the ones after it
+				s.mutex.Lock()
+				s.discardLocked(b)
+				s.mutex.Unlock()
+				continue
+			}
+			s.remove(b)
+			os.Remove(b.path) //nolint:errcheck
+			replayed += b.events
+
+			s.mutex.Lock()
+			s.stats.EventsReplayed += b.events
+			s.mutex.Unlock()
+		}
+	}
+	return replayed
+}
+
+// Stats returns a snapshot of the spool statistics
+func (s *Spool) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+// add indexes a batch, keeping batches of each log type sorted by name
+func (s *Spool) add(b *batch) {
+	batches := append(s.batches[b.logType], b)
+	sort.Slice(batches, func(i, j int) bool { return batches[i].path < batches[j].path })
+	s.batches[b.logType] = batches
+	s.stats.Batches++
+	s.stats.Events += b.events
+	s.stats.Bytes += b.size
+}
+
+// remove drops a batch from the index; it is a no-op if the batch was already removed
+func (s *Spool) remove(b *batch) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removeLocked(b)
+}
+
+func (s *Spool) removeLocked(b *batch) bool {
+	batches := s.batches[b.logType]
+	for i := range batches {
+		if batches[i] == b {
+			s.batches[b.logType] = append(batches[:i:i], batches[i+1:]...)
+			s.stats.Batches--
+			s.stats.Events -= b.events
+			s.stats.Bytes -= b.size
+			return true
+		}
+	}
+	return false
+}
+
+// discardLocked removes a batch from disk and counts its events as expired
+func (s *Spool) discardLocked(b *batch) {
+	if !s.removeLocked(b) {
+		return
+	}
+	os.Remove(b.path) //nolint:errcheck
+	s.stats.EventsExpired += b.events
+	s.logger.Error("discarding spooled batch", nil,
+		lager.Data{"event type": b.logType},
+		lager.Data{"event count": b.events},
+		lager.Data{"created": b.created.String()})
+}
+
+// enforceMaxBytes discards the oldest batches across all log types until the spool fits
+func (s *Spool) enforceMaxBytes() {
+	for s.maxBytes > 0 && s.stats.Bytes > s.maxBytes {
+		var oldest *batch
+		for _, batches := range s.batches {
+			if len(batches) > 0 && (oldest == nil || batches[0].created.Before(oldest.created)) {
+				oldest = batches[0]
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		s.discardLocked(oldest)
+	}
+}
+
+// expire discards batches older than the max age
+func (s *Spool) expire() {
+	if s.maxAge <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cutoff := time.Now().Add(-s.maxAge)
+	for _, batches := range s.batches {
+		for _, b := range append([]*batch(nil), batches...) {
+			if b.created.After(cutoff) {
+				break
+			}
+			s.discardLocked(b)
+		}
+	}
+}
+
+func (s *Spool) logTypes() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	logTypes := make([]string, 0, len(s.batches))
+	for logType := range s.batches {
+		logTypes = append(logTypes, logType)
+	}
+	sort.Strings(logTypes)
+	return logTypes
+}
+
+func (s *Spool) oldest(logType string) *batch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if batches := s.batches[logType]; len(batches) > 0 {
+		return batches[0]
+	}
+	return nil
+}
+
+// parseBatchName reads creation time and event count from <unix nanos>-<seq>-<count>.batch
+func parseBatchName(logType string, path string) (*batch, error) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, batchSuffix) {
+		return nil, errors.New("not a spooled batch")
+	}
+	parts := strings.Split(strings.TrimSuffix(name, batchSuffix), "-")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed batch file name")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	events, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &batch{
+		logType: logType,
+		path:    path,
+		created: time.Unix(0, nanos),
+		events:  events,
+	}, nil
+}
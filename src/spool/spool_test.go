@@ -0,0 +1,147 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package spool_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/client"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/mocks"
+	"github.com/vmware-tanzu/nozzle-for-microsoft-azure-log-analytics/spool"
+)
+
+type post struct {
+	logType string
+	msg     string
+}
+
+var _ = Describe("Spool", func() {
+	var (
+		dir    string
+		s      *spool.Spool
+		posted []post
+	)
+
+	recordPost := func(msg *[]byte, logType string) error {
+		posted = append(posted, post{logType: logType, msg: string(*msg)})
+		return nil
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		posted = nil
+		var err error
+		s, err = spool.NewSpool(dir, 0, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("replays batches per log type in order", func() {
+		Expect(s.Store("CF_LogMessage", []byte("log1"), 1)).To(Succeed())
+		Expect(s.Store("CF_ValueMetric", []byte("metric1"), 2)).To(Succeed())
+		Expect(s.Store("CF_LogMessage", []byte("log2"), 3)).To(Succeed())
+		Expect(s.Stats()).To(Equal(spool.Stats{Batches: 3, Events: 6, Bytes: 15, EventsSpooled: 6}))
+
+		Expect(s.Replay(recordPost)).To(Equal(uint64(6)))
+
+		Expect(posted).To(Equal([]post{
+			{logType: "CF_LogMessage", msg: "log1"},
+			{logType: "CF_LogMessage", msg: "log2"},
+			{logType: "CF_ValueMetric", msg: "metric1"},
+		}))
+		Expect(s.Stats()).To(Equal(spool.Stats{EventsSpooled: 6, EventsReplayed: 6}))
+		Expect(filepath.Join(dir, "CF_LogMessage")).To(BeADirectory())
+		Expect(os.ReadDir(filepath.Join(dir, "CF_LogMessage"))).To(BeEmpty())
+	})
+
+	It("keeps batches from the first failed post of a log type on", func() {
+		Expect(s.Store("CF_LogMessage", []byte("log1"), 1)).To(Succeed())
+		Expect(s.Store("CF_LogMessage", []byte("log2"), 1)).To(Succeed())
+		Expect(s.Store("CF_Error", []byte("error1"), 1)).To(Succeed())
+
+		failing := func(msg *[]byte, logType string) error {
+			if logType == "CF_LogMessage" && string(*msg) == "log1" {
+				return errors.New("post failed")
+			}
+			return recordPost(msg, logType)
+		}
+		Expect(s.Replay(failing)).To(Equal(uint64(1)))
+		Expect(posted).To(Equal([]post{{logType: "CF_Error", msg: "error1"}}))
+		Expect(s.Stats().Events).To(Equal(uint64(2)))
+
+		posted = nil
+		Expect(s.Replay(recordPost)).To(Equal(uint64(2)))
+		Expect(posted).To(Equal([]post{
+			{logType: "CF_LogMessage", msg: "log1"},
+			{logType: "CF_LogMessage", msg: "log2"},
+		}))
+	})
+
+	It("discards batches that fail permanently and replays the ones after them", func() {
+		Expect(s.Store("CF_LogMessage", []byte("log1"), 1)).To(Succeed())
+		Expect(s.Store("CF_LogMessage", []byte("log2"), 2)).To(Succeed())
+
+		rejecting := func(msg *[]byte, logType string) error {
+			if string(*msg) == "log1" {
+				return &client.PostError{StatusCode: 400}
+			}
+			return recordPost(msg, logType)
+		}
+		Expect(s.Replay(rejecting)).To(Equal(uint64(2)))
+
+		Expect(posted).To(Equal([]post{{logType: "CF_LogMessage", msg: "log2"}}))
+		Expect(s.Stats()).To(Equal(spool.Stats{EventsSpooled: 3, EventsReplayed: 2, EventsExpired: 1}))
+		Expect(os.ReadDir(filepath.Join(dir, "CF_LogMessage"))).To(BeEmpty())
+	})
+
+	It("survives restarts", func() {
+		Expect(s.Store("CF_LogMessage", []byte("log1"), 4)).To(Succeed())
+		Expect(s.Store("CF_LogMessage", []byte("log2"), 5)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(dir, "CF_LogMessage", "partial.batch.tmp"), []byte("x"), 0600)).To(Succeed())
+
+		reopened, err := spool.NewSpool(dir, 0, 0, mocks.NewMockLogger())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reopened.Stats()).To(Equal(spool.Stats{Batches: 2, Events: 9, Bytes: 8}))
+
+		Expect(reopened.Replay(recordPost)).To(Equal(uint64(9)))
+		Expect(posted).To(Equal([]post{
+			{logType: "CF_LogMessage", msg: "log1"},
+			{logType: "CF_LogMessage", msg: "log2"},
+		}))
+		Expect(filepath.Join(dir, "CF_LogMessage", "partial.batch.tmp")).NotTo(BeAnExistingFile())
+	})
+
+	It("discards the oldest batches beyond the max size", func() {
+		s, _ = spool.NewSpool(dir, 10, 0, mocks.NewMockLogger())
+		Expect(s.Store("CF_LogMessage", []byte("12345"), 1)).To(Succeed())
+		Expect(s.Store("CF_ValueMetric", []byte("67890"), 2)).To(Succeed())
+		Expect(s.Store("CF_LogMessage", []byte("abcde"), 3)).To(Succeed())
+
+		Expect(s.Stats()).To(Equal(spool.Stats{Batches: 2, Events: 5, Bytes: 10, EventsSpooled: 6, EventsExpired: 1}))
+		s.Replay(recordPost)
+		Expect(posted).To(Equal([]post{
+			{logType: "CF_LogMessage", msg: "abcde"},
+			{logType: "CF_ValueMetric", msg: "67890"},
+		}))
+	})
+
+	It("discards batches older than the max age", func() {
+		s, _ = spool.NewSpool(dir, 0, 50*time.Millisecond, mocks.NewMockLogger())
+		Expect(s.Store("CF_LogMessage", []byte("old"), 1)).To(Succeed())
+		time.Sleep(100 * time.Millisecond)
+		Expect(s.Store("CF_LogMessage", []byte("new"), 2)).To(Succeed())
+
+		Expect(s.Replay(recordPost)).To(Equal(uint64(2)))
+		Expect(posted).To(Equal([]post{{logType: "CF_LogMessage", msg: "new"}}))
+		Expect(s.Stats().EventsExpired).To(Equal(uint64(1)))
+	})
+
+	It("rejects log types that are not plain names", func() {
+		Expect(s.Store("../CF_LogMessage", []byte("log"), 1)).To(MatchError(`invalid log type "../CF_LogMessage"`))
+	})
+})